@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// binaryMediaType is the media type of the compact binary response format,
+// for the clients issuing many queries, e.g., language servers, which
+// decode it faster than JSON. A response is the number of results,
+// followed by the results, each being the length of its path, the path,
+// and a byte of flags. The numbers are unsigned varints, as encoded by
+// binary.PutUvarint.
+const binaryMediaType = "application/vnd.gopaths.results"
+
+// The flags of the binary results.
+const (
+	binaryValid    = 1 << iota // There is a package in the directory.
+	binaryStdlib               // It's a standard library path.
+	binaryCommand              // It's the path of a main package.
+	binaryTestOnly             // The package has only _test.go files.
+)
+
+// appendBinary appends the binary encoding of the result to b.
+func appendBinary(b []byte, res result) []byte {
+	var flags byte
+	if res.entry.valid {
+		flags |= binaryValid
+	}
+	if res.Stdlib {
+		flags |= binaryStdlib
+	}
+	if res.Command {
+		flags |= binaryCommand
+	}
+	if res.TestOnly {
+		flags |= binaryTestOnly
+	}
+
+	b = binary.AppendUvarint(b, uint64(len(res.Path)))
+	b = append(b, res.Path...)
+	return append(b, flags)
+}
+
+// writeBinary writes the results in the binary format.
+func writeBinary(w http.ResponseWriter, results []result) {
+	w.Header().Set("Content-Type", binaryMediaType)
+
+	bw := bufio.NewWriter(w)
+	bw.Write(binary.AppendUvarint(nil, uint64(len(results))))
+	var b []byte
+	for _, res := range results {
+		b = appendBinary(b[:0], res)
+		if _, err := bw.Write(b); err != nil {
+			return
+		}
+	}
+	bw.Flush()
+}
+
+// readBinary decodes the results written by writeBinary, as a client
+// would: their paths, validity, and the other flags.
+func readBinary(r io.Reader) ([]result, error) {
+	br := bufio.NewReader(r)
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, fmt.Errorf("reading the number of results: %v", err)
+	}
+
+	results := []result{}
+	for i := uint64(0); i < n; i++ {
+		size, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, fmt.Errorf("result %d: %v", i, err)
+		}
+		path := make([]byte, size)
+		if _, err := io.ReadFull(br, path); err != nil {
+			return nil, fmt.Errorf("result %d: %v", i, err)
+		}
+		flags, err := br.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("result %d: %v", i, err)
+		}
+
+		results = append(results, result{
+			Path:     string(path),
+			Valid:    flags&binaryValid != 0,
+			Stdlib:   flags&binaryStdlib != 0,
+			Command:  flags&binaryCommand != 0,
+			TestOnly: flags&binaryTestOnly != 0,
+		})
+	}
+	return results, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"go/build"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"time"
+)
+
+// builtTime returns the modification time of the installed artifact of
+// the package: the archive in GOPATH/pkg of a library package, or the
+// executable of a command in GOBIN or GOPATH/bin, as "go install" puts
+// them, e.g., for ordering the packages by how recently they were built.
+// The time is zero if there's no artifact; the build cache isn't looked up,
+// as its entries can't be told by package.
+func builtTime(p *build.Package) time.Time {
+	target := p.PkgObj
+	if p.IsCommand() {
+		target = commandTarget(p)
+	}
+	if target == "" {
+		return time.Time{}
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// commandTarget returns the path "go install" installs the command to,
+// or "" if it's unknown.
+func commandTarget(p *build.Package) string {
+	bin := os.Getenv("GOBIN")
+	if bin == "" {
+		bin = p.BinDir
+	}
+	if bin == "" {
+		gopath := filepath.SplitList(build.Default.GOPATH)
+		if len(gopath) == 0 {
+			return ""
+		}
+		bin = filepath.Join(gopath[0], "bin")
+	}
+
+	name := path.Base(p.ImportPath)
+	if p.ImportPath == "" || p.ImportPath == "." {
+		name = filepath.Base(p.Dir)
+	}
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return filepath.Join(bin, name)
+}
+
+// artifactDirs returns the directories "go install" installs the
+// artifacts builtTime looks up to: GOBIN, and the archive directory of
+// the target platform and the bin directory of the GOPATH entries.
+func artifactDirs() []string {
+	dirs := []string{}
+	if bin := os.Getenv("GOBIN"); bin != "" {
+		dirs = append(dirs, bin)
+	}
+	platform := build.Default.GOOS + "_" + build.Default.GOARCH
+	for _, gopath := range filepath.SplitList(build.Default.GOPATH) {
+		dirs = append(dirs, filepath.Join(gopath, "pkg", platform), filepath.Join(gopath, "bin"))
+	}
+	return dirs
+}
+
+// stampArtifacts adds the directories of the installed artifacts to
+// the stamp, if the built times are recorded, so that reinstalling
+// a package, which replaces its artifact, is noticed as a change of
+// the trees, and the times are looked up again. The files themselves
+// aren't looked at, like the ones of the indexed trees.
+func (dirs *index) stampArtifacts(stamp *treeStamp) {
+	if !dirs.builtTimes {
+		return
+	}
+	for _, dir := range artifactDirs() {
+		filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || !d.IsDir() {
+				return nil
+			}
+			if info, err := d.Info(); err == nil {
+				stamp.add(info)
+			}
+			return nil
+		})
+	}
+}
+
+// sortBuilt returns the results ordered by the times their packages were
+// last built, the latest first, and then the results without artifacts,
+// in their order. The cached results aren't reordered.
+func sortBuilt(results []result) []result {
+	out := append([]result(nil), results...)
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].entry.builtTime.After(out[j].entry.builtTime)
+	})
+	return out
+}
+
+// parseSort reports whether the order named by the "sort" parameter
+// is by the built times, which requires them to be recorded. An empty
+// name keeps the order of the mode.
+func (dirs *index) parseSort(name string) (byBuilt bool, err error) {
+	switch name {
+	case "":
+		return false, nil
+	case "built":
+		if !dirs.builtTimes {
+			return false, fmt.Errorf("sort %q requires -built-times", name)
+		}
+		return true, nil
+	}
+	return false, fmt.Errorf("unknown sort %q", name)
+}
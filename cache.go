@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// cache is a least recently used cache of query results.
+// A nil cache caches nothing.
+type cache struct {
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	items map[cacheKey]*list.Element
+
+	// gen is incremented when the cache is cleared, so that results
+	// of queries racing with reindexing aren't cached.
+	gen uint64
+
+	hits, misses, evictions uint64
+}
+
+type cacheKey struct {
+	query       string
+	kind        queryKind
+	mode        queryMode
+	unversioned bool
+	folding     caseFolding
+
+	// roots are the directories the results are limited to, joined
+	// by NULs, if they are (see permittedRoots).
+	roots string
+}
+
+// permittedKey returns the key of the query limited to the directories.
+func permittedKey(key cacheKey, permitted []string) cacheKey {
+	key.roots = strings.Join(permitted, "\x00")
+	return key
+}
+
+// permitted returns the directories the results of the query are
+// limited to, or nil if they aren't.
+func (key cacheKey) permitted() []string {
+	if key.roots == "" {
+		return nil
+	}
+	return strings.Split(key.roots, "\x00")
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	results []result
+}
+
+// cacheStats are the cache counters reported by /stats.
+type cacheStats struct {
+	Size      int    `json:"size"`
+	Entries   int    `json:"entries"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+}
+
+// newCache returns a cache holding up to size query results,
+// or nil if size is not positive.
+func newCache(size int) *cache {
+	if size <= 0 {
+		return nil
+	}
+	return &cache{
+		size:  size,
+		ll:    list.New(),
+		items: make(map[cacheKey]*list.Element),
+	}
+}
+
+// get returns the cached results for the key, and the cache generation
+// to put the results computed on a miss with.
+func (c *cache) get(key cacheKey) (results []result, gen uint64, ok bool) {
+	if c == nil {
+		return nil, 0, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.hits++
+		c.ll.MoveToFront(e)
+		return e.Value.(*cacheEntry).results, c.gen, true
+	}
+	c.misses++
+	return nil, c.gen, false
+}
+
+// put caches the results unless the cache has been cleared since
+// the generation gen, evicting the least recently used results if full.
+func (c *cache) put(key cacheKey, gen uint64, results []result) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen != c.gen {
+		return
+	}
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		e.Value.(*cacheEntry).results = results
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(&cacheEntry{key, results})
+	for c.ll.Len() > c.size {
+		e := c.ll.Back()
+		c.ll.Remove(e)
+		delete(c.items, e.Value.(*cacheEntry).key)
+		c.evictions++
+	}
+}
+
+// clear empties the cache.
+func (c *cache) clear() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	c.ll.Init()
+	c.items = make(map[cacheKey]*list.Element)
+}
+
+func (c *cache) stats() (s cacheStats) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return cacheStats{
+		Size:      c.size,
+		Entries:   c.ll.Len(),
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+}
+
+// cachedQuery queries the index like queryIndex, caching the results.
+func (dirs *index) cachedQuery(ctx context.Context, key cacheKey) ([]result, error) {
+	results, gen, ok := dirs.cache.get(key)
+	if ok {
+		return results, nil
+	}
+
+	results, err := dirs.queryIndex(ctx, key.query, key.kind, key.mode, key.unversioned, key.folding, key.permitted())
+	if err == nil {
+		dirs.cache.put(key, gen, results)
+	}
+	return results, err
+}
+
+// parsePrefetch parses a list of queries to prefetch, one per line, written
+// as the paths of their requests, e.g., “imports/http” or
+// “dirs/x/tools?mode=prefix”, with the mode and unversioned parameters.
+// Empty lines and lines starting with ‘#’ are ignored.
+func parsePrefetch(r io.Reader) ([]cacheKey, error) {
+	keys := []cacheKey{}
+	s := bufio.NewScanner(r)
+
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		key, err := parsePrefetchQuery(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, s.Err()
+}
+
+// parsePrefetchQuery parses a query to prefetch, written as the path
+// of its request.
+func parsePrefetchQuery(text string) (cacheKey, error) {
+	u, err := url.Parse(strings.TrimPrefix(text, "/"))
+	if err != nil {
+		return cacheKey{}, err
+	}
+	parts := strings.SplitN(u.Path, "/", 2)
+	kind, ok := kindNames[parts[0]]
+	if !ok || parts[0] == "" || len(parts) < 2 {
+		return cacheKey{}, fmt.Errorf("invalid query %q", text)
+	}
+	mode, err := parseMode(u.Query().Get("mode"))
+	if err != nil {
+		return cacheKey{}, err
+	}
+	unversioned := false
+	if v := u.Query().Get("unversioned"); v != "" {
+		if unversioned, err = strconv.ParseBool(v); err != nil {
+			return cacheKey{}, fmt.Errorf("invalid unversioned parameter %q", v)
+		}
+	}
+	folding, err := parseFolding(u.Query().Get("case"))
+	if err != nil {
+		return cacheKey{}, err
+	}
+	return cacheKey{query: parts[1], kind: kind, mode: mode, unversioned: unversioned, folding: folding}, nil
+}
+
+// Prefetch runs the queries against the index, caching their results
+// so that the first requests for them after a start are answered
+// from the cache. It returns the number of queries cached.
+func (dirs *index) Prefetch(keys []cacheKey) int {
+	if dirs.cache == nil {
+		return 0
+	}
+
+	// With query tokens, the results are cached for the directories
+	// of each token.
+	dirs.mu.RLock()
+	scopes := tokenScopes(dirs.queryTokens)
+	dirs.mu.RUnlock()
+
+	n := 0
+	for _, key := range keys {
+		prefetched := true
+		for _, permitted := range scopes {
+			ctx, cancel := context.Background(), func() {}
+			if dirs.queryTimeout > 0 {
+				ctx, cancel = context.WithTimeout(ctx, dirs.queryTimeout)
+			}
+			if _, err := dirs.cachedQuery(ctx, permittedKey(key, permitted)); err != nil {
+				prefetched = false
+			}
+			cancel()
+		}
+		if prefetched {
+			n++
+		}
+	}
+	return n
+}
+
+// tokenScopes returns the distinct lists of directories the query
+// tokens permit, sorted, or a single nil list if there are no tokens.
+func tokenScopes(tokens map[string][]string) [][]string {
+	if tokens == nil {
+		return [][]string{nil}
+	}
+
+	seen := map[string]bool{}
+	scopes := [][]string{}
+	for _, roots := range tokens {
+		key := strings.Join(roots, "\x00")
+		if len(roots) == 0 || seen[key] {
+			continue
+		}
+		seen[key] = true
+		scopes = append(scopes, roots)
+	}
+	sort.Slice(scopes, func(i, j int) bool {
+		return strings.Join(scopes[i], "\x00") < strings.Join(scopes[j], "\x00")
+	})
+	return scopes
+}
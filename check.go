@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// checkFiles are the configuration files main loads, by their flags.
+// Empty file names are skipped.
+type checkFiles struct {
+	exclusions  string // -exclude
+	regexps     string // -exclude-regex
+	prefetch    string // -prefetch
+	queryTokens string // -query-tokens
+	dirs        string // -dirs
+	load        string // -load
+}
+
+// check validates the configuration without indexing or serving: that
+// the roots and the listed directories are existing directories, that
+// the exclusions given by names parse, and that the files do too, with
+// at least one exclusion in the exclusion file. It writes each problem
+// found to w, and returns the number of problems.
+func check(w io.Writer, roots, names []string, files checkFiles) int {
+	problems := 0
+	report := func(format string, args ...interface{}) {
+		fmt.Fprintf(w, format+"\n", args...)
+		problems++
+	}
+
+	checkDir := func(kind, dir string) {
+		fi, err := os.Stat(dir)
+		switch {
+		case err != nil:
+			report("%s %v", kind, err)
+		case !fi.IsDir():
+			report("%s %s: not a directory", kind, dir)
+		}
+	}
+	for _, root := range roots {
+		checkDir("root", root)
+	}
+
+	for _, name := range names {
+		if _, err := newExclusion(name); err != nil {
+			report("GOPATHS_EXCLUDE: %v", err)
+		}
+	}
+
+	if files.exclusions != "" {
+		rules := 0
+		exists := checkLines(files.exclusions, report, func(line string) error {
+			for _, rule := range strings.Fields(line) {
+				rules++
+				if _, err := newExclusion(rule); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if exists && rules == 0 {
+			report("%s: no exclusions in the file", files.exclusions)
+		}
+	}
+
+	if files.regexps != "" {
+		checkLines(files.regexps, report, func(line string) error {
+			if expr := strings.TrimSpace(line); expr != "" {
+				_, err := regexp.Compile(expr)
+				return err
+			}
+			return nil
+		})
+	}
+
+	if files.prefetch != "" {
+		checkLines(files.prefetch, report, func(line string) error {
+			if text := strings.TrimSpace(line); text != "" && !strings.HasPrefix(text, "#") {
+				_, err := parsePrefetchQuery(text)
+				return err
+			}
+			return nil
+		})
+	}
+
+	var dirs index
+	if files.queryTokens != "" {
+		if f, err := os.Open(files.queryTokens); err != nil {
+			report("%v", err)
+		} else {
+			if err := dirs.QueryTokens(bufio.NewReader(f)); err != nil {
+				report("%s: %v", files.queryTokens, err)
+			}
+			f.Close()
+		}
+	}
+
+	if files.dirs != "" {
+		if err := listDirs(&dirs, files.dirs); err != nil {
+			report("%v", err)
+		}
+		for _, dir := range dirs.listedDirs {
+			checkDir("listed", dir)
+		}
+	}
+
+	if files.load != "" {
+		if _, err := loadIndex(&dirs, files.load); err != nil {
+			report("%v", err)
+		}
+	}
+
+	return problems
+}
+
+// checkLines reports the lines of the file failing the check, by their
+// numbers, or the error reading the file. It returns whether the file
+// could be opened.
+func checkLines(file string, report func(format string, args ...interface{}), check func(line string) error) bool {
+	f, err := os.Open(file)
+	if err != nil {
+		report("%v", err)
+		return false
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		if err := check(s.Text()); err != nil {
+			report("%s:%d: %v", file, line, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		report("%s: %v", file, err)
+	}
+	return true
+}
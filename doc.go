@@ -4,16 +4,258 @@
 // Usage: gopaths [-http [HOST]:PORT] [-root DIRS] [-exclude FILE]
 //
 //   -http=":6118"
-// 	Listen on HOST on PORT.
+// 	Listen on HOST on PORT. Several comma separated addresses may be
+//      given, including Unix sockets prefixed with “unix:”, e.g.,
+//      “localhost:6118,unix:/tmp/gopaths.sock”.
 //
 //   -root=""
 //      Directories to look for Go packages in, separated by ‘:’ in Unix
 //      and ‘;’ in Windows. By default, the packages are looked for
-//      in GOROOT and GOPATH.
+//      in GOROOT and GOPATH. If a directory goes away (e.g., an unmounted
+//      drive), the packages found in it are kept in the index until
+//      it comes back.
+//
+//   -include-goroot=true
+//      Look for packages in GOROOT, as well as in GOPATH, when no -root
+//      is given. When false, the standard library packages are left out
+//      of the index.
 //
 //   -exclude=""
 //      FILE containing a list of whitespace separated directory names
 //      in which gopaths won't be looking into when searching for packages.
+//      Names may contain the wildcards ‘*’, ‘?’ and ‘[...]’, as in
+//      filepath.Match. Names containing slashes are matched against
+//      the paths relative to the root directories, where ‘**’ also
+//      matches across slashes (e.g., “third_party/**” or “**/generated”).
+//      A name prefixed with ‘!’ re-includes the directories excluded by
+//      the names preceding it; as in .gitignore, the last matching name
+//      decides whether a directory is excluded. Names prefixed with
+//      “depth:N:” only match the directories N levels below the roots,
+//      e.g., “depth:1:node_modules” excludes node_modules directly under
+//      a root, but not deeper ones. Names prefixed with “import:” are
+//      matched against the import paths of the packages found, and drop
+//      the packages with the import path or below it from the index,
+//      e.g., “import:github.com/old/lib” drops both github.com/old/lib
+//      and github.com/old/lib/internal, while their directories are still
+//      walked.
+//      The names are added to the default exclusions, the version control
+//      directories “.git”, “.hg”, “.svn”, “.bzr” and “CVS”.
+//
+//   -no-default-exclude=false
+//      Don't exclude the version control directories
+//      unless they are listed in -exclude.
+//
+//   -strict=false
+//      Fail to start if the -exclude file has no exclusions, likely
+//      a misconfiguration, rather than just log a warning.
+//
+//   -exclude-regex=""
+//      FILE containing regular expressions, one per line, matching
+//      directories not to be indexed. The expressions are matched
+//      against slash separated absolute paths ending with a slash,
+//      e.g., “/v[0-9]+/internal/”. Invalid expressions are reported
+//      on startup.
+//
+//   -max-dir-entries=0
+//      Don't descend into the directories having more entries (files and
+//      subdirectories) than given, unless some of them are Go files;
+//      e.g., dumps of media files, which are slow to walk and unlikely
+//      to have packages underneath. Zero means no limit.
+//
+//   -dry-run=false
+//      Don't serve; print instead the directories that would be indexed
+//      and the ones that would be skipped, either because of exclusions,
+//      including the import path ones, or because they contain no
+//      Go package, and exit. With -dirs, only the listed directories
+//      are looked at.
+//
+//   -allow-update=true
+//      Allow clients to update the directory index with /update, and
+//      to reconfigure it with /config. When disallowed, both are answered
+//      with “403 Forbidden”.
+//
+//   -freeze=false
+//      Keep the directory index built at the start, e.g., of an immutable
+//      container image: neither the -interval updates nor the
+//      -refresh-invalid checks run, and /update and /config are answered
+//      with “403 Forbidden”.
+//
+//   -dirs=""
+//      Index only the directories listed in FILE, one per line, each
+//      by itself, instead of walking the trees of the roots; e.g., the
+//      packages of a build, listed with “go list -f '{{.Dir}}' ./...”.
+//      Empty lines and lines beginning with ‘#’ are skipped. The updates
+//      reimport the listed directories; the exclusions still apply.
+//
+//   -load=""
+//      Serve the index saved in FILE instead of indexing any roots, e.g.,
+//      where the trees aren't available. FILE is in the CSV format of
+//      the responses, e.g., saved with
+//      “curl -H 'Accept: text/csv' localhost:6118/all/dirs”. The index
+//      is frozen, as with -freeze; the import path exclusions still apply.
+//
+//   -update-token=""
+//      Bearer token /update, /config and /all requests must carry
+//      in the “Authorization: Bearer TOKEN” header.
+//
+//   -query-tokens=""
+//      Require a bearer token, one of the ones listed in FILE, of
+//      the queries and of the other requests answered with paths (and
+//      of /all, without -update-token), including /collisions,
+//      /mismatches, /conflicts, /roots and /stats, and answer them,
+//      suggestions included, only with the paths of the directories under
+//      the ones listed after the token, separated by spaces, e.g.,
+//      “s3cret /srv/tenant1/go/src”, on its line; /stats then counts
+//      only those directories, and leaves out the numbers of files and
+//      the exclusion hits. Requests without a listed token are answered
+//      with “401 Unauthorized”, and with a token listed without
+//      directories, with “403 Forbidden”. The -prefetch queries are
+//      cached for the directories of each token. Empty lines and lines
+//      beginning with ‘#’ are skipped.
+//
+//   -built-times=false
+//      Record, while indexing, when the packages were last installed by
+//      “go install”: the modification times of their archives in
+//      GOPATH/pkg, or of the executables of the commands in GOBIN or
+//      GOPATH/bin, for ordering the results with “?sort=built”.
+//
+//   -symbols=false
+//      Collect the exported top-level functions, types, constants and
+//      variables of packages while indexing, for /symbols queries.
+//      The symbols of packages unchanged since the previous index update
+//      aren't collected again.
+//
+//   -log-requests=false
+//      Log each request: its ID, method, URI, response status and duration.
+//      The ID is taken from the “X-Request-ID” request header, if any,
+//      or generated, and returned in the “X-Request-ID” response header
+//      and in JSON error responses, for correlating the logs of clients
+//      and the server.
+//
+//   -include-hidden=false
+//      Index directories whose names begin with a dot. By default,
+//      such directories (e.g., .cache or .idea) are skipped.
+//
+//   -fold-stdlib=false
+//      Match the standard library paths, which are lowercase by
+//      convention, case-insensitively, so that, e.g., “OS” matches “os”.
+//      The other paths are still matched case-sensitively.
+//
+//   -canonical-imports=false
+//      Return only one directory of an import path provided by several,
+//      e.g., by a copy of a standard library package in a GOPATH, or
+//      by packages in several GOPATH entries: the standard library one,
+//      or else the one under the earliest root, as GOPATH mode resolves
+//      the import path. The order of -root sets the precedence of the
+//      roots. Vendored copies, e.g., “x/vendor/net/http”, count as
+//      providing the import path without the vendor directory, and lose
+//      to an unvendored package under the same root. Directory queries
+//      still return all of them.
+//
+//   -strict-valid=false
+//      Never return the paths leading to packages, which are returned
+//      if no package matches, so that such queries are answered with
+//      no paths. “?strict=false” asks for them anyway.
+//
+//   -index-workers=0
+//      Number of goroutines importing the packages of the directories
+//      while indexing, e.g., fewer on a shared machine, or more than
+//      the CPUs on a fast disk. The index is the same whatever their
+//      number. Zero means as many as there are CPUs.
+//
+//   -parallel-threshold=0
+//      Number of indexed directories above which queries scan the index
+//      in parallel, in as many partitions as there are CPUs to use.
+//      Worth it for indexes of a hundred thousand directories or more.
+//      Zero means the index is always scanned serially.
+//
+//   -refresh-invalid=1m
+//      Interval of checking the directories that had no valid package
+//      (e.g., because of a syntax error) when indexed. The modified ones
+//      are imported again, and indexed as packages if they build now,
+//      without waiting for the next index update. Zero disables the checks.
+//
+//   -wait-ready=0
+//      Start serving before the directory index is built; until it is,
+//      queries wait for it for up to the given duration.
+//
+//   -index-deadline=0
+//      Start serving once the given duration of building the directory
+//      index has elapsed, with the directories indexed by then, and index
+//      the rest in the background. The trees are indexed breadth-first,
+//      so that the shallower directories are indexed first.
+//
+//   -cache-size=1000
+//      Number of query results to cache until the next index update.
+//      Zero disables caching.
+//
+//   -prefetch=""
+//      FILE containing queries, one per line, whose results are cached
+//      once the index is built, so that the first requests for them
+//      after a start are answered from the cache. The queries are written
+//      as the paths of their requests, e.g., “imports/http” or
+//      “dirs/x/tools?mode=prefix”; the parameters other than mode, case
+//      and unversioned don't affect the cached results. Lines starting
+//      with ‘#’ are ignored.
+//
+//   -query-timeout=5s
+//      Maximum duration of a single query. Queries taking longer are
+//      aborted with “503 Service Unavailable”. Zero means no limit.
+//
+//   -read-timeout=10s
+//   -write-timeout=1m
+//   -idle-timeout=2m
+//      Maximum durations of reading a request, of answering it, and of
+//      waiting for the next request on a kept-alive connection, after
+//      which the connection is closed, so that slow clients can't hold
+//      up connections. The write timeout should exceed -query-timeout
+//      and -wait-ready. Zero means no limit.
+//
+//   -h2c=false
+//      Serve HTTP/2 over cleartext TCP connections (h2c), as well as
+//      HTTP/1.1, for the clients multiplexing their queries on one
+//      connection without TLS, e.g., on localhost: the clients sending
+//      the HTTP/2 connection preface right away, with prior knowledge,
+//      and the ones upgrading their HTTP/1.1 connections.
+//
+//   -max-response-bytes=0
+//      Maximum size of a query response. Larger responses are truncated
+//      to the results that fit, and marked with the “X-Truncated: true”
+//      header. Zero means no limit.
+//
+//   -reject-oversized=false
+//      Answer the queries whose responses exceed -max-response-bytes
+//      with “413 Request Entity Too Large” instead of truncating them.
+//
+//   -interval=45m
+//      Interval of updating the directory index. Zero disables
+//      the updates.
+//
+// In the absence of the -root, -exclude, -http and -interval flags,
+// their values are taken from the GOPATHS_ROOTS, GOPATHS_EXCLUDE,
+// GOPATHS_HTTP and GOPATHS_INTERVAL environment variables, if set,
+// e.g., in containers. GOPATHS_EXCLUDE lists the directory names
+// themselves, rather than a file; like the roots, they are separated
+// by ‘:’ in Unix and ‘;’ in Windows.
+//
+// Usage: gopaths check [-root DIRS] [-exclude FILE] [-exclude-regex FILE] [-prefetch FILE] [-query-tokens FILE] [-dirs FILE] [-load FILE]
+//
+// The check command validates the configuration before a deployment,
+// without indexing or serving: it reports the roots and the -dirs
+// directories that don't exist or aren't directories, the lines of the
+// files with exclusions that don't parse (e.g., malformed wildcards,
+// or “!” with no name after it), with malformed regular expressions,
+// or with malformed prefetch queries, an exclusion file without any
+// exclusions, a malformed -query-tokens file, and a -load file that
+// isn't a saved index, and exits with status 1 if there are any.
+//
+// Usage: gopaths reindex [-http=[HOST]:PORT] [-update-token TOKEN]
+//
+// The reindex command asks the server at the -http address (the first one,
+// if there are several) to update its index, e.g., from a deployment
+// script, waits for the update to complete, and prints the number
+// of packages found. It exits with status 1 if the update fails or
+// isn't allowed.
 //
 //
 // Paths are matched against the base path (deepest sitting directory):
@@ -21,6 +263,8 @@
 // If there are many matches, all matches are returned; each on a separate
 // line. If there are no package matches, paths leading to the base path
 // are returned; again, if there are any.
+// With -strict-valid, or “?strict=true”, they aren't, and no paths are
+// returned instead.
 //
 // For example, if the requested path is “io”, this path will be matched:
 //
@@ -43,7 +287,10 @@
 // The paths are queried using a Web browser, preferably a console one like
 // curl(1) or wget(1), because gopaths is intended to be a CLI server.
 //
-// There are three request types, specified by path prefixes:
+// The request types are specified by path prefixes:
+//
+//   GET /
+//     Return a search page, if requested by a Web browser.
 //
 //   GET /dirs/{PATH}
 //     Return directory paths matching PATH.
@@ -51,19 +298,264 @@
 //   GET /imports/{PATH}
 //     Return import paths matching PATH.
 //
-//   GET /update
+//   GET /symbols/{NAME}
+//     Return import paths of packages exporting the symbol NAME.
+//     Requires -symbols.
+//
+//   GET /symbol/{NAME}
+//     Return import paths of the packages exporting exactly the symbol
+//     NAME, e.g., “Handler”, or, if NAME is qualified with a package name
+//     or an import path, e.g., “http.Handler” or “net/http.Handler”,
+//     of the ones it refers to, for importing the package providing
+//     a name. Importable packages come first, the commands and test-only
+//     packages last. Requires -symbols.
+//
+//   GET /files/{IMPORTPATH}
+//     Return the names of the Go files, tests included, of the package
+//     with exactly the import path IMPORTPATH, or none if its directory
+//     was removed since the index update.
+//
+//   GET /resolve/{DIR}
+//     Return the import path of the package in the directory DIR, either
+//     absolute (with the leading slash left out, e.g., “/resolve/home/...”)
+//     or relative to a root directory, or “404 Not Found” if there is
+//     no such package.
+//
+//   GET /importdir/{IMPORTPATH}
+//     Return the directories providing exactly the import path IMPORTPATH,
+//     the ones containing the package first, or “404 Not Found” if there
+//     are none.
+//
+//   GET /basename/{NAME}
+//     Return the directories named NAME, whatever their parents, e.g.,
+//     all the “handlers” directories, the ones containing packages first;
+//     “?of=imports” returns the import paths whose last elements are NAME
+//     instead, and “?prefix=true” the ones whose names start with NAME.
+//
+//   POST /query
+//     Return, in JSON, the paths matching the query posted in a JSON
+//     object, with all the options: {"q": PATH, "kind": KIND, "mode":
+//     MODE, "case": CASE, "limit": N, "root": DIR, "stdlib": BOOL,
+//     "testOnly": BOOL, "minFiles": N, "count": BOOL, "unversioned": BOOL,
+//     "strict": BOOL, "sort": SORT}.
+//     KIND is “imports” (the default), “dirs”, “symbols” or “files”;
+//     “limit” keeps the first N paths, and “root” keeps only the paths
+//     of the directories under DIR. Only "q" is required.
+//
+//   GET /recent/
+//     Return the directories of the 20 most recently modified packages,
+//     the latest first; “?limit=N” returns N directories.
+//
+//   GET /all/imports
+//   GET /all/dirs
+//     Return all the distinct import paths, or directories, of the packages
+//     in the index, sorted, e.g., to build a client side cache; “?limit=N”
+//     returns the first N. With -update-token, the token is required,
+//     and the paths aren't limited by the -query-tokens.
+//
+//   POST /update
 //     Update the directory index. The directory index updates itself
-//     every 45 minutes. Occasionally, a faster update might be needed.
+//     at the -interval, unless no directory has been modified since
+//     the last update. Occasionally, a faster update might be needed.
+//
+//   POST /config
+//     Replace the root directories and the exclusions with the ones
+//     posted in a JSON object, {"roots": [DIR, ...], "exclusions":
+//     [NAME, ...]}, at once, and update the index, so that no update
+//     walks the new roots with the old exclusions, or the other way
+//     around. The names are the ones of -exclude; the default exclusions
+//     only apply if listed. The roots must exist, and at least one is
+//     required. Authorized like /update, and disabled along with it.
+//
+//   GET /metrics
+//     Return, in the Prometheus text format, the number of completed
+//     index updates, the number of directories that failed to be read
+//     ("walk") or imported ("parse", "multiple_packages", "panic" or
+//     "other") while indexing, and the time of the last completed update,
+//     e.g., for alerting when the index hasn't been updated for an hour.
+//
+//   GET /roots
+//     Return, in JSON, the root directories, whether they exist and can
+//     be read, and how many packages the last index update found in them.
+//
+//   GET /collisions
+//     Return, in JSON, the import paths provided by packages in more
+//     than one directory (e.g., shadowed packages in GOPATH), mapped
+//     to the directories.
+//
+//   GET /mismatches
+//     Return, in JSON, the packages whose import paths don't end with
+//     their directory names; usually, renamed or vanity-imported packages.
+//
+//   GET /conflicts
+//     Return, in JSON, the directories indexed with more than one import
+//     path, e.g., reached through a symlink or a module replacement
+//     under different roots, by their paths with the symlinks resolved,
+//     mapped to the import paths. The queries only return the first
+//     one: the least import path, preferring the non-local ones,
+//     whatever the order of the roots.
+//
+//   GET /stats
+//     Return index statistics in JSON: the number of indexed directories,
+//     the number and total size of the files in them, query cache
+//     hits, misses and evictions, the number of goroutines, for spotting
+//     leaks, the number of directories each exclusion left out of the last
+//     indexing run, or, for a ‘!’ rule, re-included, as "exclusions":
+//     {RULE: N}, where a rule left at 0 may be misspelled (the
+//     -exclude-regex expressions aren't counted), the directories whose
+//     packages panicked the importer in the last run, e.g., on
+//     a malformed file, as "panics": {DIR: PANIC}, which are indexed as
+//     directories without packages, and "partial": true while the index
+//     is being completed after the -index-deadline.
+//
+// Query paths are matched as path suffixes by default. The suffixes are
+// whole trailing path elements: “x/y” matches the paths whose last two
+// elements are “x” and “y”, e.g., “a/x/y”, but not “a/wx/y”. A query
+// path ending with a slash, e.g., “net/http/”, matches the paths under
+// the matching paths instead, i.e. “net/http/httptest”, but not
+// “net/http” itself.
+// The “mode” parameter selects another way of matching:
+//
+//   ?mode=prefix       the path starts with PATH
+//   ?mode=substring    the path contains PATH
+//   ?mode=fuzzy        the path contains the characters of PATH in order
+//   ?mode=segments     the path contains the segments of PATH consecutively
+//   ?mode=complete     the path ends with PATH, but for the rest of its last
+//                      segment, e.g., “net/ht” matches “net/http”, but not
+//                      “net/template”, for completing partially typed paths
+//   ?mode=unanchored   the path ends with PATH, even in the middle of
+//                      a segment, e.g., “os” matches “paxos”; a leading
+//                      slash anchors PATH on a segment, as by default
+//   ?mode=glob         the trailing segments of the path match PATH, where
+//                      “*” matches within a segment, and a “**” segment
+//                      any number of segments, e.g., “github.com/*/logging”
+//                      matches “github.com/x/logging”
+//
+// The first segments of the paths are bounded by the path start as
+// the other segments are by the separators, for the import paths and
+// the directories alike: “http” matches the import path “http” and
+// the directory “/http”, and, in the prefix mode, “x” matches “x/y”
+// and “/x/y”, whether the query starts with a separator or not.
+//
+// Paths are matched case-sensitively. The “case” parameter selects
+// the parts of PATH and of the paths that aren't:
+//
+//   ?case=insensitive  all of them
+//   ?case=last         the last segments, the package names, which are often
+//                      the only part with the wrong case, e.g., “net/HTTP”
+//                      matches “net/http”, but “NET/http” doesn't
+//
+// The “stdlib” parameter filters standard library paths (the paths
+// under GOROOT/src): “?stdlib=false” leaves them out, and “?stdlib=true”
+// leaves out all other paths. The “kind” parameter filters commands (main
+// packages) and library packages: “?kind=command” leaves out all but
+// the commands, and “?kind=library” all but the library packages.
+// The “testonly” parameter filters the test-only packages, the directories
+// with only _test.go files (e.g., of external tests), which can't be
+// imported: “?testonly=false” leaves them out, and “?testonly=true” leaves
+// out all other paths. “?minfiles=N” leaves out the packages with fewer
+// than N Go files, not counting tests and the files excluded by build
+// constraints, e.g., the trivial stub packages, and, with N above zero,
+// the directories without packages. The indexes loaded with -load don't
+// have the numbers of files.
+//
+// The order of the paths is the one of the mode, unless “?sort=built”
+// orders them by when their packages were last installed, the latest
+// first, with -built-times, e.g., for preferring the packages in use;
+// the packages never installed follow, in the mode's order. The times are
+// the ones as of the last index update, which notices the reinstalled
+// packages, as it does the changed trees; the build cache isn't consulted,
+// as its entries can't be told by package. Without -built-times,
+// “?sort=built” is answered with “400 Bad Request”.
+//
+// Queries without matches are answered with an empty list of paths, but
+// with “?suggest=1”, they are answered with “404 Not Found” and up to five
+// paths closest to the query, e.g., “net/http” for the typo “nte/http”,
+// in the "suggestions" of the JSON error object, or after a “did you mean:”
+// line in plain text.
+//
+// With “?count=1”, queries are answered with only the number of matching
+// paths, as {"count": N} in JSON, or as a number in plain text.
+//
+// With “?unversioned=true”, suffix queries also match module paths ending
+// with a major version, as if it were left out, e.g., “x/y” matches
+// “github.com/x/y/v3”, which is still the path returned. (Prefix queries
+// match such paths anyway.)
+//
+// With “?relto=DIR”, directory queries return the paths under the absolute
+// directory DIR relative to it, e.g., “pkg/util” rather than
+// “/home/peter/project/pkg/util” for “?relto=/home/peter/project”,
+// and the other paths absolute, as usual.
+//
+// With “?file=true”, a query ending with a Go file name, e.g.,
+// “net/http/server.go”, matches the directory containing the file,
+// i.e. “net/http”, as when looking up the package of a file open
+// in an editor.
+//
+// Suffix matches are ordered by length, so that the exact match, e.g., “os”
+// for the query “os”, comes first. Substring and fuzzy matches are ordered
+// by relevance: compact matches in short paths, starting at a path element,
+// come first. Equally relevant matches are ordered by length, and then
+// alphabetically.
+//
+// Unless gopaths is started with -wait-ready or -index-deadline,
+// the directory index is built before it starts serving. Queries
+// arriving before the index is built wait for it, and get “503 Service
+// Unavailable” if the wait times out.
+//
+// Paths are returned as plain text, one per line. Clients sending
+// “Accept: application/json” get a JSON array of {"path": PATH} objects
+// instead, and clients sending “Accept: application/x-ndjson” get newline
+// delimited JSON, one object per line, streamed as it's written. In the
+// substring and fuzzy modes, the objects have a relevance "score" as well.
+// The "offsets" are [start, end) byte offsets of the matched characters
+// in the path, e.g., for highlighting. The "valid" field tells whether
+// there's a package in the directory, and "mtime" is the modification
+// time of the directory, as RFC 3339, e.g., for a picker of the recently
+// changed packages. With -built-times, "built" is the time the package was
+// last installed, if ever. Standard library paths are marked
+// with "stdlib": true, commands with "command": true, and test-only
+// packages with "testOnly": true. Packages with files requiring a Go
+// version by their build constraints, e.g., “//go:build go1.21”, have
+// the latest such version as "goVersion", e.g., "go1.21", for warning
+// about the packages unusable with older toolchains. Clients sending
+// “Accept: text/csv” get CSV with a header row and the full path, import
+// path, validity (whether there is a package) and package name of each
+// directory, for spreadsheets. Clients issuing many queries, e.g., language
+// servers, may send “Accept: application/vnd.gopaths.results” to get
+// a compact binary format, faster to decode than JSON: the number of
+// results, and then, for each, the length of the path, the path, and
+// a byte of flags: 1 for a valid path, 2 for a standard library one,
+// 4 for a command and 8 for a test-only package. The numbers
+// are unsigned varints, as encoded by Go's binary.PutUvarint. The “format”
+// parameter selects the format regardless of the Accept header:
+// “?format=csv”, “json”, “ndjson”, “binary” or “text”.
+//
+// In plain text, the paths containing control characters, e.g., directory
+// names with newlines, are quoted as Go string literals, so that each line
+// is a single path, and so are the paths starting with a ‘"’, so that
+// a line starting with one is always quoted: unquote it with
+// strconv.Unquote. The other formats have the paths verbatim, CSV
+// quoting its fields as CSV does.
+//
+// Errors are reported with the HTTP status codes and a plain text message,
+// or, to the clients accepting JSON, a JSON object with the "error" message
+// and the status "code" in snake case, e.g., {"error": "...", "code":
+// "not_found"}. Requests failing unexpectedly get “500 Internal Server
+// Error”, and the failure is logged with the request ID. The routes
+// marked GET above also answer HEAD requests; other methods, as well as
+// anything but POST to /update and /query, get “405 Method Not Allowed”
+// with the allowed methods in the “Allow” header.
 //
 // Examples:
 //
 //   $ curl :6118/imports/log
 //   log
-//   google.golang.org/appengine/internal/log
 //   google.golang.org/appengine/log
+//   google.golang.org/appengine/internal/log
 //
 //   $ curl :6118/dirs/rand
-//   /Users/peter/go/src/crypto/rand
 //   /Users/peter/go/src/math/rand
+//   /Users/peter/go/src/crypto/rand
 //
 package main
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// exclusion is a rule excluding directories from indexing.
+type exclusion struct {
+	rule    string         // As written, e.g., “!depth:1:vendor”.
+	pattern string         // Directory name or slash separated path relative to a root.
+	negate  bool           // Re-include directories excluded by earlier rules.
+	re      *regexp.Regexp // Compiled pattern, if it contains wildcards.
+	depth   int            // Depth below a root the directory must be at; zero means any.
+	imports bool           // Match the import paths of the packages instead of directories.
+}
+
+// newExclusion parses an exclusion rule. A rule prefixed with “depth:N:”
+// only matches the directories N levels below a root, e.g.,
+// “depth:1:node_modules” matches “node_modules” directly under a root.
+// A rule prefixed with “import:” matches the import paths of the indexed
+// packages, and the paths below them, e.g., “import:example.com/old”
+// matches “example.com/old” and “example.com/old/sub”.
+func newExclusion(rule string) (e exclusion, err error) {
+	e.rule = rule
+	pattern := rule
+	if strings.HasPrefix(pattern, "!") {
+		pattern, e.negate = pattern[1:], true
+	}
+	if strings.HasPrefix(pattern, "import:") {
+		pattern, e.imports = pattern[len("import:"):], true
+	}
+	if !e.imports && strings.HasPrefix(pattern, "depth:") {
+		parts := strings.SplitN(pattern, ":", 3)
+		if len(parts) < 3 {
+			return e, fmt.Errorf("exclusion %q: missing pattern after depth", rule)
+		}
+		if e.depth, err = strconv.Atoi(parts[1]); err != nil || e.depth < 1 {
+			return e, fmt.Errorf("exclusion %q: invalid depth %q", rule, parts[1])
+		}
+		pattern = parts[2]
+	}
+	e.pattern = strings.Trim(pattern, "/")
+	if e.pattern == "" {
+		return e, fmt.Errorf("exclusion %q: empty pattern", rule)
+	}
+
+	if strings.ContainsAny(e.pattern, `*?[\`) {
+		if e.re, err = compileGlob(e.pattern); err != nil {
+			return e, fmt.Errorf("exclusion %q: %v", rule, err)
+		}
+	}
+	return e, nil
+}
+
+func (e exclusion) match(rel, name string) bool {
+	if e.imports {
+		return false
+	}
+	if e.depth > 0 && e.depth != depth(rel) {
+		return false
+	}
+
+	s := name
+	if strings.Contains(e.pattern, "/") {
+		s = rel
+	}
+
+	if e.re != nil {
+		return e.re.MatchString(s)
+	}
+	return s == e.pattern
+}
+
+// depth returns the number of levels the slash separated path rel,
+// relative to a root, is below it.
+func depth(rel string) int {
+	if rel == "." || rel == "" {
+		return 0
+	}
+	return strings.Count(rel, "/") + 1
+}
+
+// excluded reports whether the directory name at the slash separated path
+// rel relative to its root is excluded from indexing. As in .gitignore,
+// the last matching rule decides.
+func (dirs *index) excluded(rel, name string) bool {
+	return dirs.excludingRule(rel, name) >= 0
+}
+
+// excludingRule returns the index of the rule excluding the directory
+// like excluded, or -1 if it isn't excluded.
+func (dirs *index) excludingRule(rel, name string) int {
+	rule := -1
+	for i, e := range dirs.exclusions {
+		if e.match(rel, name) {
+			rule = i
+		}
+	}
+	if rule >= 0 && dirs.exclusions[rule].negate {
+		return -1
+	}
+	return rule
+}
+
+// reincludingRule returns the index of the negated rule re-including
+// the directory name at the slash separated path rel, excluded by
+// a preceding rule, or -1 if none does.
+func (dirs *index) reincludingRule(rel, name string) int {
+	return reincluding(dirs.exclusions, func(e exclusion) bool { return e.match(rel, name) })
+}
+
+// reincluding returns the index of the last of the rules matching,
+// if it's negated and follows a matching rule that isn't, or -1.
+func reincluding(exclusions []exclusion, match func(exclusion) bool) int {
+	rule, excluded := -1, false
+	for i, e := range exclusions {
+		if match(e) {
+			rule, excluded = i, excluded || !e.negate
+		}
+	}
+	if rule >= 0 && exclusions[rule].negate && excluded {
+		return rule
+	}
+	return -1
+}
+
+// matchImport reports whether the import path, or one of the paths
+// it is below, matches an import path rule.
+func (e exclusion) matchImport(importPath string) bool {
+	if !e.imports {
+		return false
+	}
+	for s := importPath; ; s = s[:strings.LastIndex(s, "/")] {
+		if e.re != nil && e.re.MatchString(s) || s == e.pattern {
+			return true
+		}
+		if !strings.Contains(s, "/") {
+			return false
+		}
+	}
+}
+
+// excludedImport reports whether the package with the import path is
+// dropped from the index by the import path rules, the last matching
+// one deciding.
+func (dirs *index) excludedImport(importPath string) bool {
+	return dirs.excludingImportRule(importPath) >= 0
+}
+
+// excludingImportRule returns the index of the rule dropping the package
+// like excludedImport, or -1 if it isn't dropped.
+func (dirs *index) excludingImportRule(importPath string) int {
+	rule := -1
+	for i, e := range dirs.exclusions {
+		if e.matchImport(importPath) {
+			rule = i
+		}
+	}
+	if rule >= 0 && dirs.exclusions[rule].negate {
+		return -1
+	}
+	return rule
+}
+
+// reincludingImportRule returns the index of the negated rule
+// re-including the package with the import path, dropped by
+// a preceding rule, or -1 if none does.
+func (dirs *index) reincludingImportRule(importPath string) int {
+	return reincluding(dirs.exclusions, func(e exclusion) bool { return e.matchImport(importPath) })
+}
+
+// excludedRegexp reports whether the directory path is excluded from indexing
+// by a regular expression.
+func (dirs *index) excludedRegexp(path string) bool {
+	if len(dirs.excludeRegexps) == 0 {
+		return false
+	}
+
+	path = filepath.ToSlash(path) + "/"
+	for _, re := range dirs.excludeRegexps {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// compileGlob compiles a pattern with the syntax of filepath.Match
+// into an equivalent regular expression. Additionally, ‘**’ matches
+// any sequence of characters, including slashes, so that “a/**”
+// matches everything under “a”, and “**/b” matches “b” at any depth.
+func compileGlob(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			switch {
+			case strings.HasPrefix(pattern[i:], "**/"):
+				// Zero or more directories.
+				b.WriteString("(?:.*/)?")
+				i += 2
+			case strings.HasPrefix(pattern[i:], "**"):
+				b.WriteString(".*")
+				i++
+			default:
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			j := strings.IndexByte(pattern[i+1:], ']')
+			if j < 0 {
+				return nil, fmt.Errorf("unterminated character class")
+			}
+			b.WriteString(pattern[i : i+2+j])
+			i += j + 1
+		case '\\':
+			if i+1 == len(pattern) {
+				return nil, fmt.Errorf("trailing backslash")
+			}
+			i++
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var GlobTests = []struct {
+	pattern string
+	name    string
+}{
+	{"abc", "abc"},
+	{"abc", "abd"},
+	{"*", "abc"},
+	{"*", ""},
+	{"a*", "abc"},
+	{"a*", "bac"},
+	{"*c", "abc"},
+	{"a*/b", "abc/b"},
+	{"a*", "a/b"},
+	{"a?c", "abc"},
+	{"a?c", "a/c"},
+	{"a?c", "a☺c"},
+	{"[a-c]x", "bx"},
+	{"[a-c]x", "dx"},
+	{"[^a-c]x", "dx"},
+	{"[^a-c]x", "/x"},
+	{`a\*`, "a*"},
+	{`a\*`, "ab"},
+	{"a.b", "a.b"},
+	{"a.b", "axb"},
+	{"v[0-9]", "v2"},
+	{"node_*", "node_modules"},
+}
+
+var DoubleStarTests = []struct {
+	pattern string
+	name    string
+	match   bool
+}{
+	{"a/**", "a/b", true},
+	{"a/**", "a/b/c", true},
+	{"a/**", "a", false},
+	{"**/b", "b", true},
+	{"**/b", "a/b", true},
+	{"**/b", "a/c/b", true},
+	{"**/b", "ab", false},
+	{"a/**/b", "a/b", true},
+	{"a/**/b", "a/x/y/b", true},
+	{"a/**/b", "a/xb", false},
+}
+
+func TestCompileGlob(t *testing.T) {
+	for _, test := range GlobTests {
+		re, err := compileGlob(test.pattern)
+		if err != nil {
+			t.Errorf("%q: %v", test.pattern, err)
+			continue
+		}
+
+		want, _ := path.Match(test.pattern, test.name)
+		if got := re.MatchString(test.name); got != want {
+			t.Errorf("%q matching %q: got %v, want %v", test.pattern, test.name, got, want)
+		}
+	}
+
+	for _, test := range DoubleStarTests {
+		re, err := compileGlob(test.pattern)
+		if err != nil {
+			t.Errorf("%q: %v", test.pattern, err)
+			continue
+		}
+
+		if got := re.MatchString(test.name); got != test.match {
+			t.Errorf("%q matching %q: got %v, want %v", test.pattern, test.name, got, test.match)
+		}
+	}
+
+	for _, pattern := range []string{"[a-c", `a\`} {
+		if _, err := compileGlob(pattern); err == nil {
+			t.Errorf("%q: compileGlob should have returned an error", pattern)
+		}
+	}
+}
+
+var benchmarkExclusions = "testdata vendor node_* .git *_generated third_party/*"
+
+// benchmarkDirs returns the slash separated paths of a tree
+// with many directories.
+func benchmarkDirs() (dirs []string) {
+	for i := 0; i < 100; i++ {
+		for j := 0; j < 100; j++ {
+			dirs = append(dirs, fmt.Sprintf("github.com/org%d/pkg%d", i, j))
+		}
+	}
+	return
+}
+
+func BenchmarkExclusions(b *testing.B) {
+	paths := benchmarkDirs()
+
+	b.Run("compiled", func(b *testing.B) {
+		dirs := index{}
+		dirs.Exclusions(strings.NewReader(benchmarkExclusions))
+
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, rel := range paths {
+				dirs.excluded(rel, path.Base(rel))
+			}
+		}
+	})
+
+	b.Run("uncompiled", func(b *testing.B) {
+		patterns := strings.Fields(benchmarkExclusions)
+
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, rel := range paths {
+				name := path.Base(rel)
+				for _, pattern := range patterns {
+					s := name
+					if strings.Contains(pattern, "/") {
+						s = rel
+					}
+					filepath.Match(pattern, s)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"path"
+	"strings"
+	"sync"
+)
+
+// globMatcher matches the paths whose trailing segments match the glob
+// pattern segments: “*” matches any part of a segment, as do “?” and
+// the character classes of path.Match, and a “**” segment any number
+// of segments, e.g., “github.com/*/logging” matches “github.com/x/logging”,
+// and “golang.org/**/http” matches “golang.org/x/net/http” and
+// “golang.org/http”.
+type globMatcher struct {
+	segments []string
+	literals []string // The segments without wildcards, which the paths contain.
+	sep      string
+}
+
+// doubleStar is the segment matching any number of segments.
+const doubleStar = "**"
+
+// hasWildcards reports whether the pattern segment isn't a literal.
+func hasWildcards(segment string) bool {
+	return strings.ContainsAny(segment, `*?[\`)
+}
+
+// checkGlob returns path.ErrBadPattern if a segment of the glob pattern,
+// separated by slashes or backslashes, is malformed.
+func checkGlob(pattern string) error {
+	for _, segment := range strings.FieldsFunc(pattern, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if _, err := path.Match(segment, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxCachedGlobs is the number of compiled glob patterns kept for reuse.
+const maxCachedGlobs = 1000
+
+// globs caches the compiled glob patterns, by the separator and
+// the pattern, as the same patterns are often queried again, e.g.,
+// while typing. It's emptied when full.
+var globs = struct {
+	sync.Mutex
+	m map[[2]string]globMatcher
+}{m: map[[2]string]globMatcher{}}
+
+// newGlobMatcher returns the matcher of the glob pattern, with its segments
+// separated by sep.
+func newGlobMatcher(pattern, sep string) globMatcher {
+	key := [2]string{sep, pattern}
+	globs.Lock()
+	defer globs.Unlock()
+	if m, ok := globs.m[key]; ok {
+		return m
+	}
+
+	m := globMatcher{sep: sep}
+	for _, segment := range strings.Split(strings.Trim(pattern, sep), sep) {
+		// Consecutive double stars match as one does.
+		if segment == doubleStar && len(m.segments) > 0 && m.segments[len(m.segments)-1] == doubleStar {
+			continue
+		}
+		m.segments = append(m.segments, segment)
+		if !hasWildcards(segment) {
+			m.literals = append(m.literals, segment)
+		}
+	}
+
+	if len(globs.m) >= maxCachedGlobs {
+		globs.m = map[[2]string]globMatcher{}
+	}
+	globs.m[key] = m
+	return m
+}
+
+func (m globMatcher) match(path string) (float64, bool) {
+	return 0, m.start(path) >= 0
+}
+
+func (m globMatcher) spans(path string) [][2]int {
+	return span(m.start(path), len(path))
+}
+
+// start returns the byte offset of the first segment of path matched
+// by the pattern, or -1 if the path doesn't match.
+func (m globMatcher) start(path string) int {
+	for _, lit := range m.literals {
+		if !strings.Contains(path, lit) {
+			return -1
+		}
+	}
+
+	segments := strings.Split(strings.TrimLeft(path, m.sep), m.sep)
+	offset := len(path) - len(strings.TrimLeft(path, m.sep))
+	for i := range segments {
+		if matchSegments(m.segments, segments[i:]) {
+			return offset
+		}
+		offset += len(segments[i]) + len(m.sep)
+	}
+	return -1
+}
+
+// matchSegments reports whether the pattern segments match all of
+// the path segments.
+func matchSegments(pattern, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == doubleStar {
+			for i := len(segments); i >= 0; i-- {
+				if matchSegments(pattern[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(segments) == 0 {
+			return false
+		}
+		if hasWildcards(pattern[0]) {
+			if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+				return false
+			}
+		} else if pattern[0] != segments[0] {
+			return false
+		}
+		pattern, segments = pattern[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
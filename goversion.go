@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bufio"
+	"go/build"
+	"go/build/constraint"
+	"go/version"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// goVersion returns the latest Go version required by the build
+// constraints of the package's files, e.g., “go1.21” for a file with
+// “//go:build go1.21 && !windows”, or "" if none requires one.
+// The files ignored by the build are looked at too, as the ones
+// requiring a newer Go than the toolchain's are among them.
+func goVersion(p *build.Package) string {
+	latest := ""
+	for _, names := range [][]string{p.GoFiles, p.CgoFiles, p.IgnoredGoFiles} {
+		for _, name := range names {
+			if strings.HasSuffix(name, "_test.go") {
+				continue
+			}
+			if v := fileGoVersion(filepath.Join(p.Dir, name)); version.Compare(v, latest) > 0 {
+				latest = v
+			}
+		}
+	}
+	return latest
+}
+
+// fileGoVersion returns the Go version required by the //go:build line
+// of the Go file, or "" if there's none, or it requires no version.
+func fileGoVersion(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	// The constraints precede the package clause.
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, "package ") {
+			break
+		}
+		if !constraint.IsGoBuild(line) {
+			continue
+		}
+		if expr, err := constraint.Parse(line); err == nil {
+			return constraint.GoVersion(expr)
+		}
+	}
+	return ""
+}
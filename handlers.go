@@ -1,36 +1,1290 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"embed"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"mime"
 	"net/http"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"unicode"
 )
 
+// static holds the search page served to Web browsers.
+//
+//go:embed static
+var static embed.FS
+
+// ndjsonFlushLines is the number of NDJSON lines written between flushes.
+const ndjsonFlushLines = 100
+
+// ServeMux routes the requests to the handlers. The queries and the other
+// reads are answered to GET and HEAD requests only, and /update to POST
+// requests only, so that a Web page can't have a browser update the index.
 func (dirs *index) ServeMux() *http.ServeMux {
 	mux := http.NewServeMux()
+	get := func(h http.Handler) http.Handler { return allowMethods(h, "GET", "HEAD") }
 
-	mux.Handle("/imports/", http.StripPrefix("/imports/", dirs.ImportsHandler()))
-	mux.Handle("/dirs/", http.StripPrefix("/dirs/", dirs.DirsHandler()))
-	mux.Handle("/update", dirs.UpdateHandler())
-	mux.Handle("/", http.StripPrefix("/", dirs.DirsHandler()))
+	mux.Handle("/imports/", get(http.StripPrefix("/imports/", dirs.ImportsHandler())))
+	mux.Handle("/dirs/", get(http.StripPrefix("/dirs/", dirs.DirsHandler())))
+	mux.Handle("/symbols/", get(http.StripPrefix("/symbols/", dirs.SymbolsHandler())))
+	mux.Handle("/symbol/", get(http.StripPrefix("/symbol/", dirs.SymbolHandler())))
+	mux.Handle("/files/", get(http.StripPrefix("/files/", dirs.FilesHandler())))
+	mux.Handle("/resolve/", get(http.StripPrefix("/resolve/", dirs.ResolveHandler())))
+	mux.Handle("/importdir/", get(http.StripPrefix("/importdir/", dirs.ImportDirHandler())))
+	mux.Handle("/basename/", get(http.StripPrefix("/basename/", dirs.BaseNameHandler())))
+	mux.Handle("/query", dirs.QueryHandler())
+	mux.Handle("/recent/", get(dirs.RecentHandler()))
+	mux.Handle("/all/imports", get(dirs.AllHandler(kindImports)))
+	mux.Handle("/all/dirs", get(dirs.AllHandler(kindDirs)))
+	mux.Handle("/update", allowMethods(dirs.UpdateHandler(), "POST"))
+	mux.Handle("/config", allowMethods(dirs.ConfigHandler(), "POST"))
+	mux.Handle("/stats", get(dirs.StatsHandler()))
+	mux.Handle("/metrics", get(dirs.MetricsHandler()))
+	mux.Handle("/roots", get(dirs.RootsHandler()))
+	mux.Handle("/collisions", get(dirs.CollisionsHandler()))
+	mux.Handle("/mismatches", get(dirs.MismatchesHandler()))
+	mux.Handle("/conflicts", get(dirs.ConflictsHandler()))
+	mux.Handle("/", get(http.StripPrefix("/", dirs.RootHandler())))
 
 	return mux
 }
 
+// allowMethods returns a handler passing the requests with the methods
+// to h, and answering the others with “405 Method Not Allowed”.
+func allowMethods(h http.Handler, methods ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, m := range methods {
+			if r.Method == m {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		writeError(w, r, fmt.Sprintf("method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+	})
+}
+
 func (dirs *index) DirsHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintln(w, strings.Join(dirs.QueryIndex(r.URL.Path, kindDirs), "\n"))
+		dirs.query(w, r, kindDirs)
+	}
+}
+
+// RootHandler serves the search page to Web browsers,
+// and answers directory queries otherwise.
+func (dirs *index) RootHandler() http.HandlerFunc {
+	query := dirs.DirsHandler()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "" && accepts(r, "text/html") {
+			page, err := static.ReadFile("static/index.html")
+			if err != nil {
+				writeError(w, r, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write(page)
+			return
+		}
+		query(w, r)
 	}
 }
 
 func (dirs *index) ImportsHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintln(w, strings.Join(dirs.QueryIndex(r.URL.Path, kindImports), "\n"))
+		dirs.query(w, r, kindImports)
+	}
+}
+
+func (dirs *index) SymbolsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dirs.query(w, r, kindSymbols)
+	}
+}
+
+func (dirs *index) FilesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dirs.query(w, r, kindFiles)
+	}
+}
+
+// queryOptions are the options of a query, given by the request parameters
+// or, to /query, in the request body.
+type queryOptions struct {
+	query   string
+	kind    queryKind
+	mode    queryMode
+	folding caseFolding // The parts matched case-insensitively.
+
+	// stdlib and commands, if set, keep only the standard library, or
+	// the other, results, and only the commands, or library packages;
+	// testOnly, only the test-only packages, or the other results.
+	stdlib, commands, testOnly *bool
+
+	suggest     bool   // Suggest the closest paths if there are no results.
+	count       bool   // Answer with the number of results only.
+	unversioned bool   // Match module paths without their major versions too.
+	strict      bool   // Never return paths without packages.
+	byBuilt     bool   // Order the results by the built times of their packages.
+	minFiles    int    // Minimum number of Go files of the packages, if positive.
+	limit       int    // Maximum number of results, if positive.
+	root        string // Root directory the results must be under, if set.
+	relto       string // Directory to make the directory results relative to, if set.
+}
+
+// query queries the index for the request path in the mode given by the
+// "mode" parameter, keeping only the standard library results, or only
+// the other results, if the "stdlib" parameter is true or false. It gives
+// up if the query takes longer than the configured timeout. Until the index
+// is built, queries wait for it for the configured time and then are
+// answered with “503 Service Unavailable”. Responses exceeding the configured
+// size are truncated, with the X-Truncated header set, or rejected.
+func (dirs *index) query(w http.ResponseWriter, r *http.Request, kind queryKind) {
+	opts := queryOptions{query: r.URL.Path, kind: kind, strict: dirs.strictValid}
+
+	var err error
+	if opts.mode, err = parseMode(r.URL.Query().Get("mode")); err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if opts.folding, err = parseFolding(r.URL.Query().Get("case")); err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if opts.byBuilt, err = dirs.parseSort(r.URL.Query().Get("sort")); err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if s := r.URL.Query().Get("stdlib"); s != "" {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			writeError(w, r, fmt.Sprintf("invalid stdlib parameter %q", s), http.StatusBadRequest)
+			return
+		}
+		opts.stdlib = &b
+	}
+
+	if s := r.URL.Query().Get("testonly"); s != "" {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			writeError(w, r, fmt.Sprintf("invalid testonly parameter %q", s), http.StatusBadRequest)
+			return
+		}
+		opts.testOnly = &b
+	}
+
+	switch s := r.URL.Query().Get("kind"); s {
+	case "":
+	case "command", "library":
+		b := s == "command"
+		opts.commands = &b
+	default:
+		writeError(w, r, fmt.Sprintf("invalid kind parameter %q", s), http.StatusBadRequest)
+		return
+	}
+
+	if s := r.URL.Query().Get("suggest"); s != "" {
+		if opts.suggest, err = strconv.ParseBool(s); err != nil {
+			writeError(w, r, fmt.Sprintf("invalid suggest parameter %q", s), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if s := r.URL.Query().Get("count"); s != "" {
+		if opts.count, err = strconv.ParseBool(s); err != nil {
+			writeError(w, r, fmt.Sprintf("invalid count parameter %q", s), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if s := r.URL.Query().Get("unversioned"); s != "" {
+		if opts.unversioned, err = strconv.ParseBool(s); err != nil {
+			writeError(w, r, fmt.Sprintf("invalid unversioned parameter %q", s), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if s := r.URL.Query().Get("strict"); s != "" {
+		if opts.strict, err = strconv.ParseBool(s); err != nil {
+			writeError(w, r, fmt.Sprintf("invalid strict parameter %q", s), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if s := r.URL.Query().Get("minfiles"); s != "" {
+		if opts.minFiles, err = strconv.Atoi(s); err != nil || opts.minFiles < 0 {
+			writeError(w, r, fmt.Sprintf("invalid minfiles parameter %q", s), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if s := r.URL.Query().Get("relto"); s != "" {
+		if kind != kindDirs {
+			writeError(w, r, "relto only applies to directory queries", http.StatusBadRequest)
+			return
+		}
+		if !filepath.IsAbs(s) {
+			writeError(w, r, fmt.Sprintf("relto directory %q isn't absolute", s), http.StatusBadRequest)
+			return
+		}
+		opts.relto = filepath.Clean(s)
+	}
+
+	if s := r.URL.Query().Get("file"); s != "" {
+		file, err := strconv.ParseBool(s)
+		if err != nil {
+			writeError(w, r, fmt.Sprintf("invalid file parameter %q", s), http.StatusBadRequest)
+			return
+		}
+		if file {
+			opts.query = trimGoFile(opts.query)
+		}
+	}
+
+	dirs.answer(w, r, opts)
+}
+
+// answer answers the request with the results of the query.
+func (dirs *index) answer(w http.ResponseWriter, r *http.Request, opts queryOptions) {
+	if opts.mode == modeGlob {
+		if err := checkGlob(opts.query); err != nil {
+			writeError(w, r, fmt.Sprintf("glob %q: %v", opts.query, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	permitted, ok := dirs.permittedRoots(w, r)
+	if !ok || !dirs.awaitIndex(w, r) {
+		return
+	}
+
+	ctx := r.Context()
+	if dirs.queryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dirs.queryTimeout)
+		defer cancel()
+	}
+
+	key := cacheKey{query: opts.query, kind: opts.kind, mode: opts.mode, unversioned: opts.unversioned, folding: opts.folding}
+	results, err := dirs.cachedQuery(ctx, permittedKey(key, permitted))
+	if err != nil {
+		writeError(w, r, fmt.Sprintf("query %q: %v", opts.query, err), http.StatusServiceUnavailable)
+		return
+	}
+	if opts.strict {
+		results = filterValid(results)
+	}
+	if opts.stdlib != nil {
+		results = filterStdlib(results, *opts.stdlib)
+	}
+	if opts.commands != nil {
+		results = filterCommands(results, *opts.commands)
+	}
+	if opts.testOnly != nil {
+		results = filterTestOnly(results, *opts.testOnly)
+	}
+	if opts.minFiles > 0 {
+		results = filterMinFiles(results, opts.minFiles)
+	}
+	if opts.root != "" {
+		results = filterRoot(results, opts.root)
+	}
+	if opts.relto != "" {
+		results = relativeTo(results, opts.relto)
+	}
+	if opts.byBuilt {
+		results = sortBuilt(results)
+	}
+	if opts.count {
+		writeCount(w, r, len(results))
+		return
+	}
+	if opts.suggest && len(results) == 0 {
+		writeErrorBody(w, r, errorBody{
+			Error:       fmt.Sprintf("no paths match %q", opts.query),
+			Suggestions: dirs.Suggest(opts.query, opts.kind, permitted),
+		}, http.StatusNotFound)
+		return
+	}
+	if opts.limit > 0 && len(results) > opts.limit {
+		results = results[:opts.limit]
+	}
+
+	if results, ok := dirs.limitResponse(w, r, results); ok {
+		writeResults(w, r, results)
+	}
+}
+
+// maxQueryBody is the maximum size of a /query request body.
+const maxQueryBody = 1 << 20
+
+// queryBody is the JSON form of a /query request.
+type queryBody struct {
+	Q           string `json:"q"`
+	Kind        string `json:"kind"` // "imports", "dirs", "symbols", or "files".
+	Mode        string `json:"mode"`
+	Case        string `json:"case"`
+	Sort        string `json:"sort"`
+	Limit       int    `json:"limit"`
+	Root        string `json:"root"`
+	Stdlib      *bool  `json:"stdlib"`
+	TestOnly    *bool  `json:"testOnly"`
+	MinFiles    int    `json:"minFiles"`
+	Count       bool   `json:"count"`
+	Unversioned bool   `json:"unversioned"`
+	Strict      *bool  `json:"strict"`
+}
+
+var kindNames = map[string]queryKind{
+	"":        kindImports,
+	"imports": kindImports,
+	"dirs":    kindDirs,
+	"symbols": kindSymbols,
+	"files":   kindFiles,
+}
+
+// QueryHandler answers the queries posted in JSON request bodies,
+// with all the options in one place, in JSON unless another format
+// is asked for.
+func (dirs *index) QueryHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") == "" && r.URL.Query().Get("format") == "" {
+			r.Header.Set("Accept", "application/json")
+		}
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			writeError(w, r, "queries must be posted", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var body queryBody
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxQueryBody))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&body); err != nil {
+			writeError(w, r, fmt.Sprintf("invalid query: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		opts := queryOptions{query: body.Q, stdlib: body.Stdlib, testOnly: body.TestOnly, limit: body.Limit, count: body.Count, unversioned: body.Unversioned}
+		kind, ok := kindNames[body.Kind]
+		if !ok {
+			writeError(w, r, fmt.Sprintf("unknown query kind %q", body.Kind), http.StatusBadRequest)
+			return
+		}
+		opts.kind = kind
+
+		var err error
+		if opts.mode, err = parseMode(body.Mode); err != nil {
+			writeError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if opts.folding, err = parseFolding(body.Case); err != nil {
+			writeError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if opts.byBuilt, err = dirs.parseSort(body.Sort); err != nil {
+			writeError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if body.Limit < 0 {
+			writeError(w, r, fmt.Sprintf("invalid limit %d", body.Limit), http.StatusBadRequest)
+			return
+		}
+		if body.MinFiles < 0 {
+			writeError(w, r, fmt.Sprintf("invalid minFiles %d", body.MinFiles), http.StatusBadRequest)
+			return
+		}
+		opts.minFiles = body.MinFiles
+		if body.Root != "" {
+			opts.root = filepath.Clean(body.Root)
+		}
+		opts.strict = dirs.strictValid
+		if body.Strict != nil {
+			opts.strict = *body.Strict
+		}
+
+		dirs.answer(w, r, opts)
+	}
+}
+
+// limitResponse returns the results fitting in the configured response
+// size, setting the X-Truncated header if some are left out, or answers
+// the request with “413 Request Entity Too Large” and returns false
+// if oversized responses are rejected.
+func (dirs *index) limitResponse(w http.ResponseWriter, r *http.Request, results []result) ([]result, bool) {
+	if dirs.maxResponseBytes <= 0 {
+		return results, true
+	}
+
+	n := fitting(responseFormat(r), results, dirs.maxResponseBytes)
+	if n == len(results) {
+		return results, true
+	}
+	if dirs.rejectOversized {
+		msg := fmt.Sprintf("query %q: response exceeds %d bytes", r.URL.Path, dirs.maxResponseBytes)
+		writeError(w, r, msg, http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	w.Header().Set("X-Truncated", "true")
+	return results[:n], true
+}
+
+// awaitIndex waits for the index to be built for the configured time,
+// answering the request with “503 Service Unavailable” and returning false
+// if it isn't built by then.
+func (dirs *index) awaitIndex(w http.ResponseWriter, r *http.Request) bool {
+	if dirs.Ready() {
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), dirs.waitReady)
+	defer cancel()
+	if err := dirs.WaitReady(ctx); err != nil {
+		writeError(w, r, "index is not ready yet", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+// ResolveHandler answers with the import path of the package
+// in the directory given by the request path.
+func (dirs *index) ResolveHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		permitted, ok := dirs.permittedRoots(w, r)
+		if !ok || !dirs.awaitIndex(w, r) {
+			return
+		}
+
+		c, ok := dirs.Resolve(r.URL.Path)
+		if ok && permitted != nil {
+			ok = len(filterPermitted([]result{{entry: c}}, permitted)) > 0
+		}
+		if !ok {
+			writeError(w, r, fmt.Sprintf("%q is not a known package directory", r.URL.Path), http.StatusNotFound)
+			return
+		}
+		writeResults(w, r, []result{newResult(c, c.importPath)})
+	}
+}
+
+// ImportDirHandler answers with the directories providing
+// the import path given by the request path.
+func (dirs *index) ImportDirHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		permitted, ok := dirs.permittedRoots(w, r)
+		if !ok || !dirs.awaitIndex(w, r) {
+			return
+		}
+
+		entries := dirs.ImportDirs(r.URL.Path)
+		results := make([]result, len(entries))
+		for i, c := range entries {
+			results[i] = newResult(c, c.fullPath)
+		}
+		results = filterPermitted(results, permitted)
+		if len(results) == 0 {
+			writeError(w, r, fmt.Sprintf("import path %q is not found", r.URL.Path), http.StatusNotFound)
+			return
+		}
+		writeResults(w, r, results)
+	}
+}
+
+// BaseNameHandler answers with the directories whose base names are
+// given by the request path, whatever their parents, or, with
+// "?of=imports", the import paths whose last elements are. With
+// "?prefix=true", the base names only start with it.
+func (dirs *index) BaseNameHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Path
+		if name == "" || strings.ContainsAny(name, `/\`) {
+			writeError(w, r, fmt.Sprintf("invalid base name %q", name), http.StatusBadRequest)
+			return
+		}
+
+		kind := kindDirs
+		switch of := r.URL.Query().Get("of"); of {
+		case "", "dirs":
+		case "imports":
+			kind = kindImports
+		default:
+			writeError(w, r, fmt.Sprintf("invalid of parameter %q", of), http.StatusBadRequest)
+			return
+		}
+
+		prefix := false
+		if s := r.URL.Query().Get("prefix"); s != "" {
+			var err error
+			if prefix, err = strconv.ParseBool(s); err != nil {
+				writeError(w, r, fmt.Sprintf("invalid prefix parameter %q", s), http.StatusBadRequest)
+				return
+			}
+		}
+		permitted, ok := dirs.permittedRoots(w, r)
+		if !ok || !dirs.awaitIndex(w, r) {
+			return
+		}
+
+		entries := dirs.BaseNames(name, kind, prefix)
+		results := make([]result, len(entries))
+		for i, c := range entries {
+			path := c.fullPath
+			if kind == kindImports {
+				path = c.importPath
+			}
+			results[i] = newResult(c, path)
+		}
+		writeResults(w, r, filterPermitted(results, permitted))
+	}
+}
+
+// SymbolHandler answers with the import paths of the packages exporting
+// exactly the symbol named by the request path, e.g., “Handler”, or
+// of the ones with the package name or import path it's qualified with,
+// e.g., “http.Handler” or “net/http.Handler”, the importable ones first.
+func (dirs *index) SymbolHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		qualifier, symbol, ok := splitSymbol(r.URL.Path)
+		if !ok {
+			writeError(w, r, fmt.Sprintf("invalid symbol %q", r.URL.Path), http.StatusBadRequest)
+			return
+		}
+		permitted, ok := dirs.permittedRoots(w, r)
+		if !ok || !dirs.awaitIndex(w, r) {
+			return
+		}
+
+		entries := dirs.SymbolOwners(qualifier, symbol)
+		results := make([]result, len(entries))
+		for i, c := range entries {
+			results[i] = newResult(c, c.importPath)
+		}
+		writeResults(w, r, filterPermitted(results, permitted))
+	}
+}
+
+// errorBody is the JSON form of an error response.
+type errorBody struct {
+	Error     string `json:"error"`
+	Code      string `json:"code"` // The status text in snake case, e.g., "not_found".
+	RequestID string `json:"requestId,omitempty"`
+
+	// Suggestions are the closest paths to a query without matches.
+	Suggestions []string `json:"suggestions,omitempty"`
+}
+
+// writeError replies to the request with the error message and
+// the HTTP status code, like http.Error. Clients accepting JSON
+// get the error as a JSON object.
+func writeError(w http.ResponseWriter, r *http.Request, error string, code int) {
+	writeErrorBody(w, r, errorBody{Error: error}, code)
+}
+
+// writeErrorBody replies to the request like writeError, with the error
+// message and the suggestions of the body. The suggestions follow the
+// message in plain text, one per line, after a “did you mean:” line.
+func writeErrorBody(w http.ResponseWriter, r *http.Request, body errorBody, code int) {
+	switch responseFormat(r) {
+	case "application/json", "application/x-ndjson":
+		body.Code = strings.ToLower(strings.Replace(http.StatusText(code), " ", "_", -1))
+		body.RequestID = requestID(r.Context())
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(body)
+	default:
+		msg := body.Error
+		if len(body.Suggestions) > 0 {
+			suggestions := make([]string, len(body.Suggestions))
+			for i, s := range body.Suggestions {
+				suggestions[i] = textPath(s)
+			}
+			msg += "\ndid you mean:\n" + strings.Join(suggestions, "\n")
+		}
+		http.Error(w, msg, code)
+	}
+}
+
+// defaultRecent is the default number of packages returned by /recent.
+const defaultRecent = 20
+
+// RecentHandler answers with the directories of the most recently modified
+// packages, as many as given by the "limit" parameter.
+func (dirs *index) RecentHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		permitted, ok := dirs.permittedRoots(w, r)
+		if !ok || !dirs.awaitIndex(w, r) {
+			return
+		}
+
+		n := defaultRecent
+		if s := r.URL.Query().Get("limit"); s != "" {
+			var err error
+			if n, err = strconv.Atoi(s); err != nil || n <= 0 {
+				writeError(w, r, fmt.Sprintf("invalid limit parameter %q", s), http.StatusBadRequest)
+				return
+			}
+		}
+
+		// Keep the n latest of the permitted ones.
+		latest := n
+		if permitted != nil {
+			latest = dirs.Len()
+		}
+		entries := dirs.Recent(latest)
+		results := make([]result, len(entries))
+		for i, c := range entries {
+			results[i] = newResult(c, c.fullPath)
+		}
+		results = filterPermitted(results, permitted)
+		if len(results) > n {
+			results = results[:n]
+		}
+		writeResults(w, r, results)
+	}
+}
+
+// AllHandler answers with all the distinct import paths, or
+// directories, of the packages in the index, sorted, up to the number
+// given by the "limit" parameter, if any. As the responses are dumps
+// of the index, they require the update token, if one is configured,
+// or else a query token, if those are, and are subject to the response
+// size limit.
+func (dirs *index) AllHandler(kind queryKind) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var permitted []string
+		if dirs.updateToken != "" {
+			if !validToken(r, dirs.updateToken) {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeError(w, r, "invalid or missing token", http.StatusUnauthorized)
+				return
+			}
+		} else {
+			var ok bool
+			if permitted, ok = dirs.permittedRoots(w, r); !ok {
+				return
+			}
+		}
+		if !dirs.awaitIndex(w, r) {
+			return
+		}
+
+		n := -1
+		if s := r.URL.Query().Get("limit"); s != "" {
+			var err error
+			if n, err = strconv.Atoi(s); err != nil || n <= 0 {
+				writeError(w, r, fmt.Sprintf("invalid limit parameter %q", s), http.StatusBadRequest)
+				return
+			}
+		}
+
+		entries := dirs.All(kind)
+		results := make([]result, len(entries))
+		for i, c := range entries {
+			results[i] = newResult(c, c.importPath)
+			if kind == kindDirs {
+				results[i].Path = c.fullPath
+			}
+		}
+		results = filterPermitted(results, permitted)
+		if n >= 0 && len(results) > n {
+			results = results[:n]
+		}
+
+		if results, ok := dirs.limitResponse(w, r, results); ok {
+			writeResults(w, r, results)
+		}
+	}
+}
+
+// trimGoFile strips the last element of the query if it names a Go file,
+// e.g., “net/http/server.go” becomes “net/http”, to query for the package
+// containing the file. Queries without a directory part are left as is.
+func trimGoFile(query string) string {
+	i := strings.LastIndexAny(query, `/\`)
+	if i < 0 || !strings.HasSuffix(query, ".go") || len(query)-i-1 <= len(".go") {
+		return query
+	}
+	return query[:i]
+}
+
+// filterValid returns the results that are paths with packages, leaving
+// out the paths leading to them returned if no package matches. The cached
+// results aren't modified.
+func filterValid(results []result) []result {
+	out := []result{}
+	for _, res := range results {
+		if res.entry.valid {
+			out = append(out, res)
+		}
+	}
+	return out
+}
+
+// filterStdlib returns the results that are standard library paths,
+// or the ones that aren't, if stdlib is false. The cached results
+// aren't modified.
+func filterStdlib(results []result, stdlib bool) []result {
+	out := []result{}
+	for _, res := range results {
+		if res.Stdlib == stdlib {
+			out = append(out, res)
+		}
+	}
+	return out
+}
+
+// filterTestOnly returns the results that are test-only packages,
+// or the ones that aren't, if testOnly is false. The cached results
+// aren't modified.
+func filterTestOnly(results []result, testOnly bool) []result {
+	out := []result{}
+	for _, res := range results {
+		if res.TestOnly == testOnly {
+			out = append(out, res)
+		}
+	}
+	return out
+}
+
+// filterMinFiles returns the results of the packages with at least n
+// Go files, leaving out the stub packages and the directories without
+// packages. The cached results aren't modified.
+func filterMinFiles(results []result, n int) []result {
+	out := []result{}
+	for _, res := range results {
+		if res.entry.goFiles >= n {
+			out = append(out, res)
+		}
+	}
+	return out
+}
+
+// filterRoot returns the results under the root directory.
+// The cached results aren't modified.
+func filterRoot(results []result, root string) []result {
+	out := []result{}
+	for _, res := range results {
+		if underRoot(res.entry.fullPath, root) {
+			out = append(out, res)
+		}
+	}
+	return out
+}
+
+// relativeTo returns the results with the paths under the base directory
+// made relative to it, and their offsets shifted accordingly. The other
+// paths are left absolute. The cached results aren't modified.
+func relativeTo(results []result, base string) []result {
+	out := make([]result, len(results))
+	for i, res := range results {
+		out[i] = res
+		if !underRoot(res.Path, base) {
+			continue
+		}
+		rel, err := filepath.Rel(base, res.Path)
+		if err != nil {
+			continue
+		}
+
+		// The offsets of the matches within the base are dropped.
+		shift := len(res.Path) - len(rel)
+		out[i].Path, out[i].Offsets = rel, nil
+		for _, o := range res.Offsets {
+			if o[1] <= shift {
+				continue
+			}
+			start := o[0] - shift
+			if start < 0 {
+				start = 0
+			}
+			out[i].Offsets = append(out[i].Offsets, [2]int{start, o[1] - shift})
+		}
 	}
+	return out
+}
+
+// filterCommands returns the results that are commands, or library
+// packages, if commands is false. The cached results aren't modified.
+func filterCommands(results []result, commands bool) []result {
+	out := []result{}
+	for _, res := range results {
+		if res.entry.valid && res.Command == commands {
+			out = append(out, res)
+		}
+	}
+	return out
 }
 
 func (dirs *index) UpdateHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if dirs.disableUpdate {
+			writeError(w, r, "updates are disabled", http.StatusForbidden)
+			return
+		}
+		if dirs.frozen {
+			writeError(w, r, "the index is frozen", http.StatusForbidden)
+			return
+		}
+		if dirs.updateToken != "" && !validToken(r, dirs.updateToken) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, r, "invalid or missing token", http.StatusUnauthorized)
+			return
+		}
+
 		dirs.Index()
 	}
 }
+
+// configBody is the JSON request body of /config.
+type configBody struct {
+	Roots      []string `json:"roots"`
+	Exclusions []string `json:"exclusions"` // As listed for Exclusions.
+}
+
+// ConfigHandler replaces the roots and the exclusions with the ones
+// posted, at once, and reindexes (see Reconfigure). It's authorized
+// like /update.
+func (dirs *index) ConfigHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if dirs.disableUpdate {
+			writeError(w, r, "updates are disabled", http.StatusForbidden)
+			return
+		}
+		if dirs.frozen {
+			writeError(w, r, "the index is frozen", http.StatusForbidden)
+			return
+		}
+		if dirs.updateToken != "" && !validToken(r, dirs.updateToken) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, r, "invalid or missing token", http.StatusUnauthorized)
+			return
+		}
+
+		var body configBody
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&body); err != nil {
+			writeError(w, r, fmt.Sprintf("invalid configuration: %v", err), http.StatusBadRequest)
+			return
+		}
+		if len(body.Roots) == 0 {
+			writeError(w, r, "no roots", http.StatusBadRequest)
+			return
+		}
+
+		exclusions := strings.NewReader(strings.Join(body.Exclusions, "\n"))
+		if err := dirs.Reconfigure(body.Roots, exclusions); err != nil {
+			writeError(w, r, fmt.Sprintf("invalid configuration: %v", err), http.StatusBadRequest)
+		}
+	}
+}
+
+// validToken reports whether the request carries the bearer token.
+func validToken(r *http.Request, token string) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(token)) == 1
+}
+
+// permittedRoots returns the directories the results of the request
+// must be under, by its query token, or nil if query tokens aren't
+// required. It answers the requests without a valid token with
+// “401 Unauthorized”, and with a token permitted no directories with
+// “403 Forbidden”, returning false.
+func (dirs *index) permittedRoots(w http.ResponseWriter, r *http.Request) ([]string, bool) {
+	dirs.mu.RLock()
+	tokens := dirs.queryTokens
+	dirs.mu.RUnlock()
+	if tokens == nil {
+		return nil, true
+	}
+
+	// Compare all the tokens in constant time,
+	// rather than looking the request's one up.
+	var permitted []string
+	for token, roots := range tokens {
+		if validToken(r, token) {
+			permitted = roots
+		}
+	}
+	switch {
+	case permitted == nil:
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, r, "invalid or missing token", http.StatusUnauthorized)
+		return nil, false
+	case len(permitted) == 0:
+		writeError(w, r, "the token permits no directories", http.StatusForbidden)
+		return nil, false
+	}
+	return permitted, true
+}
+
+// filterPermitted returns the results under any of the permitted roots,
+// or all of them if permitted is nil.
+func filterPermitted(results []result, permitted []string) []result {
+	if permitted == nil {
+		return results
+	}
+
+	out := []result{}
+	for _, res := range results {
+		if permits(permitted, res.entry.fullPath) {
+			out = append(out, res)
+		}
+	}
+	return out
+}
+
+// permits reports whether the directory at path lies under one of
+// the permitted directories, or the directories aren't limited.
+func permits(permitted []string, path string) bool {
+	if permitted == nil {
+		return true
+	}
+	for _, root := range permitted {
+		if underRoot(path, root) {
+			return true
+		}
+	}
+	return false
+}
+
+// stats are the index statistics reported by /stats.
+type stats struct {
+	Directories int        `json:"directories"`
+	Files       int        `json:"files"`     // Files in the indexed directories.
+	FileBytes   int64      `json:"fileBytes"` // Total size of the files.
+	Cache       cacheStats `json:"cache"`
+
+	// Goroutines is the number of goroutines, for spotting leaks
+	// in long running servers.
+	Goroutines int `json:"goroutines"`
+
+	// Exclusions are the numbers of directories each exclusion rule left
+	// out of the last indexing run; a rule without any may be misspelled.
+	Exclusions map[string]int `json:"exclusions,omitempty"`
+
+	// Panics are the panics of importing packages in the last indexing
+	// run, by directory, indexed as directories without packages.
+	Panics map[string]string `json:"panics,omitempty"`
+
+	// Partial is set while the rest of the directories are indexed
+	// after the -index-deadline.
+	Partial bool `json:"partial,omitempty"`
+}
+
+// StatsHandler answers with the index statistics. With a query token,
+// only the token's directories are counted, and the numbers of files
+// and exclusion hits, which aren't kept by directory, are left out.
+func (dirs *index) StatsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		permitted, ok := dirs.permittedRoots(w, r)
+		if !ok {
+			return
+		}
+
+		dirs.mu.RLock()
+		s := stats{
+			Directories: len(dirs.index),
+			Files:       dirs.files,
+			FileBytes:   dirs.fileBytes,
+			Cache:       dirs.cache.stats(),
+			Goroutines:  runtime.NumGoroutine(),
+			Exclusions:  dirs.exclusionHits,
+			Panics:      dirs.importPanics,
+			Partial:     dirs.partial,
+		}
+		if permitted != nil {
+			s.Directories, s.Files, s.FileBytes, s.Exclusions = 0, 0, 0, nil
+			for _, c := range dirs.index {
+				if permits(permitted, c.fullPath) {
+					s.Directories++
+				}
+			}
+			s.Panics = map[string]string{}
+			for dir, v := range dirs.importPanics {
+				if permits(permitted, dir) {
+					s.Panics[dir] = v
+				}
+			}
+		}
+		dirs.mu.RUnlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+	}
+}
+
+// RootsHandler answers with the status of the root directories, with
+// a query token, of the ones under the token's directories.
+func (dirs *index) RootsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		permitted, ok := dirs.permittedRoots(w, r)
+		if !ok {
+			return
+		}
+
+		roots := []rootStatus{}
+		for _, s := range dirs.RootsStatus() {
+			if permits(permitted, s.Root) {
+				roots = append(roots, s)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(roots)
+	}
+}
+
+// The diagnostics of the import paths list the directories they are
+// found in, so they are limited to the directories of a query token,
+// as the queries are.
+
+func (dirs *index) CollisionsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		permitted, ok := dirs.permittedRoots(w, r)
+		if !ok {
+			return
+		}
+
+		// The collisions between other directories aren't the token's.
+		collisions := map[string][]string{}
+		for importPath, paths := range dirs.Collisions() {
+			kept := []string{}
+			for _, path := range paths {
+				if permits(permitted, path) {
+					kept = append(kept, path)
+				}
+			}
+			if len(kept) > 1 {
+				collisions[importPath] = kept
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(collisions)
+	}
+}
+
+func (dirs *index) MismatchesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		permitted, ok := dirs.permittedRoots(w, r)
+		if !ok {
+			return
+		}
+
+		mismatches := []mismatch{}
+		for _, m := range dirs.Mismatches() {
+			if permits(permitted, m.Dir) {
+				mismatches = append(mismatches, m)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(mismatches)
+	}
+}
+
+func (dirs *index) ConflictsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		permitted, ok := dirs.permittedRoots(w, r)
+		if !ok {
+			return
+		}
+
+		conflicts := map[string][]string{}
+		for dir, importPaths := range dirs.Conflicts() {
+			if permits(permitted, dir) {
+				conflicts[dir] = importPaths
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(conflicts)
+	}
+}
+
+// formats are the media types of the response formats by their names,
+// as given by the "format" parameter.
+var formats = map[string]string{
+	"text":   "text/plain",
+	"json":   "application/json",
+	"ndjson": "application/x-ndjson",
+	"csv":    "text/csv",
+	"binary": binaryMediaType,
+}
+
+// responseFormat returns the media type of the response format named by
+// the request's "format" parameter or, in its absence or if it's unknown,
+// of the format the client accepts; plain text by default.
+func responseFormat(r *http.Request) string {
+	if t, ok := formats[r.URL.Query().Get("format")]; ok {
+		return t
+	}
+	for _, t := range []string{binaryMediaType, "application/x-ndjson", "application/json", "text/csv"} {
+		if accepts(r, t) {
+			return t
+		}
+	}
+	return "text/plain"
+}
+
+// csvHeader names the columns of the CSV output.
+var csvHeader = []string{"full_path", "import_path", "valid", "package"}
+
+// csvRecord returns the CSV output columns of a result.
+func csvRecord(res result) []string {
+	return []string{res.entry.fullPath, res.entry.importPath, strconv.FormatBool(res.entry.valid), res.entry.name}
+}
+
+// writeResults writes the result paths as newline separated text or,
+// if the client asked for it, as JSON, newline delimited JSON, or
+// in the binary format, or the index entries of the results as CSV.
+func writeResults(w http.ResponseWriter, r *http.Request, results []result) {
+	switch responseFormat(r) {
+	case binaryMediaType:
+		writeBinary(w, results)
+	case "application/x-ndjson":
+		writeNDJSON(w, results)
+	case "application/json":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	case "text/csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		cw := csv.NewWriter(w)
+		cw.Write(csvHeader)
+		for _, res := range results {
+			cw.Write(csvRecord(res))
+		}
+		cw.Flush()
+	default:
+		paths := make([]string, len(results))
+		for i, res := range results {
+			paths[i] = textPath(res.Path)
+		}
+		fmt.Fprintln(w, strings.Join(paths, "\n"))
+	}
+}
+
+// textPath returns the path as written in plain text responses, one per
+// line: quoted, as a Go string literal, if it contains control characters,
+// e.g., newlines in directory names, which would otherwise corrupt the lines
+// or pass for more paths, or if it starts with a quote, so that it can't
+// be mistaken for a quoted path.
+func textPath(path string) string {
+	if strings.IndexFunc(path, unicode.IsControl) >= 0 || strings.HasPrefix(path, `"`) {
+		return strconv.Quote(path)
+	}
+	return path
+}
+
+// writeCount replies to the request with the number of results, as
+// a {"count": N} JSON object to the clients accepting JSON, and as plain
+// text otherwise.
+func writeCount(w http.ResponseWriter, r *http.Request, n int) {
+	switch responseFormat(r) {
+	case "application/json", "application/x-ndjson":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Count int `json:"count"`
+		}{n})
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, n)
+	}
+}
+
+// fitting returns the number of leading results whose encoding,
+// in the format of the media type, fits in max bytes.
+func fitting(format string, results []result, max int) int {
+	ndjson := format == "application/x-ndjson"
+	array := format == "application/json"
+
+	size := 0
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	switch format {
+	case "application/json":
+		size = len("[]\n")
+	case "text/csv":
+		cw.Write(csvHeader)
+		cw.Flush()
+		size = buf.Len()
+	case binaryMediaType:
+		size = len(binary.AppendUvarint(nil, uint64(len(results))))
+	}
+
+	for i, res := range results {
+		n := len(textPath(res.Path)) + len("\n")
+		if format == "text/csv" {
+			buf.Reset()
+			cw.Write(csvRecord(res))
+			cw.Flush()
+			n = buf.Len()
+		}
+		if format == binaryMediaType {
+			n = len(appendBinary(nil, res))
+		}
+		if ndjson || array {
+			b, err := json.Marshal(res)
+			if err != nil {
+				return i
+			}
+			n = len(b) + len("\n") // Or a comma, in an array.
+			if array && i == 0 {
+				n--
+			}
+		}
+
+		if size+n > max {
+			return i
+		}
+		size += n
+	}
+	return len(results)
+}
+
+// writeNDJSON writes one JSON object per result, flushing the output
+// periodically so that clients can process long responses incrementally.
+func writeNDJSON(w http.ResponseWriter, results []result) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	for i, res := range results {
+		if err := enc.Encode(res); err != nil {
+			return
+		}
+
+		if flusher != nil && (i+1)%ndjsonFlushLines == 0 {
+			flusher.Flush()
+		}
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
+
+// accepts reports whether the request's Accept header lists the media type.
+func accepts(r *http.Request, mediaType string) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if t, _, err := mime.ParseMediaType(accept); err == nil && t == mediaType {
+			return true
+		}
+	}
+	return false
+}
@@ -2,147 +2,1801 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"encoding/csv"
+	"fmt"
 	"go/build"
 	"io"
+	"io/fs"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+type index struct {
+	mu sync.RWMutex
+
+	// indexing serializes the indexing runs, which hold mu only
+	// to take a snapshot of the configuration and to store the results.
+	indexing sync.Mutex
+
+	// index is nil until the first indexing run completes. Neither it
+	// nor symbols are modified in place once stored, only replaced.
+	index      []details
+	files      int       // Number of files seen by the last indexing run.
+	fileBytes  int64     // Total size of the files.
+	stamp      treeStamp // Of the trees indexed by the last run.
+	partial    bool      // Set while the rest is indexed after a deadline.
+	rootDirs   []string
+	exclusions []exclusion
+
+	// listedDirs, if not nil, are the directories to index, each by
+	// itself, instead of walking the trees of the roots (see ListDirs).
+	listedDirs []string
+
+	// rootPackages are the numbers of packages found by the last
+	// indexing run in the root directories.
+	rootPackages map[string]int
+
+	// indexRuns and indexErrors count the completed indexing runs, and
+	// the directories that failed to be read or imported by them, by the
+	// class of the error (see errorClass); lastIndexed is when the last
+	// run completed.
+	indexRuns   uint64
+	indexErrors map[string]uint64
+	lastIndexed time.Time
+
+	// exclusionHits are the numbers of directories each exclusion rule
+	// left out of the last indexing run, by the rule as written.
+	exclusionHits map[string]int
+
+	// importPanics are the panics of importing the packages, by
+	// directory, in the last indexing run (see importPackage).
+	importPanics map[string]string
+
+	// conflicts are the import paths of the directories indexed
+	// with more than one, the chosen one first (see resolveConflicts).
+	conflicts map[string][]string
+
+	// excludeRegexps exclude directories by their slash separated
+	// absolute paths.
+	excludeRegexps []*regexp.Regexp
+
+	// maxDirEntries, if positive, is the number of entries of directories
+	// without Go files above which the indexer doesn't descend into them.
+	maxDirEntries int
+
+	// includeHidden makes the indexer descend into directories
+	// whose names begin with a dot.
+	includeHidden bool
+
+	// foldStdlib makes the queries match the standard library paths
+	// case-insensitively, while the other paths stay case-sensitive.
+	foldStdlib bool
+
+	// canonicalImports makes the import path queries return only
+	// the canonical directory of an import path provided by several
+	// (see canonical).
+	canonicalImports bool
+
+	// strictValid makes the queries return only the paths with packages,
+	// unless asked otherwise, and no paths if no package matches.
+	strictValid bool
+
+	// parallelThreshold, if positive, is the number of indexed directories
+	// above which the queries scan the index in parallel partitions.
+	parallelThreshold int
+
+	// queryTimeout limits the time a query may take. Zero means no limit.
+	queryTimeout time.Duration
+
+	// cache caches query results between reindexing.
+	cache *cache
+
+	// maxResponseBytes limits the size of query responses. Zero means
+	// no limit. Larger responses are truncated, or rejected if
+	// rejectOversized is set.
+	maxResponseBytes int
+	rejectOversized  bool
+
+	// disableUpdate disables the /update route. Otherwise, if updateToken
+	// is set, /update requires it as a bearer token.
+	disableUpdate bool
+	updateToken   string
+
+	// queryTokens, if not nil, are the bearer tokens the queries require,
+	// mapped to the directories the results of each must be under
+	// (see QueryTokens).
+	queryTokens map[string][]string
+
+	// frozen keeps the index built at the start: the periodic updates
+	// and refreshes don't run, and /update is disabled.
+	frozen bool
+
+	// indexSymbols makes the indexer collect the exported symbols
+	// of packages, by directory, into symbols.
+	indexSymbols bool
+	symbols      map[string]symbolSet
+
+	// indexWorkers, if positive, is the number of the goroutines importing
+	// packages while indexing; otherwise, there are as many as CPUs.
+	indexWorkers int
+
+	// builtTimes makes the indexer look up the times the packages were
+	// last built (see builtTime), for ordering the results by them.
+	builtTimes bool
+
+	// logRequests enables logging the requests, with their IDs.
+	logRequests bool
+
+	// waitReady is how long queries wait for the index to be built.
+	waitReady time.Duration
+
+	readyOnce, builtOnce sync.Once
+	ready                chan struct{} // Closed when the index is built.
+}
+
+// treeStamp summarizes the indexed directory trees, so that changes
+// in them can be noticed without reindexing. Adding, removing or renaming
+// a file or directory updates the modification time of its parent.
+type treeStamp struct {
+	dirs    int       // Number of directories.
+	modTime time.Time // Latest modification time of the directories.
+}
+
+func (s *treeStamp) add(info os.FileInfo) {
+	s.dirs++
+	if info.ModTime().After(s.modTime) {
+		s.modTime = info.ModTime()
+	}
+}
+
+func (s treeStamp) equal(t treeStamp) bool {
+	return s.dirs == t.dirs && s.modTime.Equal(t.modTime)
+}
+
+type details struct {
+	fullPath   string
+	importPath string
+	name       string // Package name.
+	valid      bool
+	goVersion  string // Latest Go version required by build constraints, if any.
+
+	// testOnly is set for the packages with only _test.go files,
+	// e.g., external tests, which can't be imported.
+	testOnly bool
+
+	// goFiles is the number of the Go files of the package, tests and
+	// the files excluded by build constraints left out.
+	goFiles int
+
+	// builtTime is when the package was last installed, if known
+	// (see builtTime).
+	builtTime time.Time
+
+	// modTime is the modification time of the directory or, for
+	// an invalid package, the latest one of the directory and its Go files
+	// (see RefreshInvalid).
+	modTime time.Time
+}
+
+// isCommand reports whether the entry is of a command, i.e. a main package,
+// rather than of a library package or a directory without packages.
+func (c details) isCommand() bool {
+	return c.valid && c.name == "main"
+}
+
+// isTestOnly reports whether the package has only test files, in
+// the package itself or an external test package, so that
+// there's nothing to import.
+func isTestOnly(p *build.Package) bool {
+	return len(p.GoFiles)+len(p.CgoFiles) == 0 && len(p.TestGoFiles)+len(p.XTestGoFiles) > 0
+}
+
+type queryKind uint
+
+const (
+	kindImports queryKind = iota + 1
+	kindDirs
+	kindSymbols
+	kindFiles
 )
 
-type index struct {
-	mu         sync.RWMutex
-	index      []details
-	rootDirs   []string
-	exclusions map[string]struct{}
+// cancelCheckInterval is the number of index entries scanned
+// between checks for query cancellation.
+const cancelCheckInterval = 1024
+
+// Index walks the directory trees and creates an index with path information.
+func (dirs *index) Index() {
+	dirs.IndexWithin(0)
+}
+
+// IndexWithin indexes like Index, but if the deadline d is positive and
+// elapses before indexing completes, it stores the directories indexed
+// so far and marks the index ready, so that queries are answered from
+// the partial index while the rest is indexed. The trees are walked
+// breadth-first, so that the partial index has the shallow directories.
+// If the directories are listed (see ListDirs), only they are indexed.
+func (dirs *index) IndexWithin(d time.Duration) {
+	dirs.indexing.Lock()
+	defer dirs.indexing.Unlock()
+
+	// Walk a snapshot of the configuration, so that queries aren't held up
+	// and concurrent Roots or Exclusions calls don't affect the walk.
+	dirs.mu.RLock()
+	cfg := dirs.snapshot()
+	previous := dirs.index
+	dirs.mu.RUnlock()
+
+	type queued struct {
+		root int
+		path string
+		info os.FileInfo
+	}
+	queue := []queued{}
+	entries := []rooted{}
+	files, fileBytes := 0, int64(0)
+	stamp := treeStamp{}
+	cfg.stampArtifacts(&stamp)
+	symbols := map[string]symbolSet{}
+	errs := map[string]uint64{}
+	panics := map[string]string{}
+	hits := make([]int, len(cfg.exclusions))
+
+	// The pool only lives for the duration of the run.
+	pool := interner{}
+
+	for _, path := range cfg.listedDirs {
+		info, err := os.Stat(path)
+		if err != nil || !info.IsDir() {
+			log.Printf("Skipping %s: not a directory", path)
+			errs[errorWalk]++
+			continue
+		}
+		queue = append(queue, queued{cfg.rootOf(path), path, info})
+	}
+
+	// Walk the roots, unless the directories are listed.
+	roots := cfg.rootDirs
+	if cfg.listedDirs != nil {
+		roots = nil
+	}
+	for i, root := range roots {
+		info, err := os.Lstat(root)
+
+		// Keep the entries of a root that went away (e.g., an unmounted
+		// drive) until it comes back.
+		if os.IsNotExist(err) {
+			kept := 0
+			for _, c := range previous {
+				if underRoot(c.fullPath, root) {
+					entries = append(entries, rooted{i, c})
+					if s, ok := cfg.symbols[c.fullPath]; ok {
+						symbols[c.fullPath] = s
+					}
+					kept++
+				}
+			}
+			log.Printf("Root %s is missing; keeping its %d previously indexed directories", root, kept)
+			continue
+		}
+		if err == nil && info.IsDir() {
+			queue = append(queue, queued{i, root, info})
+		}
+	}
+
+	deadline := time.Now().Add(d)
+	partial := false
+	for len(queue) > 0 {
+		if d > 0 && !partial && time.Now().After(deadline) {
+			partial = true
+			copied := make(map[string]symbolSet, len(symbols))
+			for dir, s := range symbols {
+				copied[dir] = s
+			}
+
+			dirs.mu.Lock()
+			// Leave out the conflicting duplicates, as the final index does.
+			index, _ := resolveConflicts(walkOrder(entries), cfg.rootDirs)
+			dirs.index, dirs.symbols, dirs.partial = index, copied, true
+			dirs.mu.Unlock()
+
+			dirs.cache.clear()
+			dirs.builtOnce.Do(func() { close(dirs.readyc()) })
+			log.Printf("Indexed %d directories by the deadline; indexing the rest", len(entries))
+		}
+
+		batch := queue
+		if len(batch) > importBatch {
+			batch = batch[:importBatch]
+		}
+		queue = queue[len(batch):]
+
+		// Import the packages of the batch in parallel, but collect them
+		// in the walk order, so that the index doesn't depend on which
+		// worker finishes first.
+		kept, paths := []queued{}, []string{}
+		for _, q := range batch {
+			root := cfg.listedRoot(q.root, q.path)
+			if cfg.skipDir(root, q.path) {
+				if i := cfg.skippingRule(root, q.path); i >= 0 {
+					hits[i]++
+				}
+				continue
+			}
+			if i := cfg.keepingRule(root, q.path); i >= 0 {
+				hits[i]++
+			}
+			kept = append(kept, q)
+			paths = append(paths, q.path)
+		}
+		visited := cfg.visitAll(paths)
+
+		for j, q := range kept {
+			stamp.add(q.info)
+
+			v := visited[j]
+			err := v.err
+			if e, ok := err.(importPanic); ok {
+				panics[q.path] = fmt.Sprint(e.value)
+			}
+			c := details{fullPath: q.path, modTime: q.info.ModTime()}
+			pool.fillPackage(&c, v)
+			if _, noGo := err.(*build.NoGoError); !c.valid && !noGo {
+				c.modTime = v.modTime
+			}
+			if class := errorClass(err); class != "" {
+				errs[class]++
+			}
+
+			// Drop the packages excluded by their import paths, but still
+			// walk their contents, which later rules may re-include.
+			if i := cfg.excludingImportRule(c.importPath); i >= 0 {
+				hits[i]++
+			} else {
+				if i := cfg.reincludingImportRule(c.importPath); i >= 0 {
+					hits[i]++
+				}
+				entries = append(entries, rooted{q.root, c})
+				if cfg.indexSymbols && err == nil {
+					symbols[q.path] = v.symbols
+				}
+			}
+
+			// Skip the contents of the directories that can't be read,
+			// as filepath.Walk would.
+			children, err := v.children, v.readErr
+			if err != nil {
+				log.Printf("Skipping the contents of %s: %v", q.path, err)
+				errs[errorWalk]++
+				continue
+			}
+			if cfg.crowded(children) {
+				log.Printf("Skipping the contents of %s: %d entries without Go files", q.path, len(children))
+				continue
+			}
+			for _, child := range children {
+				info, err := child.Info()
+				if err != nil {
+					errs[errorWalk]++
+					continue
+				}
+				if !info.IsDir() {
+					files++
+					fileBytes += info.Size()
+					continue
+				}
+				if cfg.listedDirs != nil {
+					continue
+				}
+				queue = append(queue, queued{q.root, filepath.Join(q.path, child.Name()), info})
+			}
+		}
+	}
+
+	packages := map[string]int{}
+	for _, c := range entries {
+		if c.valid && c.root < len(cfg.rootDirs) {
+			packages[cfg.rootDirs[c.root]]++
+		}
+	}
+
+	index, conflicts := resolveConflicts(walkOrder(entries), cfg.rootDirs)
+
+	dirs.mu.Lock()
+	dirs.index, dirs.symbols, dirs.partial = index, symbols, false
+	dirs.conflicts = conflicts
+	dirs.rootPackages = packages
+	dirs.files, dirs.fileBytes = files, fileBytes
+	dirs.stamp = stamp
+	if dirs.indexErrors == nil {
+		dirs.indexErrors = map[string]uint64{}
+	}
+	for class, n := range errs {
+		dirs.indexErrors[class] += n
+	}
+	dirs.indexRuns++
+	dirs.lastIndexed = time.Now()
+	dirs.exclusionHits = map[string]int{}
+	for i, e := range cfg.exclusions {
+		dirs.exclusionHits[e.rule] += hits[i]
+	}
+	dirs.importPanics = panics
+	dirs.mu.Unlock()
+
+	dirs.cache.clear()
+	dirs.builtOnce.Do(func() { close(dirs.readyc()) })
+	log.Printf("Indexed %d directories", len(entries))
+}
+
+// importBatch is the number of the queued directories an indexing run
+// imports in parallel before collecting them.
+const importBatch = 256
+
+// visit is what an indexing run finds in a directory: the package,
+// by importPackage, and the facts about it to index, and the entries of
+// the directory to walk.
+type visit struct {
+	p         *build.Package
+	err       error
+	goVersion string
+	builtTime time.Time
+	symbols   symbolSet
+	modTime   time.Time // Of the directory and its Go files, if the package is invalid.
+
+	children []fs.DirEntry
+	readErr  error
+}
+
+// workers returns the number of the goroutines importing the packages
+// of an indexing run.
+func (dirs *index) workers() int {
+	if dirs.indexWorkers > 0 {
+		return dirs.indexWorkers
+	}
+	return runtime.NumCPU()
+}
+
+// visitAll visits the directories in parallel, by as many goroutines
+// as workers returns, and returns the visits in the order of the paths.
+// The caller holds a snapshot of the configuration, which is only read.
+func (dirs *index) visitAll(paths []string) []visit {
+	visits := make([]visit, len(paths))
+	next := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < dirs.workers() && w < len(paths); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				visits[i] = dirs.visit(paths[i])
+			}
+		}()
+	}
+	for i := range paths {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return visits
+}
+
+// visit imports the package in the directory at path and reads the
+// directory. The symbols are only collected from the packages kept
+// by the import path exclusions. A panic reading the package's files,
+// e.g., in go/parser, makes it an invalid package, as in importPackage,
+// rather than crash the indexer.
+func (dirs *index) visit(path string) (v visit) {
+	defer func() {
+		if e := recover(); e != nil {
+			v = visit{modTime: dirModTime(path)}
+			v.p, v.err = panicked(path, e)
+			v.children, v.readErr = os.ReadDir(path)
+		}
+	}()
+
+	v.p, v.err = importPackage(path)
+	if v.err == nil {
+		v.goVersion = goVersion(v.p)
+		if dirs.builtTimes {
+			v.builtTime = builtTime(v.p)
+		}
+		if dirs.indexSymbols && dirs.excludingImportRule(v.p.ImportPath) < 0 {
+			v.symbols = dirs.packageSymbols(path, v.p)
+		}
+	} else if _, noGo := v.err.(*build.NoGoError); !noGo {
+		v.modTime = dirModTime(path)
+	}
+
+	v.children, v.readErr = os.ReadDir(path)
+	return
+}
+
+// fillPackage records in the index entry c the package imported by
+// the visit of its directory, interning its strings in the pool, so
+// that indexing runs and refreshes record the packages alike.
+func (in interner) fillPackage(c *details, v visit) {
+	c.importPath = in.importPath(c.fullPath, v.p.ImportPath)
+	c.name = in.intern(v.p.Name)
+	c.valid = v.err == nil
+	if c.valid {
+		c.goVersion = in.intern(v.goVersion)
+		c.testOnly = isTestOnly(v.p)
+		c.goFiles = len(v.p.GoFiles) + len(v.p.CgoFiles)
+		c.builtTime = v.builtTime
+	}
+}
+
+// Load replaces the index with the entries, as if an indexing run had
+// found their directories, without walking the trees, so that queries
+// can be tested without directories on disk. As when indexing, the entries
+// in or under the directories excluded from indexing under a root, and
+// the entries excluded by their import paths, are left out.
+func (dirs *index) Load(entries []details) {
+	dirs.indexing.Lock()
+	defer dirs.indexing.Unlock()
+
+	dirs.mu.Lock()
+	index, packages := []details{}, map[string]int{}
+	for _, c := range entries {
+		root := ""
+		for _, r := range dirs.rootDirs {
+			if underRoot(c.fullPath, r) {
+				root = r
+				break
+			}
+		}
+		if dirs.loadExcluded(root, c) {
+			continue
+		}
+
+		index = append(index, c)
+		if c.valid && root != "" {
+			packages[root]++
+		}
+	}
+	index, conflicts := resolveConflicts(index, dirs.rootDirs)
+	dirs.index, dirs.symbols, dirs.partial = index, nil, false
+	dirs.conflicts = conflicts
+	dirs.rootPackages = packages
+	dirs.mu.Unlock()
+
+	dirs.cache.clear()
+	dirs.builtOnce.Do(func() { close(dirs.readyc()) })
+}
+
+// readIndex reads index entries for Load from CSV in the format of the CSV
+// responses, with the header row, e.g., as saved from /all/dirs.
+func readIndex(r io.Reader) ([]details, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = len(csvHeader)
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("no header row")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if strings.Join(header, ",") != strings.Join(csvHeader, ",") {
+		return nil, fmt.Errorf("header %q, want %q", header, csvHeader)
+	}
+
+	entries := []details{}
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		valid, err := strconv.ParseBool(record[2])
+		if err != nil {
+			line, _ := cr.FieldPos(2)
+			return nil, fmt.Errorf("line %d: invalid valid column %q", line, record[2])
+		}
+		entries = append(entries, details{
+			fullPath:   record[0],
+			importPath: record[1],
+			valid:      valid,
+			name:       record[3],
+		})
+	}
+}
+
+// loadExcluded reports whether the entry would have been left out
+// of the index by a walk of the root, if any. The caller holds dirs.mu.
+func (dirs *index) loadExcluded(root string, c details) bool {
+	if dirs.excludedImport(c.importPath) {
+		return true
+	}
+	if root == "" {
+		return false
+	}
+	for path := c.fullPath; ; path = filepath.Dir(path) {
+		if dirs.skipDir(root, path) {
+			return true
+		}
+		if path == root || filepath.Dir(path) == path {
+			return false
+		}
+	}
+}
+
+// resolveConflicts drops the entries of the directories indexed with
+// more than one import path, e.g., reached through a symlink or a module
+// replacement under different roots, or loaded so, except the ones
+// with the chosen import path: a non-local one, and the least of them,
+// so that the queries don't depend on the order of the roots. It returns
+// the remaining entries, and the import paths of those directories,
+// by their physical paths (see physicalPaths), the chosen one first.
+func resolveConflicts(entries []details, roots []string) ([]details, map[string][]string) {
+	physical := physicalPaths(roots)
+	byDir := map[string][]string{}
+	dirOf := make([]string, len(entries))
+	for i, c := range entries {
+		dir := physical(c.fullPath)
+		dirOf[i] = dir
+		if paths := byDir[dir]; !containsString(paths, c.importPath) {
+			byDir[dir] = append(paths, c.importPath)
+		}
+	}
+
+	conflicts := map[string][]string{}
+	for dir, paths := range byDir {
+		if len(paths) < 2 {
+			continue
+		}
+		sort.Slice(paths, func(i, j int) bool {
+			if (paths[i] == ".") != (paths[j] == ".") {
+				return paths[j] == "."
+			}
+			return paths[i] < paths[j]
+		})
+		conflicts[dir] = paths
+	}
+	if len(conflicts) == 0 {
+		return entries, conflicts
+	}
+
+	resolved := entries[:0:0]
+	for i, c := range entries {
+		if paths, ok := conflicts[dirOf[i]]; !ok || c.importPath == paths[0] {
+			resolved = append(resolved, c)
+		}
+	}
+	return resolved, conflicts
+}
+
+// physicalPaths returns a function returning the physical path of
+// a directory under the roots, with the symlinks in the paths of
+// the roots resolved. The walks don't follow the symlinks under
+// the roots, so a directory is only reached by several paths through
+// the roots', e.g., of a root under a symlinked directory.
+func physicalPaths(roots []string) func(path string) string {
+	type resolved struct{ root, real string }
+	links := []resolved{}
+	for _, root := range roots {
+		if real, err := filepath.EvalSymlinks(root); err == nil && real != root {
+			links = append(links, resolved{root, real})
+		}
+	}
+
+	return func(path string) string {
+		for _, l := range links {
+			if underRoot(path, l.root) {
+				return l.real + path[len(l.root):]
+			}
+		}
+		return path
+	}
+}
+
+// containsString reports whether s is in the list.
+func containsString(list []string, s string) bool {
+	for _, t := range list {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
+
+// rooted is an index entry with the position of its root directory.
+type rooted struct {
+	root int
+	details
+}
+
+// walkOrder returns the entries in the order of filepath.Walk:
+// by root directory, and then lexically, parents before their children.
+func walkOrder(entries []rooted) []details {
+	sorted := append([]rooted(nil), entries...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].root != sorted[j].root {
+			return sorted[i].root < sorted[j].root
+		}
+		return pathLess(sorted[i].fullPath, sorted[j].fullPath)
+	})
+
+	index := make([]details, len(sorted))
+	for i, c := range sorted {
+		index[i] = c.details
+	}
+	return index
+}
+
+// pathLess reports whether the path a comes before b when their elements
+// are compared lexically, one by one, i.e. as if the path separator
+// sorted before all other characters.
+func pathLess(a, b string) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		switch {
+		case a[i] == b[i]:
+		case os.IsPathSeparator(a[i]):
+			return true
+		case os.IsPathSeparator(b[i]):
+			return false
+		default:
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
+
+// snapshot returns a copy of the configuration of indexing, and of the
+// symbols to reuse, to walk the trees with. Roots and Exclusions replace
+// the slices rather than modify them, and the symbols map is replaced after
+// indexing, so they can be shared. The caller must hold the lock.
+func (dirs *index) snapshot() *index {
+	return &index{
+		rootDirs:       dirs.rootDirs,
+		listedDirs:     dirs.listedDirs,
+		exclusions:     dirs.exclusions,
+		excludeRegexps: dirs.excludeRegexps,
+		includeHidden:  dirs.includeHidden,
+		maxDirEntries:  dirs.maxDirEntries,
+		indexSymbols:   dirs.indexSymbols,
+		symbols:        dirs.symbols,
+		builtTimes:     dirs.builtTimes,
+		indexWorkers:   dirs.indexWorkers,
+	}
+}
+
+// rootOf returns the position of the root directory the directory at path
+// lies under, or the number of roots if it lies under none of them.
+func (dirs *index) rootOf(path string) int {
+	for i, root := range dirs.rootDirs {
+		if underRoot(path, root) {
+			return i
+		}
+	}
+	return len(dirs.rootDirs)
+}
+
+// listedRoot returns the root directory at the position i, or, for
+// a listed directory under none of them, the directory itself.
+func (dirs *index) listedRoot(i int, path string) string {
+	if i < len(dirs.rootDirs) {
+		return dirs.rootDirs[i]
+	}
+	return path
+}
+
+// underRoot reports whether path is the root directory or lies under it.
+func underRoot(path, root string) bool {
+	return path == root ||
+		strings.HasPrefix(path, root) && os.IsPathSeparator(path[len(root)])
+}
+
+// isStdlib reports whether the directory at path holds a standard
+// library package, i.e. lies under GOROOT/src.
+func isStdlib(path, goroot string) bool {
+	return goroot != "" && underRoot(path, filepath.Join(goroot, "src"))
+}
+
+// skipDir reports whether the directory at path under root
+// is excluded from indexing.
+func (dirs *index) skipDir(root, path string) bool {
+	// Skip directories in the exclusion list.
+	if dirs.skippingRule(root, path) >= 0 {
+		return true
+	}
+	if dirs.excludedRegexp(path) {
+		return true
+	}
+
+	// Skip hidden directories, but not hidden roots.
+	return !dirs.includeHidden && strings.HasPrefix(filepath.Base(path), ".") && path != root
+}
+
+// skippingRule returns the index of the exclusion rule excluding
+// the directory at path under root, or -1 if none does.
+func (dirs *index) skippingRule(root, path string) int {
+	rel, _ := filepath.Rel(root, path)
+	return dirs.excludingRule(filepath.ToSlash(rel), filepath.Base(path))
+}
+
+// keepingRule returns the index of the negated exclusion rule
+// re-including the directory at path under root, or -1 if none does.
+func (dirs *index) keepingRule(root, path string) int {
+	rel, _ := filepath.Rel(root, path)
+	return dirs.reincludingRule(filepath.ToSlash(rel), filepath.Base(path))
+}
+
+// DryRun walks the directory trees like Index, but instead of indexing
+// the directories, writes what would be done with each of them: whether
+// it would be indexed, skipped because of the exclusions, or skipped as
+// containing no Go package (though still indexed as leading to packages).
+// With directories listed, only looks at those, as Index does.
+func (dirs *index) DryRun(w io.Writer) {
+	dirs.mu.RLock()
+	defer dirs.mu.RUnlock()
+
+	if dirs.listedDirs != nil {
+		for _, path := range dirs.listedDirs {
+			info, err := os.Stat(path)
+			switch {
+			case err != nil:
+				fmt.Fprintf(w, "unreadable\t%s\t%v\n", path, err)
+			case !info.IsDir():
+				fmt.Fprintf(w, "unreadable\t%s\tnot a directory\n", path)
+			default:
+				dirs.dryRunDir(w, dirs.listedRoot(dirs.rootOf(path), path), path)
+			}
+		}
+		return
+	}
+
+	for _, root := range dirs.rootDirs {
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				fmt.Fprintf(w, "unreadable\t%s\t%v\n", path, err)
+				return skipOnError(info)
+			}
+			if info == nil || !info.IsDir() {
+				return nil
+			}
+
+			if !dirs.dryRunDir(w, root, path) {
+				return filepath.SkipDir
+			}
+
+			if dirs.maxDirEntries > 0 {
+				if entries, err := os.ReadDir(path); err == nil && dirs.crowded(entries) {
+					fmt.Fprintf(w, "skipped-crowded\t%s\t%d entries\n", path, len(entries))
+					return filepath.SkipDir
+				}
+			}
+
+			return nil
+		})
+	}
+}
+
+// dryRunDir writes what Index would do with the directory at path
+// under root. It reports false if the directory would be excluded.
+func (dirs *index) dryRunDir(w io.Writer, root, path string) bool {
+	if dirs.skipDir(root, path) {
+		fmt.Fprintf(w, "skipped-excluded\t%s\n", path)
+		return false
+	}
+
+	p, err := importPackage(path)
+	switch err.(type) {
+	case nil:
+		if dirs.excludedImport(p.ImportPath) {
+			fmt.Fprintf(w, "skipped-excluded-import\t%s\t%s\n", path, p.ImportPath)
+		} else {
+			fmt.Fprintf(w, "indexed\t%s\n", path)
+		}
+	case *build.NoGoError:
+		fmt.Fprintf(w, "skipped-no-go\t%s\n", path)
+	default:
+		fmt.Fprintf(w, "invalid\t%s\t%v\n", path, err)
+	}
+	return true
+}
+
+// crowded reports whether the directory with the entries has more of them
+// than the configured maximum, and none of them are Go files, so that its
+// contents aren't worth walking (e.g., a dump of media files).
+func (dirs *index) crowded(entries []fs.DirEntry) bool {
+	if dirs.maxDirEntries <= 0 || len(entries) <= dirs.maxDirEntries {
+		return false
+	}
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".go") {
+			return false
+		}
+	}
+	return true
+}
+
+// skipOnError returns the result of a filepath.WalkFunc for an error
+// walking the file or directory described by info, if known: the walk
+// skips the directories that can't be read (e.g., due to permissions),
+// and goes on past the files that can't.
+func skipOnError(info os.FileInfo) error {
+	if info != nil && info.IsDir() {
+		return filepath.SkipDir
+	}
+	return nil
+}
+
+// interner deduplicates strings, so that equal strings share storage.
+type interner map[string]string
+
+func (in interner) intern(s string) string {
+	if t, ok := in[s]; ok {
+		return t
+	}
+	in[s] = s
+	return s
+}
+
+// importPath returns the import path of the package in dir. In GOPATH
+// layouts, the directory path ends with the import path, so the import path
+// shares its storage; otherwise, it's interned.
+func (in interner) importPath(dir, importPath string) string {
+	if os.PathSeparator == '/' && importPath != "." &&
+		strings.HasSuffix(dir, "/"+importPath) {
+		return dir[len(dir)-len(importPath):]
+	}
+	return in.intern(importPath)
+}
+
+// UpdateIndex updates packages' index at the interval d,
+// unless the index is frozen.
+func (dirs *index) UpdateIndex(d time.Duration) {
+	if dirs.frozen {
+		return
+	}
+	for range time.Tick(d) {
+		dirs.IndexIfChanged()
+	}
+}
+
+// IndexIfChanged reindexes the directory trees unless, judging by
+// the directories' modification times, they haven't changed since
+// the last run. It reports whether it has reindexed.
+func (dirs *index) IndexIfChanged() bool {
+	// Walk the trees without holding up the queries.
+	dirs.mu.RLock()
+	cfg, indexed, last := dirs.snapshot(), dirs.index != nil, dirs.stamp
+	dirs.mu.RUnlock()
+
+	if indexed && cfg.treeStamp().equal(last) {
+		log.Printf("Reindexing skipped: no changes")
+		return false
+	}
+	dirs.Index()
+	return true
+}
+
+// treeStamp walks the directory trees like Index, but only looks at
+// the directories' modification times. It's called on a snapshot of
+// the index.
+func (dirs *index) treeStamp() (stamp treeStamp) {
+	dirs.stampArtifacts(&stamp)
+
+	var walk func(root, path string, info fs.FileInfo)
+	walk = func(root, path string, info fs.FileInfo) {
+		if dirs.skipDir(root, path) {
+			return
+		}
+		stamp.add(info)
+
+		entries, err := os.ReadDir(path)
+		if err != nil || dirs.crowded(entries) {
+			return
+		}
+		for _, e := range entries {
+			if !e.IsDir() {
+				continue
+			}
+			if info, err := e.Info(); err == nil {
+				walk(root, filepath.Join(path, e.Name()), info)
+			}
+		}
+	}
+
+	if dirs.listedDirs != nil {
+		for _, path := range dirs.listedDirs {
+			info, err := os.Stat(path)
+			if err == nil && info.IsDir() && !dirs.skipDir(dirs.listedRoot(dirs.rootOf(path), path), path) {
+				stamp.add(info)
+			}
+		}
+		return
+	}
+	for _, root := range dirs.rootDirs {
+		if info, err := os.Lstat(root); err == nil && info.IsDir() {
+			walk(root, root, info)
+		}
+	}
+	return
+}
+
+// Exclusions loads a list of directory names to exclude from indexing.
+// Names containing slashes are paths relative to the roots. Names prefixed
+// with ‘!’ re-include the directories excluded by the preceding names, and
+// names prefixed with “depth:N:” only match at the depth N below the roots.
+// Names prefixed with “import:” match the import paths of the packages
+// found, dropping them from the index after the directories are read.
+// Names may contain the wildcards of filepath.Match; the patterns are
+// compiled once here rather than for every directory walked.
+func (dirs *index) Exclusions(r io.Reader) error {
+	exclusions, err := parseExclusions(r)
+	if err != nil {
+		return err
+	}
+
+	dirs.mu.Lock()
+	dirs.exclusions = exclusions
+	dirs.mu.Unlock()
+	return nil
+}
+
+// parseExclusions reads the exclusions listed for Exclusions.
+func parseExclusions(r io.Reader) ([]exclusion, error) {
+	exclusions := []exclusion{}
+	s := bufio.NewScanner(r)
+	s.Split(bufio.ScanWords)
+
+	for s.Scan() {
+		e, err := newExclusion(s.Text())
+		if err != nil {
+			return nil, err
+		}
+		exclusions = append(exclusions, e)
+	}
+	return exclusions, s.Err()
+}
+
+// ListDirs loads a list of directories, one per line, to index each
+// by itself, without walking the trees under them, e.g., the packages
+// of a build. Empty lines and lines beginning with ‘#’ are skipped,
+// and relative paths are relative to the working directory.
+func (dirs *index) ListDirs(r io.Reader) error {
+	listed := []string{}
+	s := bufio.NewScanner(r)
+
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		path, err := filepath.Abs(line)
+		if err != nil {
+			return err
+		}
+		listed = append(listed, path)
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	dirs.mu.Lock()
+	dirs.listedDirs = listed
+	dirs.mu.Unlock()
+	return nil
+}
+
+// QueryTokens loads a list of bearer tokens the queries require, one per
+// line, each followed by the directories, separated by spaces, whose
+// results the queries with the token get, e.g., the roots of a tenant.
+// Empty lines and lines beginning with ‘#’ are skipped.
+func (dirs *index) QueryTokens(r io.Reader) error {
+	tokens := map[string][]string{}
+	s := bufio.NewScanner(r)
+
+	for line := 1; s.Scan(); line++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if _, ok := tokens[fields[0]]; ok {
+			return fmt.Errorf("line %d: duplicate token", line)
+		}
+
+		roots := []string{}
+		for _, root := range fields[1:] {
+			abs, err := filepath.Abs(root)
+			if err != nil {
+				return fmt.Errorf("line %d: %v", line, err)
+			}
+			roots = append(roots, abs)
+		}
+		tokens[fields[0]] = roots
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	dirs.mu.Lock()
+	dirs.queryTokens = tokens
+	dirs.mu.Unlock()
+	return nil
+}
+
+// ExclusionRegexps loads a list of regular expressions, one per line,
+// matching the directories to exclude from indexing. The expressions
+// are matched against the slash separated absolute directory paths
+// with a trailing slash, e.g., “/home/peter/go/src/x/v2/internal/”.
+func (dirs *index) ExclusionRegexps(r io.Reader) error {
+	dirs.mu.Lock()
+	defer dirs.mu.Unlock()
+
+	dirs.excludeRegexps = []*regexp.Regexp{}
+	s := bufio.NewScanner(r)
+
+	for line := 1; s.Scan(); line++ {
+		expr := strings.TrimSpace(s.Text())
+		if expr == "" {
+			continue
+		}
+
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		dirs.excludeRegexps = append(dirs.excludeRegexps, re)
+	}
+	return s.Err()
+}
+
+// result is a path matching a query.
+type result struct {
+	Path    string   `json:"path"`
+	Score   float64  `json:"score,omitempty"`   // Relevance in the ranked modes.
+	Offsets [][2]int `json:"offsets,omitempty"` // Byte offsets of the matched characters in Path.
+	Stdlib  bool     `json:"stdlib,omitempty"`  // Whether it's a standard library path.
+	Command bool     `json:"command,omitempty"` // Whether it's the path of a main package.
+
+	// TestOnly is set for the packages with only _test.go files.
+	TestOnly bool `json:"testOnly,omitempty"`
+
+	// Valid is whether there is a package in the directory, and MTime
+	// its modification time as RFC 3339, e.g., for a file picker.
+	Valid bool   `json:"valid"`
+	MTime string `json:"mtime,omitempty"`
+
+	// GoVersion is the latest Go version required by the build
+	// constraints of the package's files, e.g., "go1.21".
+	GoVersion string `json:"goVersion,omitempty"`
+
+	// Built is when the package was last installed, as RFC 3339,
+	// if it's looked up (see builtTime).
+	Built string `json:"built,omitempty"`
+
+	entry details // The index entry, for the CSV output.
+}
+
+// newResult returns the result of the path of the index entry, e.g.,
+// its import path or directory, with the facts about its package,
+// so that all the routes describe the packages alike.
+func newResult(c details, path string) result {
+	return result{
+		Path:      path,
+		Stdlib:    isStdlib(c.fullPath, build.Default.GOROOT),
+		Command:   c.isCommand(),
+		TestOnly:  c.testOnly,
+		GoVersion: c.goVersion,
+		Valid:     c.valid,
+		MTime:     mtime(c.modTime),
+		Built:     mtime(c.builtTime),
+		entry:     c,
+	}
+}
+
+// mtime formats the modification time for the results, or returns ""
+// if it's unknown, e.g., of a loaded index.
+func mtime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
 }
 
-type details struct {
-	fullPath   string
-	importPath string
-	valid      bool
+// Ready reports whether the index has been built.
+func (dirs *index) Ready() bool {
+	dirs.mu.RLock()
+	defer dirs.mu.RUnlock()
+
+	return dirs.index != nil
 }
 
-type queryKind uint
+// Len returns the number of indexed directories.
+func (dirs *index) Len() int {
+	dirs.mu.RLock()
+	defer dirs.mu.RUnlock()
 
-const (
-	kindImports queryKind = iota + 1
-	kindDirs
-)
+	return len(dirs.index)
+}
 
-// Index walks the directory trees and creates an index with path information.
-func (dirs *index) Index() {
-	dirs.mu.Lock()
-	defer dirs.mu.Unlock()
+// readyc returns a channel closed when the index is built.
+func (dirs *index) readyc() chan struct{} {
+	dirs.readyOnce.Do(func() { dirs.ready = make(chan struct{}) })
+	return dirs.ready
+}
 
-	dirs.index = []details{}
+// WaitReady waits for the index to be built, until ctx is done.
+func (dirs *index) WaitReady(ctx context.Context) error {
+	if dirs.Ready() {
+		return nil
+	}
 
-	for _, root := range dirs.rootDirs {
-		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-			if !info.IsDir() {
-				return nil
+	select {
+	case <-dirs.readyc():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// QueryIndex returns a list of absolute directory paths or
+// full import paths matching a partial path query, the import paths of
+// the packages exporting the symbol named by the query, or the Go files
+// of the package with the import path. In the ranked modes,
+// better matches come first. If ctx is done before the scan completes,
+// the paths matched so far are returned along with the context's error.
+func (dirs *index) QueryIndex(ctx context.Context, query string, kind queryKind, mode queryMode) (out []result, err error) {
+	return dirs.queryIndex(ctx, query, kind, mode, false, foldNone, nil)
+}
+
+// queryIndex queries the index like QueryIndex. If unversioned is set,
+// the suffix queries also match the paths ending with a major
+// version element, e.g., “/v3”, as if it were left out, so that “x/y”
+// matches “x/y/v3”. The parts of the query and the paths selected by
+// folding are matched case-insensitively. If permitted isn't nil, only
+// the directories under the permitted ones are matched, so that
+// the invalid paths under them are returned if none of them is valid,
+// whatever the other directories match.
+func (dirs *index) queryIndex(ctx context.Context, query string, kind queryKind, mode queryMode, unversioned bool, folding caseFolding, permitted []string) (out []result, err error) {
+	// The files are listed without holding up the indexing.
+	if kind == kindFiles {
+		out, err = dirs.queryFiles(ctx, query)
+		return filterPermitted(out, permitted), err
+	}
+
+	dirs.mu.RLock()
+	defer dirs.mu.RUnlock()
+
+	if kind == kindSymbols {
+		out, err = dirs.querySymbols(ctx, query)
+		return filterPermitted(out, permitted), err
+	}
+
+	sep := "/"
+	if kind == kindDirs {
+		sep = string(os.PathSeparator)
+	}
+
+	// Accept both slashes and backslashes, whatever the client's
+	// platform, as the separators of the indexed paths.
+	query = strings.NewReplacer("/", sep, `\`, sep).Replace(query)
+	if kind == kindDirs {
+		query = trimLongPathPrefix(query)
+	}
+	m := newMatcher(mode, folding.fold(matchKey(query, kind), sep), sep)
+	goroot := build.Default.GOROOT
+
+	// Prefix queries match the paths with major versions anyway.
+	unversioned = unversioned && mode == modeSuffix
+
+	// The standard library paths, all lowercase, may be matched
+	// by the lowercase query.
+	var folded matcher
+	if dirs.foldStdlib {
+		folded = newMatcher(mode, strings.ToLower(matchKey(query, kind)), sep)
+	}
+
+	// Valid paths are the paths with packages.
+	// Invalid paths are subdirectories leading to valid paths.
+	scan := func(entries []details) (valid, invalid []result, err error) {
+		valid, invalid = []result{}, []result{}
+		for i, c := range entries {
+			if i%cancelCheckInterval == 0 {
+				if err = ctx.Err(); err != nil {
+					break
+				}
 			}
 
-			// Skip directories in the exclusion list.
-			dir := filepath.Base(path)
-			if _, ok := dirs.exclusions[dir]; ok {
-				return filepath.SkipDir
+			if !permits(permitted, c.fullPath) {
+				continue
+			}
+			path := c.importPath
+			if kind == kindDirs {
+				path = c.fullPath
+			}
+
+			score, ok := m.match(anchor(folding.fold(matchKey(path, kind), sep), sep))
+			if !ok && unversioned {
+				score, ok = m.match(anchor(folding.fold(matchKey(trimMajorVersion(path, sep), kind), sep), sep))
+			}
+			stdlib := isStdlib(c.fullPath, goroot)
+			if !ok && folded != nil && stdlib {
+				score, ok = folded.match(anchor(strings.ToLower(matchKey(path, kind)), sep))
+			}
+			if !ok {
+				continue
 			}
 
-			p, err := build.Default.ImportDir(path, 0)
-			dirs.index = append(dirs.index, details{
-				fullPath:   path,
-				importPath: p.ImportPath,
-				valid:      err == nil,
-			})
+			res := newResult(c, path)
+			res.Score = score
+			if c.valid {
+				valid = append(valid, res)
+			} else {
+				invalid = append(invalid, res)
+			}
+		}
+		return
+	}
 
-			return nil
+	var valid, invalid []result
+	if n := runtime.GOMAXPROCS(0); n > 1 && dirs.parallelThreshold > 0 && len(dirs.index) > dirs.parallelThreshold {
+		valid, invalid, err = scanPartitions(dirs.index, n, scan)
+	} else {
+		valid, invalid, err = scan(dirs.index)
+	}
+
+	// Return invalid paths if there are no valid ones.
+	out = valid
+	if len(valid) == 0 {
+		out = invalid
+	}
+	if kind == kindImports && dirs.canonicalImports {
+		out = canonical(out, dirs.rootDirs)
+	}
+
+	switch {
+	case mode.ranked():
+		// Equal scores are ordered by path length and then lexically,
+		// so that the order doesn't depend on the order of indexing.
+		sort.Slice(out, func(i, j int) bool {
+			a, b := out[i], out[j]
+			if a.Score != b.Score {
+				return a.Score > b.Score
+			}
+			if len(a.Path) != len(b.Path) {
+				return len(a.Path) < len(b.Path)
+			}
+			return a.Path < b.Path
 		})
+	case mode == modeSuffix, mode == modeComplete, mode == modeUnanchored, mode == modeGlob:
+		// All paths end with the query (but for the rest of the last
+		// segment, completing it), so the exact match, if any, is the
+		// shortest, and the shorter paths are the closer ones.
+		sort.SliceStable(out, func(i, j int) bool {
+			return len(out[i].Path) < len(out[j].Path)
+		})
+	}
+
+	for i := range out {
+		// The matched part of a path matched without its major version
+		// is the same as of the path without it, and of a path matched
+		// case-insensitively, the same as of the lowercase path.
+		path, pm := folding.fold(out[i].Path, sep), m
+		if len(path) != len(out[i].Path) {
+			// Lowercasing changed the byte offsets.
+			continue
+		}
+		if _, ok := m.match(anchor(matchKey(path, kind), sep)); !ok {
+			switch {
+			case folded != nil && out[i].Stdlib:
+				path, pm = strings.ToLower(path), folded
+			case unversioned:
+				path = trimMajorVersion(path, sep)
+			}
+		}
+		out[i].Offsets = offsets(pm, path, kind, sep)
 	}
-	log.Printf("Indexed %d directories", len(dirs.index))
+	return
 }
 
-// UpdateIndex updates packages' index at regular intervals.
-func (dirs *index) UpdateIndex() {
-	for {
-		select {
-		case <-time.Tick(45 * time.Minute):
-			dirs.Index()
+// canonical returns the results leaving out the ones whose import paths,
+// without the vendor directories they are under, are also provided by
+// a preferred directory, one in the standard library, or else under
+// an earlier root, or else unvendored, as Go resolves the import paths,
+// e.g., a copy of a standard library package in a GOPATH, or one
+// vendored as “x/vendor/net/http”.
+func canonical(results []result, roots []string) []result {
+	rank := func(res result) int {
+		r := 2 * (len(roots) + 1)
+		if res.Stdlib {
+			r = 0
+		} else {
+			for i, root := range roots {
+				if underRoot(res.entry.fullPath, root) {
+					r = 2 * (i + 1)
+					break
+				}
+			}
+		}
+		if unvendored(res.Path) != res.Path {
+			r++
+		}
+		return r
+	}
+
+	best := map[string]int{}
+	for i, res := range results {
+		// Directories outside GOPATH don't have import paths.
+		if res.Path == "." {
+			continue
+		}
+		path := unvendored(res.Path)
+		if j, ok := best[path]; !ok || rank(res) < rank(results[j]) {
+			best[path] = i
+		}
+	}
+
+	out := []result{}
+	for i, res := range results {
+		if j, ok := best[unvendored(res.Path)]; !ok || i == j {
+			out = append(out, res)
 		}
 	}
+	return out
 }
 
-// Exclusions loads a list of directory names to exclude from indexing.
-func (dirs *index) Exclusions(r io.Reader) {
-	dirs.mu.Lock()
-	defer dirs.mu.Unlock()
+// unvendored returns the import path without the vendor directory it is
+// under, if any, e.g., “net/http” for “x/vendor/net/http”.
+func unvendored(importPath string) string {
+	if i := strings.LastIndex(importPath, "/vendor/"); i >= 0 {
+		return importPath[i+len("/vendor/"):]
+	}
+	return strings.TrimPrefix(importPath, "vendor/")
+}
 
-	dirs.exclusions = make(map[string]struct{})
-	s := bufio.NewScanner(r)
-	s.Split(bufio.ScanWords)
+// scanPartitions scans n partitions of the entries in parallel, and
+// concatenates their results in the order of the entries, so that they
+// are the same as of scanning the entries at once.
+func scanPartitions(entries []details, n int, scan func([]details) (valid, invalid []result, err error)) (valid, invalid []result, err error) {
+	type partition struct {
+		valid, invalid []result
+		err            error
+	}
+	parts := make([]partition, n)
+	size := (len(entries) + n - 1) / n
 
-	for s.Scan() {
-		dirs.exclusions[s.Text()] = struct{}{}
+	var wg sync.WaitGroup
+	for i := range parts {
+		start, end := i*size, (i+1)*size
+		if end > len(entries) {
+			end = len(entries)
+		}
+		if start >= end {
+			break
+		}
+		wg.Add(1)
+		go func(p *partition, entries []details) {
+			defer wg.Done()
+			p.valid, p.invalid, p.err = scan(entries)
+		}(&parts[i], entries[start:end])
+	}
+	wg.Wait()
+
+	valid, invalid = []result{}, []result{}
+	for _, p := range parts {
+		valid = append(valid, p.valid...)
+		invalid = append(invalid, p.invalid...)
+		if err == nil {
+			err = p.err
+		}
 	}
+	return
 }
 
-// QueryIndex returns a list of absolute directory paths or
-// full import paths matching a partial path query.
-func (dirs *index) QueryIndex(query string, kind queryKind) (out []string) {
-	dirs.mu.RLock()
-	defer dirs.mu.RUnlock()
+// trimMajorVersion returns the path without its last element if it's
+// a major version suffix of a module path, i.e. “v2” or a later version,
+// as in “github.com/x/y/v3”; otherwise, the path is returned unchanged.
+func trimMajorVersion(path, sep string) string {
+	i := strings.LastIndex(path, sep)
+	if i < 0 {
+		return path
+	}
 
-	sep := string(os.PathSeparator)
+	v := path[i+len(sep):]
+	if len(v) < 2 || v[0] != 'v' || v[1] == '0' || v == "v1" {
+		return path
+	}
+	for _, c := range v[1:] {
+		if c < '0' || c > '9' {
+			return path
+		}
+	}
+	return path[:i]
+}
 
-	// Match full names. (e.g., if typed "os", match a package or dir
-	// named "os", but not "paxos".)
-	switch kind {
-	case kindDirs:
-		// Reverse the slashes in Windows.
-		query = strings.Join(strings.Split(query, "/"), sep)
+// queryFiles returns the names of the Go files, tests included, of the
+// package with exactly the given import path. If several directories
+// provide the import path, the first one indexed is used, as the go tool
+// would. The packages are imported without holding dirs.mu, and the ones
+// that can't be anymore, e.g., of removed directories, are skipped.
+func (dirs *index) queryFiles(ctx context.Context, importPath string) (out []result, err error) {
+	out = []result{}
 
-		query = sep + query
-	case kindImports:
-		query = "/" + query
+	// Packages outside GOPATH have no import path but ".".
+	if importPath == "." {
+		return
 	}
 
-	// Valid paths are the paths with packages.
-	// Invalid paths are subdirectories leading to valid paths.
-	valid, invalid := []string{}, []string{}
-	for _, c := range dirs.index {
-		var path string
+	dirs.mu.RLock()
+	candidates := []details{}
+	for i, c := range dirs.index {
+		if i%cancelCheckInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				break
+			}
+		}
+		if c.valid && c.importPath == importPath {
+			candidates = append(candidates, c)
+		}
+	}
+	dirs.mu.RUnlock()
+	if err != nil {
+		return
+	}
 
-		switch kind {
-		case kindImports:
-			if strings.HasSuffix("/"+c.importPath, query) {
-				path = c.importPath
+	for _, c := range candidates {
+		p, err := importPackage(c.fullPath)
+		if err != nil {
+			continue
+		}
+		for _, names := range [][]string{p.GoFiles, p.TestGoFiles, p.XTestGoFiles} {
+			for _, name := range names {
+				out = append(out, newResult(c, name))
 			}
-		case kindDirs:
-			if strings.HasSuffix(c.fullPath, query) {
-				path = c.fullPath
+		}
+		break
+	}
+	return
+}
+
+// offsets returns the byte offsets of the query characters matched by m
+// in path. If the form of the path used for matching isn't byte-for-byte
+// the same length as the path (e.g., because of Unicode normalization),
+// there are no offsets.
+func offsets(m matcher, path string, kind queryKind, sep string) [][2]int {
+	key := strings.TrimLeft(matchKey(path, kind), sep)
+	raw := strings.TrimLeft(trimLongPathPrefix(path), sep)
+	if len(key) != len(raw) {
+		return nil
+	}
+
+	// Match offsets are shifted by the added leading separator
+	// and the trimmed path prefix.
+	shift := len(path) - len(raw) - 1
+	spans := m.spans(sep + key)
+	for i := range spans {
+		spans[i][0] += shift
+		spans[i][1] += shift
+	}
+	return spans
+}
+
+// matchKey returns the form of an import or directory path
+// that is used for matching.
+func matchKey(path string, kind queryKind) string {
+	path = normalize(path)
+	if kind == kindDirs {
+		path = trimLongPathPrefix(path)
+
+		// NTFS is case-insensitive.
+		if runtime.GOOS == "windows" {
+			path = strings.ToLower(path)
+		}
+	}
+	return path
+}
 
+// Resolve returns the index entry of the package in the directory
+// at path, which is either absolute or relative to one of the roots.
+// The leading slash of absolute paths may be missing, as in URL paths.
+func (dirs *index) Resolve(path string) (c details, ok bool) {
+	dirs.mu.RLock()
+	defer dirs.mu.RUnlock()
+
+	path = filepath.FromSlash(path)
+	candidates := []string{filepath.Clean(path)}
+	if !filepath.IsAbs(path) {
+		candidates = []string{filepath.Clean(string(filepath.Separator) + path)}
+		for _, root := range dirs.rootDirs {
+			candidates = append(candidates, filepath.Join(root, path))
+		}
+	}
+
+	for _, dir := range candidates {
+		for _, c := range dirs.index {
+			if c.valid && c.fullPath == dir {
+				return c, true
 			}
 		}
+	}
+	return details{}, false
+}
 
-		if path == "" {
+// ImportDirs returns the index entries of the directories providing
+// the import path, e.g., in several roots, the ones with the package first.
+func (dirs *index) ImportDirs(importPath string) []details {
+	dirs.mu.RLock()
+	defer dirs.mu.RUnlock()
+
+	valid, invalid := []details{}, []details{}
+	for _, c := range dirs.index {
+		if c.importPath != importPath || importPath == "." {
 			continue
 		}
+		if c.valid {
+			valid = append(valid, c)
+		} else {
+			invalid = append(invalid, c)
+		}
+	}
+	return append(valid, invalid...)
+}
+
+// BaseNames returns the index entries whose directory base names,
+// or, for kindImports, the last elements of whose import paths,
+// are name or, if prefix is set, start with it, the ones containing
+// packages first.
+func (dirs *index) BaseNames(name string, kind queryKind, prefix bool) []details {
+	dirs.mu.RLock()
+	defer dirs.mu.RUnlock()
+
+	name = matchKey(name, kind)
+	valid, invalid := []details{}, []details{}
+	for _, c := range dirs.index {
+		base := filepath.Base(c.fullPath)
+		if kind == kindImports {
+			if c.importPath == "." {
+				continue
+			}
+			base = path.Base(c.importPath)
+		}
 
+		base = matchKey(base, kind)
+		if base != name && !(prefix && strings.HasPrefix(base, name)) {
+			continue
+		}
 		if c.valid {
-			valid = append(valid, path)
+			valid = append(valid, c)
 		} else {
-			invalid = append(invalid, path)
+			invalid = append(invalid, c)
 		}
 	}
+	return append(valid, invalid...)
+}
 
-	// Return invalid paths if there are no valid ones.
-	out = valid
-	if len(valid) == 0 {
-		out = invalid
+// Recent returns the n valid entries with the latest modification times,
+// the latest first.
+func (dirs *index) Recent(n int) []details {
+	dirs.mu.RLock()
+	defer dirs.mu.RUnlock()
+
+	recent := []details{}
+	for _, c := range dirs.index {
+		if c.valid {
+			recent = append(recent, c)
+		}
 	}
-	return
+	sort.SliceStable(recent, func(i, j int) bool {
+		return recent[i].modTime.After(recent[j].modTime)
+	})
+
+	if len(recent) > n {
+		recent = recent[:n]
+	}
+	return recent
+}
+
+// All returns the valid entries sorted by import path, or by directory
+// if kind is kindDirs. For import paths, only the first entry providing
+// each one is returned, and entries outside GOPATH are left out.
+func (dirs *index) All(kind queryKind) []details {
+	dirs.mu.RLock()
+	defer dirs.mu.RUnlock()
+
+	all := []details{}
+	seen := map[string]bool{}
+	for _, c := range dirs.index {
+		if !c.valid {
+			continue
+		}
+		if kind == kindImports {
+			if c.importPath == "." || seen[c.importPath] {
+				continue
+			}
+			seen[c.importPath] = true
+		}
+		all = append(all, c)
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		if kind == kindDirs {
+			return all[i].fullPath < all[j].fullPath
+		}
+		return all[i].importPath < all[j].importPath
+	})
+	return all
+}
+
+// Collisions returns the import paths provided by packages
+// in more than one directory, e.g., in several GOPATH entries.
+func (dirs *index) Collisions() map[string][]string {
+	dirs.mu.RLock()
+	defer dirs.mu.RUnlock()
+
+	byImport := map[string][]string{}
+	for _, c := range dirs.index {
+		if c.valid && c.importPath != "." {
+			byImport[c.importPath] = append(byImport[c.importPath], c.fullPath)
+		}
+	}
+
+	collisions := map[string][]string{}
+	for importPath, paths := range byImport {
+		if len(paths) > 1 {
+			collisions[importPath] = paths
+		}
+	}
+	return collisions
+}
+
+// Conflicts returns the directories indexed with more than one import
+// path, mapped to the import paths, the one the queries return first.
+func (dirs *index) Conflicts() map[string][]string {
+	dirs.mu.RLock()
+	defer dirs.mu.RUnlock()
+
+	conflicts := map[string][]string{}
+	for dir, paths := range dirs.conflicts {
+		conflicts[dir] = paths
+	}
+	return conflicts
+}
+
+// mismatch is a package whose import path doesn't end with
+// its directory name.
+type mismatch struct {
+	ImportPath string `json:"importPath"`
+	Dir        string `json:"dir"`
+}
+
+// Mismatches returns the packages whose import paths' last elements
+// differ from their directory names, which usually indicates a renamed
+// or vanity-imported package.
+func (dirs *index) Mismatches() []mismatch {
+	dirs.mu.RLock()
+	defer dirs.mu.RUnlock()
+
+	mismatches := []mismatch{}
+	for _, c := range dirs.index {
+		if !c.valid || c.importPath == "." {
+			continue
+		}
+		if path.Base(c.importPath) != filepath.Base(c.fullPath) {
+			mismatches = append(mismatches, mismatch{c.importPath, c.fullPath})
+		}
+	}
+	return mismatches
 }
 
 // Roots sets a list of directory paths where Go packages are going to be
@@ -151,7 +1805,16 @@ func (dirs *index) Roots(roots []string) error {
 	dirs.mu.Lock()
 	defer dirs.mu.Unlock()
 
-	dirs.rootDirs = []string{}
+	var err error
+	dirs.rootDirs, err = cleanRoots(roots)
+	return err
+}
+
+// cleanRoots returns the absolute paths of the root directories, without
+// duplicates, and an error if one of them isn't an existing directory,
+// along with the roots preceding it.
+func cleanRoots(roots []string) ([]string, error) {
+	rootDirs := []string{}
 
 	// Remove duplicate directories and check for existence.
 	seen := map[string]bool{}
@@ -160,18 +1823,100 @@ func (dirs *index) Roots(roots []string) error {
 
 		fi, err := os.Stat(root)
 		if err != nil {
-			return err
+			return rootDirs, err
 		}
 		if fi.IsDir() == false {
-			return os.ErrInvalid
+			return rootDirs, os.ErrInvalid
 		}
 
 		if _, ok := seen[absPath]; ok {
 			continue
 		}
 		seen[absPath] = true
-		dirs.rootDirs = append(dirs.rootDirs, absPath)
+		rootDirs = append(rootDirs, absPath)
+	}
+
+	return rootDirs, nil
+}
+
+// Reconfigure replaces both the root directories and the exclusions,
+// as Roots and Exclusions do, at once, and then reindexes, so that
+// no indexing run walks the new roots with the old exclusions or
+// the other way around. Neither is replaced if either is invalid.
+func (dirs *index) Reconfigure(roots []string, exclusions io.Reader) error {
+	rootDirs, err := cleanRoots(roots)
+	if err != nil {
+		return err
 	}
+	parsed, err := parseExclusions(exclusions)
+	if err != nil {
+		return err
+	}
+
+	dirs.mu.Lock()
+	dirs.rootDirs, dirs.exclusions = rootDirs, parsed
+	dirs.mu.Unlock()
 
+	dirs.Index()
 	return nil
 }
+
+// rootStatus is the status of a root directory reported by /roots.
+type rootStatus struct {
+	Root     string `json:"root"`
+	Exists   bool   `json:"exists"`
+	Readable bool   `json:"readable"`
+	Packages int    `json:"packages"` // Found by the last indexing run.
+}
+
+// RootsStatus returns the status of the root directories: whether they
+// exist and can be read now, and how many packages were found in them.
+func (dirs *index) RootsStatus() []rootStatus {
+	dirs.mu.RLock()
+	roots, packages := dirs.rootDirs, dirs.rootPackages
+	dirs.mu.RUnlock()
+
+	status := []rootStatus{}
+	for _, root := range roots {
+		s := rootStatus{Root: root, Packages: packages[root]}
+		if _, err := os.Stat(root); err == nil {
+			s.Exists = true
+		}
+		if f, err := os.Open(root); err == nil {
+			_, err = f.Readdirnames(1)
+			s.Readable = err == nil || err == io.EOF
+			f.Close()
+		}
+		status = append(status, s)
+	}
+	return status
+}
+
+// normalize returns s in Unicode Normalization Form C, so that decomposed
+// names (as returned by some filesystems, e.g., HFS+) match composed queries.
+// ASCII strings are returned unchanged.
+func normalize(s string) string {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return norm.NFC.String(s)
+		}
+	}
+	return s
+}
+
+// trimLongPathPrefix strips the Windows extended-length prefix (\\?\ or
+// \\?\UNC\) from path, so that matching doesn't depend on whether
+// filepath.Abs rendered the path in its long form or not.
+func trimLongPathPrefix(path string) string {
+	if os.PathSeparator != '\\' {
+		return path
+	}
+
+	switch {
+	case strings.HasPrefix(path, `\\?\UNC\`):
+		return `\\` + path[len(`\\?\UNC\`):]
+	case strings.HasPrefix(path, `\\?\`):
+		return path[len(`\\?\`):]
+	}
+	return path
+}
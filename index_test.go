@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+// syntheticIndex returns an index of n valid packages with import paths
+// like "github.com/org7/repo123/pkg".
+func syntheticIndex(n int) *index {
+	dirs := &index{}
+	for i := 0; i < n; i++ {
+		importPath := fmt.Sprintf("github.com/org%d/repo%d/pkg", i%50, i)
+		dirs.index = append(dirs.index, details{
+			fullPath:   "/go/src/" + importPath,
+			importPath: importPath,
+			valid:      true,
+		})
+	}
+	return dirs
+}
+
+var QueryBenchmarks = []struct {
+	name string
+	mode queryMode
+	high string // Matches a single package.
+	low  string // Matches most packages.
+}{
+	{"suffix", modeSuffix, "repo777/pkg", "pkg"},
+	{"prefix", modePrefix, "github.com/org27/repo777/", "github.com/"},
+	{"substring", modeSubstring, "repo777/", "repo"},
+	{"fuzzy", modeFuzzy, "o27r777p", "gorp"},
+}
+
+func BenchmarkQueryIndex(b *testing.B) {
+	for _, size := range []int{1000, 10000, 100000} {
+		dirs := syntheticIndex(size)
+
+		for _, bench := range QueryBenchmarks {
+			for _, sel := range []struct {
+				name, query string
+			}{
+				{"high", bench.high},
+				{"low", bench.low},
+			} {
+				b.Run(fmt.Sprintf("%s/%d/%s", bench.name, size, sel.name), func(b *testing.B) {
+					b.ReportAllocs()
+					for i := 0; i < b.N; i++ {
+						dirs.QueryIndex(context.Background(), sel.query, kindImports, bench.mode)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestParallelQueryIndex(t *testing.T) {
+	// Partition the index even on a single CPU.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	serial := syntheticIndex(10000)
+	for i := 0; i < len(serial.index); i += 7 {
+		serial.index[i].valid = false
+	}
+	parallel := &index{index: serial.index, parallelThreshold: 1}
+
+	for _, bench := range QueryBenchmarks {
+		for _, query := range []string{bench.high, bench.low, "none"} {
+			want, err := serial.QueryIndex(context.Background(), query, kindImports, bench.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := parallel.QueryIndex(context.Background(), query, kindImports, bench.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s %q: parallel scan results differ from the serial ones", bench.name, query)
+			}
+		}
+	}
+}
+
+func BenchmarkParallelQueryIndex(b *testing.B) {
+	for _, size := range []int{100000, 500000} {
+		entries := syntheticIndex(size).index
+
+		for _, bench := range QueryBenchmarks {
+			for _, sel := range []struct {
+				name, query string
+			}{
+				{"high", bench.high},
+				{"low", bench.low},
+			} {
+				for _, scan := range []struct {
+					name      string
+					threshold int
+				}{
+					{"serial", 0},
+					{"parallel", 1},
+				} {
+					dirs := &index{index: entries, parallelThreshold: scan.threshold}
+					b.Run(fmt.Sprintf("%s/%d/%s/%s", bench.name, size, sel.name, scan.name), func(b *testing.B) {
+						b.ReportAllocs()
+						for i := 0; i < b.N; i++ {
+							dirs.QueryIndex(context.Background(), sel.query, kindImports, bench.mode)
+						}
+					})
+				}
+			}
+		}
+	}
+}
+
+// storageSize returns the number of bytes backing the strings,
+// counting shared storage once.
+func storageSize(strs ...[]string) int {
+	seen := map[uintptr]bool{}
+	for _, ss := range strs {
+		for _, s := range ss {
+			p := uintptr(unsafe.Pointer(unsafe.StringData(s)))
+			for i := 0; i < len(s); i++ {
+				seen[p+uintptr(i)] = true
+			}
+		}
+	}
+	return len(seen)
+}
+
+func TestInternImportPaths(t *testing.T) {
+	if os.PathSeparator != '/' {
+		t.Skip("import paths don't share storage with directory paths")
+	}
+
+	dirs, plain, interned := []string{}, []string{}, []string{}
+	pool := interner{}
+	for i := 0; i < 10000; i++ {
+		dir := fmt.Sprintf("/go/src/github.com/org/repo%d/internal/pkg", i)
+		importPath := fmt.Sprintf("github.com/org/repo%d/internal/pkg", i)
+		dirs = append(dirs, dir)
+		plain = append(plain, importPath)
+		interned = append(interned, pool.importPath(dir, importPath))
+	}
+
+	if !reflect.DeepEqual(interned, plain) {
+		t.Fatalf("interned import paths differ from the originals")
+	}
+
+	before, after := storageSize(dirs, plain), storageSize(dirs, interned)
+	t.Logf("index strings: %d bytes, %d bytes interned", before, after)
+	if after*10 > before*6 {
+		t.Errorf("interning saved %d of %d bytes, want at least 40%%", before-after, before)
+	}
+}
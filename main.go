@@ -2,53 +2,405 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"go/build"
+	"io"
+	"io/ioutil"
 	"log"
-	"net/http"
+	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 )
 
 var (
-	httpFlag = flag.String("http", ":6118", "HTTP service address, e.g. 'localhost:6118'")
-	exclFlag = flag.String("exclude", "", "List of directories to exclude from indexing")
-	rootFlag = flag.String("root", "", "List of root directories containing go packages")
+	httpFlag      = flag.String("http", ":6118", "Comma separated HTTP service addresses, e.g. 'localhost:6118,unix:/tmp/gopaths.sock'")
+	exclFlag      = flag.String("exclude", "", "List of directories to exclude from indexing")
+	exclRegexFlag = flag.String("exclude-regex", "", "List of regular expressions matching directories to exclude from indexing")
+	rootFlag      = flag.String("root", "", "List of root directories containing go packages")
+	gorootFlag    = flag.Bool("include-goroot", true, "Index the standard library in GOROOT unless -root is given")
 
-	defaultExclusions = `.git .hg`
+	noDefaultExclFlag = flag.Bool("no-default-exclude", false, "Don't exclude the version control directories ("+defaultExclusions+") by default")
+	strictFlag        = flag.Bool("strict", false, "Fail on an -exclude file without exclusions instead of warning")
+
+	hiddenFlag       = flag.Bool("include-hidden", false, "Index directories whose names begin with a dot")
+	foldStdlibFlag   = flag.Bool("fold-stdlib", false, "Match the standard library paths case-insensitively")
+	maxEntriesFlag   = flag.Int("max-dir-entries", 0, "Don't descend into the directories without Go files having more entries; 0 means no limit")
+	canonicalFlag    = flag.Bool("canonical-imports", false, "Return only the directory Go resolves an import path provided by several directories, vendored copies included, to")
+	strictValidFlag  = flag.Bool("strict-valid", false, "Never return paths without packages, even if no package matches")
+	workersFlag      = flag.Int("index-workers", 0, "Number of goroutines importing packages while indexing; 0 means one per CPU")
+	parallelFlag     = flag.Int("parallel-threshold", 0, "Scan indexes of more directories in parallel; 0 means serial scans")
+	queryTimeoutFlag = flag.Duration("query-timeout", 5*time.Second, "Maximum duration of a query; 0 means no limit")
+	cacheSizeFlag    = flag.Int("cache-size", 1000, "Number of query results to cache; 0 disables caching")
+	waitReadyFlag    = flag.Duration("wait-ready", 0, "Start serving before the index is built; queries wait for it this long")
+	deadlineFlag     = flag.Duration("index-deadline", 0, "Start serving with the directories indexed by this deadline, and index the rest in the background")
+	dirsFlag         = flag.String("dirs", "", "File listing the directories to index, one per line, instead of walking the roots")
+	loadFlag         = flag.String("load", "", "Serve the index saved in a CSV file, e.g. from /all/dirs, without indexing or updating it")
+	dryRunFlag       = flag.Bool("dry-run", false, "Print the directories that would be indexed or skipped, and exit")
+	allowUpdateFlag  = flag.Bool("allow-update", true, "Allow clients to update the index with /update")
+	freezeFlag       = flag.Bool("freeze", false, "Never update the index once built, periodically or with /update")
+	updateTokenFlag  = flag.String("update-token", "", "Bearer token required by /update and /all")
+	queryTokensFlag  = flag.String("query-tokens", "", "File of bearer tokens the queries require, each followed by the directories it may query")
+	symbolsFlag      = flag.Bool("symbols", false, "Index the exported symbols of packages for symbols/ queries")
+	builtFlag        = flag.Bool("built-times", false, "Look up when the packages were last installed, for ?sort=built")
+	prefetchFlag     = flag.String("prefetch", "", "File of queries, one per line, to cache the results of once the index is built")
+	maxResponseFlag  = flag.Int("max-response-bytes", 0, "Maximum size of a query response; larger responses are truncated; 0 means no limit")
+	rejectFlag       = flag.Bool("reject-oversized", false, "Answer queries exceeding -max-response-bytes with 413 instead of truncating them")
+	logRequestsFlag  = flag.Bool("log-requests", false, "Log the requests, with their X-Request-ID")
+	intervalFlag     = flag.Duration("interval", 45*time.Minute, "Interval of updating the index; 0 disables")
+	refreshFlag      = flag.Duration("refresh-invalid", time.Minute, "Interval of checking modified directories without packages for new ones; 0 disables")
+	h2cFlag          = flag.Bool("h2c", false, "Serve HTTP/2 over cleartext connections as well as HTTP/1.1")
+	readTimeoutFlag  = flag.Duration("read-timeout", 10*time.Second, "Maximum duration of reading a request; 0 means no limit")
+	writeTimeoutFlag = flag.Duration("write-timeout", time.Minute, "Maximum duration of answering a request; 0 means no limit")
+	idleTimeoutFlag  = flag.Duration("idle-timeout", 2*time.Minute, "Maximum duration of waiting for the next request on a connection; 0 means no limit")
 )
 
+// defaultExclusions are the metadata directories of the version control
+// systems (Git, Mercurial, Subversion, Bazaar, and CVS), excluded from
+// indexing unless -no-default-exclude is given.
+const defaultExclusions = `.git .hg .svn .bzr CVS`
+
 func main() {
 	flag.Usage = func() {
 		fmt.Println(`gopaths [-http=[HOST]:PORT] [-exclusions FILE] [-root DIRS]`)
+		fmt.Println(`gopaths check [-exclude FILE] [-exclude-regex FILE] [-prefetch FILE] [-query-tokens FILE] [-dirs FILE] [-load FILE] [-root DIRS]`)
+		fmt.Println(`gopaths reindex [-http=[HOST]:PORT] [-update-token TOKEN]`)
 		flag.PrintDefaults()
 		os.Exit(2)
 	}
 	flag.Parse()
 
-	dirs := index{}
+	// “gopaths check” and “gopaths reindex” take the flags both before
+	// and after them.
+	checking, reindexing := flag.Arg(0) == "check", flag.Arg(0) == "reindex"
+	if checking || reindexing {
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
+
+	envExclusions, err := applyEnv(flag.CommandLine, os.Getenv)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+
+	if reindexing {
+		if err := reindex(os.Stdout, *httpFlag, *updateTokenFlag); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		return
+	}
+
+	if checking {
+		roots := defaultRoots(*gorootFlag)
+		if *rootFlag != "" {
+			roots = strings.Split(*rootFlag, string(os.PathListSeparator))
+		}
+		if check(os.Stderr, roots, envExclusions, checkFiles{
+			exclusions:  *exclFlag,
+			regexps:     *exclRegexFlag,
+			prefetch:    *prefetchFlag,
+			queryTokens: *queryTokensFlag,
+			dirs:        *dirsFlag,
+			load:        *loadFlag,
+		}) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
 
-	if *exclFlag != "" {
-		f, err := os.Open(*exclFlag)
+	if *workersFlag < 0 {
+		log.Fatalf("invalid -index-workers %d: must not be negative\n", *workersFlag)
+	}
+
+	dirs := index{
+		includeHidden:     *hiddenFlag,
+		foldStdlib:        *foldStdlibFlag,
+		strictValid:       *strictValidFlag,
+		canonicalImports:  *canonicalFlag,
+		maxDirEntries:     *maxEntriesFlag,
+		indexWorkers:      *workersFlag,
+		queryTimeout:      *queryTimeoutFlag,
+		parallelThreshold: *parallelFlag,
+		cache:             newCache(*cacheSizeFlag),
+		waitReady:         *waitReadyFlag,
+		disableUpdate:     !*allowUpdateFlag,
+		frozen:            *freezeFlag,
+		updateToken:       *updateTokenFlag,
+		indexSymbols:      *symbolsFlag,
+		builtTimes:        *builtFlag,
+		logRequests:       *logRequestsFlag,
+
+		maxResponseBytes: *maxResponseFlag,
+		rejectOversized:  *rejectFlag,
+	}
+
+	if err := loadExclusions(&dirs, *exclFlag, envExclusions, *noDefaultExclFlag, *strictFlag); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+
+	if *exclRegexFlag != "" {
+		f, err := os.Open(*exclRegexFlag)
 		if err != nil {
 			log.Fatalf("%v\n", err)
 		}
 
-		dirs.Exclusions(bufio.NewReader(f))
+		err = dirs.ExclusionRegexps(bufio.NewReader(f))
 		f.Close()
-	} else {
-		dirs.Exclusions(strings.NewReader(defaultExclusions))
+		if err != nil {
+			log.Fatalf("%s: %v\n", *exclRegexFlag, err)
+		}
 	}
 
-	if *rootFlag != "" {
+	if *queryTokensFlag != "" {
+		f, err := os.Open(*queryTokensFlag)
+		if err != nil {
+			log.Fatalf("%v\n", err)
+		}
+
+		err = dirs.QueryTokens(bufio.NewReader(f))
+		f.Close()
+		if err != nil {
+			log.Fatalf("%s: %v\n", *queryTokensFlag, err)
+		}
+	}
+
+	prefetch := []cacheKey{}
+	if *prefetchFlag != "" {
+		f, err := os.Open(*prefetchFlag)
+		if err != nil {
+			log.Fatalf("%v\n", err)
+		}
+
+		prefetch, err = parsePrefetch(bufio.NewReader(f))
+		f.Close()
+		if err != nil {
+			log.Fatalf("%s: %v\n", *prefetchFlag, err)
+		}
+	}
+
+	var loaded []details
+	if *loadFlag != "" {
+		if loaded, err = loadIndex(&dirs, *loadFlag); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+	} else if *rootFlag != "" {
 		dirs.Roots(strings.Split(*rootFlag, string(os.PathListSeparator)))
 	} else {
-		dirs.Roots(build.Default.SrcDirs())
+		dirs.Roots(defaultRoots(*gorootFlag))
 	}
+	if *dirsFlag != "" {
+		if err := listDirs(&dirs, *dirsFlag); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+	}
+
+	if *dryRunFlag {
+		dirs.DryRun(os.Stdout)
+		return
+	}
+
+	var listeners []net.Listener
+	if *loadFlag != "" {
+		start := time.Now()
+		dirs.Load(loaded)
+		if listeners, err = listen(*httpFlag); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		ready(&dirs, listenAddrs(listeners), start, prefetch)
+	} else if *waitReadyFlag > 0 || *deadlineFlag > 0 {
+		if listeners, err = listen(*httpFlag); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		addrs := listenAddrs(listeners)
+		go func() {
+			warm(&dirs, addrs, *deadlineFlag, prefetch)
+			if *intervalFlag > 0 {
+				dirs.UpdateIndex(*intervalFlag)
+			}
+		}()
 
+		// Serve from the partial index, unless queries may wait for it.
+		if *waitReadyFlag == 0 {
+			dirs.WaitReady(context.Background())
+		}
+	} else {
+		if listeners, err = warmListen(&dirs, *httpFlag, prefetch); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		if *intervalFlag > 0 {
+			go dirs.UpdateIndex(*intervalFlag)
+		}
+	}
+
+	if *refreshFlag > 0 {
+		go dirs.RefreshInvalidEvery(*refreshFlag)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	t := timeouts{read: *readTimeoutFlag, write: *writeTimeoutFlag, idle: *idleTimeoutFlag}
+	handler := dirs.Handler()
+	if *h2cFlag {
+		handler = allowH2C(handler, t)
+	}
+	if err := serve(ctx, listeners, handler, t); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// defaultRoots returns the source directories of GOROOT, unless
+// includeGoroot is false, and of GOPATH.
+func defaultRoots(includeGoroot bool) []string {
+	goroot := filepath.Join(build.Default.GOROOT, "src")
+
+	roots := []string{}
+	for _, dir := range build.Default.SrcDirs() {
+		if includeGoroot || dir != goroot {
+			roots = append(roots, dir)
+		}
+	}
+	return roots
+}
+
+// envFlags are the environment variables the flags fall back to, for
+// configuring gopaths in containers. GOPATHS_EXCLUDE lists exclusions,
+// rather than naming a file of them like -exclude.
+var envFlags = []struct {
+	flag, env string
+}{
+	{"root", "GOPATHS_ROOTS"},
+	{"exclude", "GOPATHS_EXCLUDE"},
+	{"http", "GOPATHS_HTTP"},
+	{"interval", "GOPATHS_INTERVAL"},
+}
+
+// applyEnv sets the flags of fs not given on the command line to
+// the values of their environment variables, looked up with getenv,
+// if set, except for the exclusions of GOPATHS_EXCLUDE, separated
+// by the OS path list separator, which it returns.
+func applyEnv(fs *flag.FlagSet, getenv func(string) string) (exclusions []string, err error) {
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	for _, e := range envFlags {
+		v := getenv(e.env)
+		if v == "" || given[e.flag] {
+			continue
+		}
+		if e.flag == "exclude" {
+			exclusions = filepath.SplitList(v)
+			continue
+		}
+		if err := fs.Set(e.flag, v); err != nil {
+			return nil, fmt.Errorf("%s: %v", e.env, err)
+		}
+	}
+	return exclusions, nil
+}
+
+// loadExclusions loads the exclusions listed by names and in the file, if any,
+// on top of the default exclusions, unless noDefault is set. The file
+// and the names may thus re-include a default exclusion with ‘!’.
+// A file without exclusions is likely a mistake, so it's warned about,
+// or, if strict is set, it's an error.
+func loadExclusions(dirs *index, file string, names []string, noDefault, strict bool) error {
+	rules := []io.Reader{}
+	if !noDefault {
+		rules = append(rules, strings.NewReader(defaultExclusions+"\n"))
+	}
+	if len(names) > 0 {
+		rules = append(rules, strings.NewReader(strings.Join(names, "\n")+"\n"))
+	}
+
+	if file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if len(strings.Fields(string(b))) == 0 {
+			if strict {
+				return fmt.Errorf("%s: no exclusions in the file", file)
+			}
+			applied := "only the default exclusions apply"
+			if noDefault {
+				applied = "no directories are excluded"
+			}
+			log.Printf("WARNING: %s: no exclusions in the file; %s", file, applied)
+		}
+		rules = append(rules, bytes.NewReader(b))
+	}
+	return dirs.Exclusions(io.MultiReader(rules...))
+}
+
+// loadIndex reads the index entries saved in the file, for serving them
+// instead of indexing, and freezes the index, as there are no roots
+// to update it from.
+func loadIndex(dirs *index, file string) ([]details, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries, err := readIndex(bufio.NewReader(f))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	dirs.frozen = true
+	return entries, nil
+}
+
+// listDirs reads the directories to index listed in the file.
+func listDirs(dirs *index, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := dirs.ListDirs(bufio.NewReader(f)); err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	return nil
+}
+
+// warm builds the index, serving the partial index after the deadline,
+// if positive, caches the results of the prefetch queries, and then logs
+// a machine readable line per address announcing that the service
+// at it is ready to answer queries.
+func warm(dirs *index, addrs []string, deadline time.Duration, prefetch []cacheKey) {
+	start := time.Now()
+	dirs.IndexWithin(deadline)
+	ready(dirs, addrs, start, prefetch)
+}
+
+// warmListen builds the index before listening on the comma separated
+// addresses, so that the clients don't connect until the queries can be
+// answered, and then logs the ready lines of the addresses listened on.
+func warmListen(dirs *index, addrs string, prefetch []cacheKey) ([]net.Listener, error) {
+	start := time.Now()
 	dirs.Index()
-	go dirs.UpdateIndex()
+	listeners, err := listen(addrs)
+	if err != nil {
+		return nil, err
+	}
+	ready(dirs, listenAddrs(listeners), start, prefetch)
+	return listeners, nil
+}
 
-	log.Fatal(http.ListenAndServe(*httpFlag, dirs.ServeMux()))
+// ready caches the results of the prefetch queries, and then announces
+// that the service at each of the addresses is ready, since start.
+func ready(dirs *index, addrs []string, start time.Time, prefetch []cacheKey) {
+	if len(prefetch) > 0 {
+		log.Printf("Prefetched %d of %d queries", dirs.Prefetch(prefetch), len(prefetch))
+	}
+	n, d := dirs.Len(), time.Since(start)
+	for _, addr := range addrs {
+		log.Printf("ready addr=%s directories=%d duration=%s", addr, n, d)
+	}
 }
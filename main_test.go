@@ -1,16 +1,35 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/ast"
 	"go/build"
+	"go/token"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
 )
 
 const (
@@ -67,24 +86,24 @@ func prefixImp(paths []string, prefix string) []string {
 }
 
 var QueryTestDetails = []details{
-	{"/root/a/a", "a/a", true},
-	{"/root/b/a", "b/a", true},
-	{"/root/a", "a", true},
-	{"/root/ab", "ab", true},
-	{"/root/a/b", "a/b", false},
-	{"/long path/ab/ab", "ab/ab", true},
-	{"/long/path/ab/a.b", "ab/a.b", true},
-	{"/c-c/c.c", "c-c/c.c", false},
-	{"/c-c/c.c/c.c", "c-c/c.c/c.c", true},
-	{"/a/b/c", "a/b/c", true},
-	{"./d/d", "d/d", false},
+	{fullPath: "/root/a/a", importPath: "a/a", valid: true},
+	{fullPath: "/root/b/a", importPath: "b/a", valid: true},
+	{fullPath: "/root/a", importPath: "a", valid: true},
+	{fullPath: "/root/ab", importPath: "ab", valid: true},
+	{fullPath: "/root/a/b", importPath: "a/b", valid: false},
+	{fullPath: "/long path/ab/ab", importPath: "ab/ab", valid: true},
+	{fullPath: "/long/path/ab/a.b", importPath: "ab/a.b", valid: true},
+	{fullPath: "/c-c/c.c", importPath: "c-c/c.c", valid: false},
+	{fullPath: "/c-c/c.c/c.c", importPath: "c-c/c.c/c.c", valid: true},
+	{fullPath: "/a/b/c", importPath: "a/b/c", valid: true},
+	{fullPath: "./d/d", importPath: "d/d", valid: false},
 }
 
 var QueryImportsTests = []struct {
 	query string
 	out   []string
 }{
-	{"imports/a", []string{"a/a", "b/a", "a"}},
+	{"imports/a", []string{"a", "a/a", "b/a"}},
 	{"imports/a/a", []string{"a/a"}},
 	{"imports/b", []string{"a/b"}},
 	{"imports/ab", []string{"ab", "ab/ab"}},
@@ -118,7 +137,7 @@ var QueryDirTests = []struct {
 	query string
 	out   []string
 }{
-	{"dirs/a", []string{"/root/a/a", "/root/b/a", "/root/a"}},
+	{"dirs/a", []string{"/root/a", "/root/a/a", "/root/b/a"}},
 	{"dirs/a/a", []string{"/root/a/a"}},
 	{"dirs/b", []string{"/root/a/b"}},
 	{"dirs/ab", []string{"/root/ab", "/long path/ab/ab"}},
@@ -159,24 +178,25 @@ func TestQueryDirs(t *testing.T) {
 	}
 }
 
-var IndexerImportsTests = []struct {
+var QueryModeTests = []struct {
 	query string
 	out   []string
 }{
-	{"imports/a", []string{"a"}},
-	{"imports/c", []string{"a/b/c"}},
-	{"imports/d", []string{"a/b/c/d", "d", "d/d"}},
-	{"imports/bb", []string{"aa/bb"}},
-	{"imports/c-c", []string{"c-c"}},
-	{"imports/c.c", []string{"c-c/c.c"}},
+	{"imports/a?mode=suffix", []string{"a", "a/a", "b/a"}},
+	{"imports/a?mode=prefix", []string{"a/a", "a", "ab", "ab/ab", "ab/a.b", "a/b/c"}},
+	{"imports/c-c/?mode=prefix", []string{"c-c/c.c/c.c"}},
+	{"imports/.b?mode=substring", []string{"ab/a.b"}},
+	{"imports/b/?mode=substring", []string{"b/a", "a/b/c", "ab/ab", "ab/a.b"}},
+	{"imports/abc?mode=fuzzy", []string{"a/b/c"}},
+	{"imports/cc?mode=fuzzy", []string{"c-c/c.c/c.c"}},
+	{"dirs/lpab?mode=fuzzy", []string{"/long path/ab/ab", "/long/path/ab/a.b"}},
+	{"dirs/root/a?mode=prefix", []string{"/root/a/a", "/root/a", "/root/ab"}},
 }
 
-func TestIndexerImports(t *testing.T) {
-	dirs := index{}
-	dirs.Roots([]string{"testdata"})
-	dirs.Index()
+func TestQueryModes(t *testing.T) {
+	dirs := index{index: QueryTestDetails}
 
-	for _, test := range IndexerImportsTests {
+	for _, test := range QueryModeTests {
 		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
 		if err != nil {
 			t.Errorf("GET %q failed", test.query)
@@ -185,77 +205,233 @@ func TestIndexerImports(t *testing.T) {
 		rec := httptest.NewRecorder()
 		dirs.ServeMux().ServeHTTP(rec, req)
 
-		out := prefixImp(test.out, testdataPrefix)
-
-		if actual := slice(rec.Body.String()); reflect.DeepEqual(actual, out) != true {
-			t.Errorf("%q: got %q, want %q", test.query, actual, out)
+		if actual := slice(rec.Body.String()); reflect.DeepEqual(actual, test.out) != true {
+			t.Errorf("%q: got %q, want %q", test.query, actual, test.out)
 		}
 	}
+
+	req, err := http.NewRequest("GET", hostPrefix+"imports/a?mode=bogus", nil)
+	if err != nil {
+		t.Errorf("GET %q failed", "imports/a?mode=bogus")
+	}
+
+	rec := httptest.NewRecorder()
+	dirs.ServeMux().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown mode: got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
 }
 
-func TestDuplicateRoots(t *testing.T) {
-	dirs := index{}
-	dirs.Roots([]string{
-		"testdata",
-		"./././testdata",
-	})
-	dirs.Index()
+var AnchoringTests = []struct {
+	query   string
+	out     []string
+	offsets [][][2]int
+}{
+	{"imports/http", []string{"http", "net/http"}, [][][2]int{{{0, 4}}, {{4, 8}}}},
+	{"dirs/http", []string{"/http", "/srv/go/src/net/http"}, [][][2]int{{{1, 5}}, {{16, 20}}}},
+	{"imports/http?mode=prefix", []string{"http"}, [][][2]int{{{0, 4}}}},
+	{"dirs/http?mode=prefix", []string{"/http"}, [][][2]int{{{1, 5}}}},
+	{"imports/os", []string{"os"}, [][][2]int{{{0, 2}}}},
+	{"dirs/os", []string{"/srv/go/src/os"}, [][][2]int{{{12, 14}}}},
+	{"imports/http?mode=unanchored", []string{"http", "nethttp", "net/http"}, [][][2]int{{{0, 4}}, {{3, 7}}, {{4, 8}}}},
+	{"dirs/http?mode=unanchored", []string{"/http", "/srv/go/src/nethttp", "/srv/go/src/net/http"}, [][][2]int{{{1, 5}}, {{15, 19}}, {{16, 20}}}},
+	{"imports/os?mode=unanchored", []string{"os", "paxos"}, [][][2]int{{{0, 2}}, {{3, 5}}}},
+	{"dirs/os?mode=unanchored", []string{"/srv/paxos", "/srv/go/src/os"}, [][][2]int{{{8, 10}}, {{12, 14}}}},
+	{"dirs/src/os?mode=unanchored", []string{"/srv/go/src/os"}, [][][2]int{{{8, 14}}}},
+}
 
-	for _, test := range IndexerImportsTests {
+func TestAnchoring(t *testing.T) {
+	dirs := index{index: []details{
+		{fullPath: "/http", importPath: "http", valid: true},
+		{fullPath: "/srv/go/src/net/http", importPath: "net/http", valid: true},
+		{fullPath: "/srv/go/src/nethttp", importPath: "nethttp", valid: true},
+		{fullPath: "/srv/go/src/os", importPath: "os", valid: true},
+		{fullPath: "/srv/paxos", importPath: "paxos", valid: true},
+	}}
+
+	for _, test := range AnchoringTests {
 		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
 		if err != nil {
 			t.Errorf("GET %q failed", test.query)
 		}
+		req.Header.Set("Accept", "application/json")
 
 		rec := httptest.NewRecorder()
 		dirs.ServeMux().ServeHTTP(rec, req)
 
-		out := prefixImp(test.out, testdataPrefix)
+		var results []result
+		if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+			t.Fatalf("%q: %v", test.query, err)
+		}
 
-		if actual := slice(rec.Body.String()); reflect.DeepEqual(actual, out) != true {
-			t.Errorf("%q: got %q, want %q", test.query, actual, out)
+		paths, offsets := []string{}, [][][2]int{}
+		for _, res := range results {
+			paths = append(paths, res.Path)
+			offsets = append(offsets, res.Offsets)
+		}
+		if !reflect.DeepEqual(paths, test.out) {
+			t.Errorf("%q: got %q, want %q", test.query, paths, test.out)
+		}
+		if !reflect.DeepEqual(offsets, test.offsets) {
+			t.Errorf("%q: got offsets %v, want %v", test.query, offsets, test.offsets)
 		}
 	}
 }
 
-func TestNonExistentRoot(t *testing.T) {
-	dirs := index{}
-	err := dirs.Roots([]string{
-		"non/existent/path",
-	})
-	if err == nil {
-		t.Errorf("non existent root: Roots should have returned an error")
+var QueryGlobTests = []struct {
+	query   string
+	out     []string
+	offsets [][][2]int
+}{
+	{"imports/github.com/*/logging?mode=glob", []string{"github.com/a/logging", "github.com/b/logging"}, [][][2]int{{{0, 20}}, {{0, 20}}}},
+	{"imports/*/logging?mode=glob", []string{"github.com/logging", "github.com/a/logging", "github.com/b/logging", "github.com/a/x/logging"}, [][][2]int{{{0, 18}}, {{11, 20}}, {{11, 20}}, {{13, 22}}}},
+	{"imports/github.com/**/logging?mode=glob", []string{"github.com/logging", "github.com/a/logging", "github.com/b/logging", "github.com/a/x/logging"}, [][][2]int{{{0, 18}}, {{0, 20}}, {{0, 20}}, {{0, 22}}}},
+	{"imports/github.com/**/**/x/logging?mode=glob", []string{"github.com/a/x/logging"}, [][][2]int{{{0, 22}}}},
+	{"imports/github.com/%3F/log*?mode=glob", []string{"github.com/a/logrus", "github.com/a/logging", "github.com/b/logging"}, [][][2]int{{{0, 19}}, {{0, 20}}, {{0, 20}}}},
+	{"imports/github.com/[a]/log*?mode=glob", []string{"github.com/a/logrus", "github.com/a/logging"}, [][][2]int{{{0, 19}}, {{0, 20}}}},
+	{"imports/github.com/*?mode=glob", []string{"github.com/logging"}, [][][2]int{{{0, 18}}}},
+	{"imports/gitlab.com/*/logging?mode=glob", []string{}, [][][2]int{}},
+	{"imports/*/lo?mode=glob", []string{}, [][][2]int{}},
+	{"dirs/src/*/*/logging?mode=glob", []string{"/go/src/github.com/a/logging", "/go/src/github.com/b/logging"}, [][][2]int{{{4, 28}}, {{4, 28}}}},
+	{"dirs/go/**/x/*?mode=glob", []string{"/go/src/github.com/a/x/logging"}, [][][2]int{{{1, 30}}}},
+}
+
+func TestQueryGlob(t *testing.T) {
+	dirs := index{index: []details{
+		{fullPath: "/go/src/github.com/a/logging", importPath: "github.com/a/logging", valid: true},
+		{fullPath: "/go/src/github.com/a/logrus", importPath: "github.com/a/logrus", valid: true},
+		{fullPath: "/go/src/github.com/a/x/logging", importPath: "github.com/a/x/logging", valid: true},
+		{fullPath: "/go/src/github.com/b/logging", importPath: "github.com/b/logging", valid: true},
+		{fullPath: "/go/src/github.com/logging", importPath: "github.com/logging", valid: true},
+	}}
+
+	for _, test := range QueryGlobTests {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+		req.Header.Set("Accept", "application/json")
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		var results []result
+		if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+			t.Fatalf("%q: %v", test.query, err)
+		}
+
+		paths, offsets := []string{}, [][][2]int{}
+		for _, res := range results {
+			paths = append(paths, res.Path)
+			offsets = append(offsets, res.Offsets)
+		}
+		if !reflect.DeepEqual(paths, test.out) {
+			t.Errorf("%q: got %q, want %q", test.query, paths, test.out)
+		}
+		if !reflect.DeepEqual(offsets, test.offsets) {
+			t.Errorf("%q: got offsets %v, want %v", test.query, offsets, test.offsets)
+		}
+	}
+
+	req, err := http.NewRequest("GET", hostPrefix+"imports/github.com/[a/logging?mode=glob", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	dirs.ServeMux().ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("malformed glob: got status %d, want %d", rec.Code, http.StatusBadRequest)
 	}
 }
 
-func TestNonDirRoot(t *testing.T) {
-	dirs := index{}
-	err := dirs.Roots([]string{
-		"main.go",
-	})
-	if err != os.ErrInvalid {
-		t.Errorf("non dir root: Roots should have returned an error")
+var CaseFoldingTests = []struct {
+	query   string
+	out     []string
+	offsets [][][2]int
+}{
+	{"imports/net/http", []string{"example.com/net/http"}, [][][2]int{{{12, 20}}}},
+	{"imports/net/HTTP", []string{}, [][][2]int{}},
+	{"imports/net/HTTP?case=last", []string{"example.com/net/http"}, [][][2]int{{{12, 20}}}},
+	{"imports/Net/http?case=last", []string{"example.com/Net/Http"}, [][][2]int{{{12, 20}}}},
+	{"imports/NET/http?case=last", []string{}, [][][2]int{}},
+	{"imports/NET/http?case=insensitive", []string{"example.com/net/http", "example.com/Net/Http"}, [][][2]int{{{12, 20}}, {{12, 20}}}},
+	{"imports/net/?case=last", []string{"example.com/net/http"}, [][][2]int{{{12, 15}}}},
+	{"imports/NET/?case=insensitive", []string{"example.com/net/http", "example.com/Net/Http"}, [][][2]int{{{12, 15}}, {{12, 15}}}},
+	{"imports/example.com/net/HT?mode=prefix&case=last", []string{"example.com/net/http"}, [][][2]int{{{0, 18}}}},
+	{"imports/example.com/net/HT?mode=prefix&case=sensitive", []string{}, [][][2]int{}},
+}
+
+func TestQueryCaseFolding(t *testing.T) {
+	dirs := index{index: []details{
+		{fullPath: "/gopath/src/example.com/net/http", importPath: "example.com/net/http", valid: true},
+		{fullPath: "/gopath/src/example.com/Net/Http", importPath: "example.com/Net/Http", valid: true},
+	}}
+
+	for _, test := range CaseFoldingTests {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+		req.Header.Set("Accept", "application/json")
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		var results []result
+		if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+			t.Fatalf("%q: %v", test.query, err)
+		}
+
+		paths, offsets := []string{}, [][][2]int{}
+		for _, res := range results {
+			paths = append(paths, res.Path)
+			offsets = append(offsets, res.Offsets)
+		}
+		if !reflect.DeepEqual(paths, test.out) {
+			t.Errorf("%q: got %q, want %q", test.query, paths, test.out)
+		}
+		if !reflect.DeepEqual(offsets, test.offsets) {
+			t.Errorf("%q: got offsets %v, want %v", test.query, offsets, test.offsets)
+		}
+	}
+
+	req, err := http.NewRequest("GET", hostPrefix+"imports/http?case=bogus", nil)
+	if err != nil {
+		t.Errorf("GET %q failed", "imports/http?case=bogus")
+	}
+
+	rec := httptest.NewRecorder()
+	dirs.ServeMux().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown case: got status %d, want %d", rec.Code, http.StatusBadRequest)
 	}
 }
 
-var IndexerDirTests = []struct {
+var RankingTestDetails = []details{
+	{fullPath: "/home/x/go/src/github.com/x/os", importPath: "github.com/x/os", valid: true},
+	{fullPath: "/home/x/go/src/github.com/x/chaos", importPath: "github.com/x/chaos", valid: true},
+	{fullPath: "/home/x/go/src/x/os", importPath: "x/os", valid: true},
+	{fullPath: "/usr/local/go/src/os", importPath: "os", valid: true},
+	{fullPath: "/usr/local/go/src/cmd/vendor/golang.org/x/sys/os", importPath: "golang.org/x/sys/os", valid: true},
+}
+
+var RankingTests = []struct {
 	query string
 	out   []string
 }{
-	{"a", []string{"/a"}},
-	{"c", []string{"/a/b/c"}},
-	{"d", []string{"/a/b/c/d", "/d", "/d/d"}},
-	{"bb", []string{"/aa/bb"}},
-	{"c-c", []string{"/c-c"}},
-	{"c.c", []string{"/c-c/c.c"}},
+	{"imports/os", []string{"os", "x/os", "github.com/x/os", "golang.org/x/sys/os"}},
+	{"imports/x/os", []string{"x/os", "github.com/x/os"}},
+	{"dirs/os", []string{"/home/x/go/src/x/os", "/usr/local/go/src/os",
+		"/home/x/go/src/github.com/x/os", "/usr/local/go/src/cmd/vendor/golang.org/x/sys/os"}},
+	{"imports/os?mode=prefix", []string{"os"}},
 }
 
-func TestIndexerDirs(t *testing.T) {
-	dirs := index{}
-	dirs.Roots([]string{"testdata"})
-	dirs.Index()
+func TestQueryRanking(t *testing.T) {
+	dirs := index{index: RankingTestDetails}
 
-	for _, test := range IndexerDirTests {
+	for _, test := range RankingTests {
 		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
 		if err != nil {
 			t.Errorf("GET %q failed", test.query)
@@ -264,33 +440,74 @@ func TestIndexerDirs(t *testing.T) {
 		rec := httptest.NewRecorder()
 		dirs.ServeMux().ServeHTTP(rec, req)
 
-		out := prefixDir(test.out, dirPrefix)
+		if actual := slice(rec.Body.String()); reflect.DeepEqual(actual, test.out) != true {
+			t.Errorf("%q: got %q, want %q", test.query, actual, test.out)
+		}
+	}
+}
 
-		if actual := slice(rec.Body.String()); reflect.DeepEqual(actual, out) != true {
-			t.Errorf("%q: got %q, want %q", test.query, actual, out)
+var TiesTests = []struct {
+	query string
+	out   []string
+}{
+	{"imports/x?mode=substring", []string{"a/x", "b/x", "c/x", "ab/x", "ba/x"}},
+	{"imports/x?mode=fuzzy", []string{"a/x", "b/x", "c/x", "ab/x", "ba/x"}},
+	{"imports/?mode=substring", []string{"a/x", "b/x", "c/x", "ab/x", "ba/x"}},
+}
+
+// TestQueryTies queries paths with equal scores, indexed in different orders.
+func TestQueryTies(t *testing.T) {
+	paths := []string{"c/x", "ba/x", "a/x", "ab/x", "b/x"}
+
+	for i := range paths {
+		dirs := index{}
+		for j := range paths {
+			path := paths[(i+j)%len(paths)]
+			dirs.index = append(dirs.index, details{fullPath: "/go/src/" + path, importPath: path, valid: true})
+		}
+
+		for _, test := range TiesTests {
+			req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+			if err != nil {
+				t.Errorf("GET %q failed", test.query)
+			}
+
+			rec := httptest.NewRecorder()
+			dirs.ServeMux().ServeHTTP(rec, req)
+
+			if actual := slice(rec.Body.String()); !reflect.DeepEqual(actual, test.out) {
+				t.Errorf("%q, indexed from %s: got %q, want %q", test.query, paths[i], actual, test.out)
+			}
 		}
 	}
 }
 
-var ExclusionsTests = []struct {
+var ChildrenTestDetails = []details{
+	{fullPath: "/go/src/net/http", importPath: "net/http", valid: true},
+	{fullPath: "/go/src/net/http/httptest", importPath: "net/http/httptest", valid: true},
+	{fullPath: "/go/src/net/http/internal", importPath: "net/http/internal", valid: false},
+	{fullPath: "/go/src/net/http/internal/ascii", importPath: "net/http/internal/ascii", valid: true},
+	{fullPath: "/go/src/net/httpx", importPath: "net/httpx", valid: true},
+	{fullPath: "/gopath/src/golang.org/x/net/http/httpguts", importPath: "golang.org/x/net/http/httpguts", valid: true},
+	{fullPath: "/gopath/src/x/mynet/http/foo", importPath: "x/mynet/http/foo", valid: true},
+}
+
+var ChildrenTests = []struct {
 	query string
 	out   []string
 }{
-	{"imports/a", []string{"a"}},
-	{"imports/c", []string{""}},
-	{"imports/d", []string{"d", "d/d"}},
-	{"imports/bb", []string{"aa/bb"}},
-	{"imports/c-c", []string{"c-c"}},
-	{"imports/c.c", []string{"c-c/c.c"}},
+	{"imports/net/http", []string{"net/http"}},
+	{"imports/net/http/", []string{"net/http/httptest", "net/http/internal/ascii", "golang.org/x/net/http/httpguts"}},
+	{"imports/http/internal/", []string{"net/http/internal/ascii"}},
+	{"imports/httptest/", []string{""}},
+	{"imports/net/http/?mode=prefix", []string{"net/http/httptest", "net/http/internal/ascii"}},
+	{"dirs/src/net/http/", []string{"/go/src/net/http/httptest", "/go/src/net/http/internal/ascii"}},
 }
 
-func TestExclusions(t *testing.T) {
-	dirs := index{}
-	dirs.Roots([]string{"testdata"})
-	dirs.Exclusions(strings.NewReader(`b c`))
-	dirs.Index()
+func TestQueryChildren(t *testing.T) {
+	dirs := index{index: ChildrenTestDetails}
 
-	for _, test := range ExclusionsTests {
+	for _, test := range ChildrenTests {
 		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
 		if err != nil {
 			t.Errorf("GET %q failed", test.query)
@@ -299,32 +516,5434 @@ func TestExclusions(t *testing.T) {
 		rec := httptest.NewRecorder()
 		dirs.ServeMux().ServeHTTP(rec, req)
 
-		out := prefixImp(test.out, testdataPrefix)
+		if actual := slice(rec.Body.String()); reflect.DeepEqual(actual, test.out) != true {
+			t.Errorf("%q: got %q, want %q", test.query, actual, test.out)
+		}
+	}
+}
 
-		if actual := slice(rec.Body.String()); reflect.DeepEqual(actual, out) != true {
-			t.Errorf("%q: got %q, want %q", test.query, actual, out)
+var SeparatorTests = []struct {
+	query string
+	out   []string
+}{
+	{`imports/a\a`, []string{"a/a"}},
+	{"imports/a%5Ca", []string{"a/a"}},
+	{`imports/c-c\c.c/`, []string{"c-c/c.c/c.c"}},
+	{`dirs/root\b\a`, []string{"/root/b/a"}},
+	{"dirs/root%5Cb%5Ca", []string{"/root/b/a"}},
+	{`dirs/b\a?mode=prefix`, []string{""}},
+	{`dirs/root\a/a`, []string{"/root/a/a"}},
+}
+
+// TestQuerySeparators queries slash separated paths with backslashes,
+// as sent by Windows clients. (The Windows tests query backslash separated
+// paths with slashes.)
+func TestQuerySeparators(t *testing.T) {
+	if sep != "/" {
+		t.Skip("the indexed paths are slash separated")
+	}
+
+	dirs := index{index: QueryTestDetails}
+
+	for _, test := range SeparatorTests {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		if actual := slice(rec.Body.String()); reflect.DeepEqual(actual, test.out) != true {
+			t.Errorf("%q: got %q, want %q", test.query, actual, test.out)
 		}
 	}
 }
 
-func TestQueryUpdate(t *testing.T) {
+var SegmentsTestDetails = []details{
+	{fullPath: "/src/x/y/z/w", importPath: "x/y/z/w", valid: true},
+	{fullPath: "/src/a/y/z", importPath: "a/y/z", valid: true},
+	{fullPath: "/src/x/yy/zz", importPath: "x/yy/zz", valid: true},
+	{fullPath: "/src/y/zap", importPath: "y/zap", valid: true},
+	{fullPath: "/src/y/z/y", importPath: "y/z/y", valid: true},
+}
+
+var SegmentsTests = []struct {
+	query string
+	out   []string
+}{
+	{"imports/y/z?mode=segments", []string{"x/y/z/w", "a/y/z", "y/z/y"}},
+	{"imports/y/z/?mode=segments", []string{"x/y/z/w", "a/y/z", "y/z/y"}},
+	{"imports/z/y?mode=segments", []string{"y/z/y"}},
+	{"imports/y?mode=segments", []string{"x/y/z/w", "a/y/z", "y/zap", "y/z/y"}},
+	{"imports/y/z", []string{"a/y/z"}},
+	{"imports/y/z?mode=substring", []string{"a/y/z", "y/z/y", "y/zap", "x/y/z/w", "x/yy/zz"}},
+
+	// Suffixes are whole trailing segments, unlike substrings.
+	{"imports/y/zz", []string{""}},
+	{"imports/y/zz?mode=substring", []string{"x/yy/zz"}},
+	{"imports/yy/zz", []string{"x/yy/zz"}},
+	{"imports/ap", []string{""}},
+	{"imports/ap?mode=substring", []string{"y/zap"}},
+	{"dirs/y/z/w?mode=segments", []string{"/src/x/y/z/w"}},
+	{"dirs/src/y?mode=segments", []string{"/src/y/zap", "/src/y/z/y"}},
+}
+
+func TestQuerySegments(t *testing.T) {
+	dirs := index{index: SegmentsTestDetails}
+
+	for _, test := range SegmentsTests {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		if actual := slice(rec.Body.String()); reflect.DeepEqual(actual, test.out) != true {
+			t.Errorf("%q: got %q, want %q", test.query, actual, test.out)
+		}
+	}
+}
+
+var CompleteTests = []struct {
+	query   string
+	out     []string
+	offsets [][][2]int
+}{
+	{"imports/net/ht", []string{"net/http", "x/net/http", "net/httptest", "x/net/httpguts"}, [][][2]int{{{0, 6}}, {{2, 8}}, {{0, 6}}, {{2, 8}}}},
+	{"imports/net/http", []string{"net/http", "x/net/http", "net/httptest", "x/net/httpguts"}, [][][2]int{{{0, 8}}, {{2, 10}}, {{0, 8}}, {{2, 10}}}},
+	{"imports/net/httpt", []string{"net/httptest"}, [][][2]int{{{0, 9}}}},
+	{"imports/et/ht", []string{}, [][][2]int{}},
+	{"imports/ht", []string{"net/http", "x/net/http", "net/httptest", "x/net/httpguts"}, [][][2]int{{{4, 6}}, {{6, 8}}, {{4, 6}}, {{6, 8}}}},
+	{"imports/te", []string{"net/template", "net/http/template"}, [][][2]int{{{4, 6}}, {{9, 11}}}},
+	{"imports/net/", []string{"net/http", "x/net/http", "net/httptest", "net/template", "x/net/httpguts"}, [][][2]int{{{0, 4}}, {{2, 6}}, {{0, 4}}, {{0, 4}}, {{2, 6}}}},
+	{"imports/x/net/h", []string{"x/net/http", "x/net/httpguts"}, [][][2]int{{{0, 7}}, {{0, 7}}}},
+}
+
+func TestQueryComplete(t *testing.T) {
 	dirs := index{}
-	dirs.Roots([]string{"testdata"})
-	dirs.Index()
+	for _, importPath := range []string{"net", "net/http", "net/http/template", "net/httptest", "net/template", "x/net/http", "x/net/httpguts"} {
+		dirs.index = append(dirs.index, details{fullPath: "/gopath/src/" + importPath, importPath: importPath, valid: true})
+	}
 
-	query := "update"
+	for _, test := range CompleteTests {
+		req, err := http.NewRequest("GET", hostPrefix+test.query+"?mode=complete", nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+		req.Header.Set("Accept", "application/json")
 
-	req, err := http.NewRequest("GET", hostPrefix+query, nil)
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		var results []result
+		if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+			t.Fatalf("%q: %v", test.query, err)
+		}
+
+		paths, offsets := []string{}, [][][2]int{}
+		for _, res := range results {
+			paths = append(paths, res.Path)
+			offsets = append(offsets, res.Offsets)
+		}
+		if !reflect.DeepEqual(paths, test.out) {
+			t.Errorf("%q: got %q, want %q", test.query, paths, test.out)
+		}
+		if !reflect.DeepEqual(offsets, test.offsets) {
+			t.Errorf("%q: got offsets %v, want %v", test.query, offsets, test.offsets)
+		}
+	}
+}
+
+var LoadTests = []struct {
+	query string
+	out   []string
+}{
+	{"imports/http", []string{"net/http", "example.com/http"}},
+	{"imports/example.com/?mode=prefix", []string{"example.com/http", "example.com/http/httputil", "example.com/tool"}},
+	{"imports/util?mode=substring", []string{"example.com/http/httputil"}},
+	{"imports/exhttp?mode=fuzzy", []string{"example.com/http", "example.com/http/httputil"}},
+	{"imports/example.com/http?mode=segments", []string{"example.com/http", "example.com/http/httputil"}},
+	{"imports/old", []string{""}},
+	{"imports/vendored", []string{""}},
+	{"imports/.cache/x", []string{""}},
+	{"dirs/tool", []string{filepath.FromSlash("/gopath/src/example.com/tool")}},
+	{"imports/tool?kind=command", []string{"example.com/tool"}},
+}
+
+func TestLoad(t *testing.T) {
+	root := filepath.FromSlash("/gopath/src")
+	entry := func(importPath, name string, valid bool) details {
+		return details{
+			fullPath:   filepath.Join(root, filepath.FromSlash(importPath)),
+			importPath: importPath,
+			name:       name,
+			valid:      valid,
+		}
+	}
+
+	dirs := index{rootDirs: []string{root}, cache: newCache(10)}
+	dirs.Exclusions(strings.NewReader("vendor import:example.com/old"))
+	dirs.Load([]details{
+		{fullPath: filepath.FromSlash("/goroot/src/net/http"), importPath: "net/http", name: "http", valid: true},
+		entry("example.com", "", false),
+		entry("example.com/http", "http", true),
+		entry("example.com/http/httputil", "httputil", true),
+		entry("example.com/old", "old", true),
+		entry("example.com/vendor/vendored", "vendored", true),
+		entry("example.com/.cache/x", "x", true),
+		entry("example.com/tool", "main", true),
+	})
+
+	if !dirs.Ready() {
+		t.Fatal("the loaded index should be ready")
+	}
+	if n := dirs.Len(); n != 5 {
+		t.Errorf("got %d directories, want 5", n)
+	}
+	if n := dirs.rootPackages[root]; n != 3 {
+		t.Errorf("got %d packages under %s, want 3", n, root)
+	}
+
+	for _, test := range LoadTests {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		if actual := slice(rec.Body.String()); !reflect.DeepEqual(actual, test.out) {
+			t.Errorf("%q: got %q, want %q", test.query, actual, test.out)
+		}
+	}
+
+	// Loading again replaces the entries, and the cached results.
+	dirs.Load([]details{entry("example.com/http", "http", true)})
+	req, err := http.NewRequest("GET", hostPrefix+"imports/http", nil)
 	if err != nil {
-		t.Errorf("GET %q failed", query)
+		t.Errorf("GET %q failed", "imports/http")
 	}
 
 	rec := httptest.NewRecorder()
 	dirs.ServeMux().ServeHTTP(rec, req)
 
-	out := []string{""}
+	if actual, out := slice(rec.Body.String()), []string{"example.com/http"}; !reflect.DeepEqual(actual, out) {
+		t.Errorf("reloaded: got %q, want %q", actual, out)
+	}
+}
 
-	if actual := slice(rec.Body.String()); reflect.DeepEqual(actual, out) != true {
-		t.Errorf("%q: got %q, want %q", query, actual, out)
+func TestLoadIndex(t *testing.T) {
+	dirs := index{}
+	entries, err := loadIndex(&dirs, filepath.Join("testdata", "index.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs.Load(entries)
+
+	for query, out := range map[string][]string{
+		"imports/net/http":                  {"example.com/net/http", "example.com/x/net/http"},
+		"imports/tool?kind=command":         {"example.com/cmd/tool"},
+		"imports/example.com/x?mode=prefix": {"example.com/x/net/http"},
+	} {
+		req, err := http.NewRequest("GET", hostPrefix+query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", query)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		if actual := slice(rec.Body.String()); !reflect.DeepEqual(actual, out) {
+			t.Errorf("%q: got %q, want %q", query, actual, out)
+		}
+	}
+
+	// The index saved from /all/dirs is the loaded one.
+	req, err := http.NewRequest("GET", hostPrefix+"all/dirs?format=csv", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	dirs.ServeMux().ServeHTTP(rec, req)
+
+	saved, err := ioutil.ReadFile(filepath.Join("testdata", "index.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Body.String() != string(saved) {
+		t.Errorf("/all/dirs: got %q, want %q", rec.Body, saved)
+	}
+
+	// The loaded index isn't updated.
+	req, err = http.NewRequest("POST", hostPrefix+"update", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	dirs.ServeMux().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("update: got status %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+var ReadIndexErrorTests = []struct {
+	csv string
+	err string
+}{
+	{"", "no header row"},
+	{"path,import_path,valid,package\n", `header ["path" "import_path" "valid" "package"], want ["full_path" "import_path" "valid" "package"]`},
+	{"full_path,import_path,valid,package\n/a,a,yes,a\n", `line 2: invalid valid column "yes"`},
+	{"full_path,import_path,valid,package\n/a,a,true\n", "record on line 2: wrong number of fields"},
+}
+
+func TestReadIndexErrors(t *testing.T) {
+	for _, test := range ReadIndexErrorTests {
+		if _, err := readIndex(strings.NewReader(test.csv)); err == nil || err.Error() != test.err {
+			t.Errorf("%q: got error %v, want %q", test.csv, err, test.err)
+		}
+	}
+}
+
+var ScoreTests = []struct {
+	query  string
+	scored bool
+}{
+	{"imports/a?mode=fuzzy", true},
+	{"imports/b?mode=fuzzy", true},
+	{"dirs/ab?mode=fuzzy", true},
+	{"imports/a?mode=substring", true},
+	{"dirs/b?mode=substring", true},
+	{"imports/a", false},
+	{"imports/a?mode=prefix", false},
+}
+
+func TestQueryScores(t *testing.T) {
+	dirs := index{index: QueryTestDetails}
+
+	for _, test := range ScoreTests {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+		req.Header.Set("Accept", "application/json")
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		var results []struct {
+			Path  string   `json:"path"`
+			Score *float64 `json:"score"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+			t.Errorf("%q: can't decode %q: %v", test.query, rec.Body.String(), err)
+			continue
+		}
+		if len(results) < 2 {
+			t.Errorf("%q: got %d results, want at least 2", test.query, len(results))
+		}
+
+		for i, res := range results {
+			if (res.Score != nil) != test.scored {
+				t.Errorf("%q: %q: got score %v, want scored: %v", test.query, res.Path, res.Score, test.scored)
+				continue
+			}
+			if test.scored && i > 0 && *res.Score > *results[i-1].Score {
+				t.Errorf("%q: %q scored %v is ranked below %q scored %v",
+					test.query, res.Path, *res.Score, results[i-1].Path, *results[i-1].Score)
+			}
+		}
+	}
+}
+
+var OffsetTests = []string{
+	"imports/a",
+	"imports/ab/a.b",
+	"imports/a?mode=prefix",
+	"imports/b/?mode=substring",
+	"imports/abc?mode=fuzzy",
+	"imports/cc?mode=fuzzy",
+	"dirs/a/a",
+	"dirs/root/a?mode=prefix",
+	"dirs/ath/ab?mode=substring",
+	"dirs/lpab?mode=fuzzy",
+	"dirs/c-c/c.c/c.c?mode=fuzzy",
+}
+
+func TestQueryOffsets(t *testing.T) {
+	dirs := index{index: QueryTestDetails}
+
+	for _, test := range OffsetTests {
+		req, err := http.NewRequest("GET", hostPrefix+test, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test)
+		}
+		req.Header.Set("Accept", "application/json")
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		var results []result
+		if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+			t.Errorf("%q: can't decode %q: %v", test, rec.Body.String(), err)
+			continue
+		}
+		if len(results) == 0 {
+			t.Errorf("%q: got no results", test)
+		}
+
+		// The matched characters make up the query.
+		query := test[strings.Index(test, "/")+1:]
+		if i := strings.Index(query, "?"); i >= 0 {
+			query = query[:i]
+		}
+		if strings.HasPrefix(test, "dirs/") {
+			query = strings.Join(strings.Split(query, "/"), sep)
+		}
+
+		for _, res := range results {
+			matched := ""
+			for _, span := range res.Offsets {
+				matched += res.Path[span[0]:span[1]]
+			}
+			if !strings.EqualFold(matched, query) {
+				t.Errorf("%q: offsets %v locate %q in %q", test, res.Offsets, matched, res.Path)
+			}
+		}
+	}
+}
+
+var NormalizationTestDetails = []details{
+	{fullPath: "/root/cafe\u0301", importPath: "cafe\u0301", valid: true},
+	{fullPath: "/root/cafe", importPath: "cafe", valid: true},
+}
+
+var NormalizationTests = []struct {
+	query string
+	out   []string
+}{
+	{"imports/caf\u00e9", []string{"cafe\u0301"}},
+	{"imports/cafe\u0301", []string{"cafe\u0301"}},
+	{"dirs/caf\u00e9", []string{"/root/cafe\u0301"}},
+	{"imports/cafe", []string{"cafe"}},
+}
+
+func TestQueryNormalization(t *testing.T) {
+	dirs := index{index: NormalizationTestDetails}
+
+	for _, test := range NormalizationTests {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		out := test.out
+		if strings.HasPrefix(test.query, "dirs/") {
+			out = prefixDir(test.out, "")
+		}
+
+		if actual := slice(rec.Body.String()); reflect.DeepEqual(actual, out) != true {
+			t.Errorf("%q: got %q, want %q", test.query, actual, out)
+		}
+	}
+}
+
+func TestQueryNDJSON(t *testing.T) {
+	dirs := index{index: QueryTestDetails}
+
+	for _, test := range QueryImportsTests {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+		req.Header.Set("Accept", "application/x-ndjson")
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		if ct := rec.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+			t.Errorf("%q: got Content-Type %q, want %q", test.query, ct, "application/x-ndjson")
+		}
+
+		actual := []string{}
+		s := bufio.NewScanner(rec.Body)
+		for s.Scan() {
+			var line struct {
+				Path string `json:"path"`
+			}
+			if err := json.Unmarshal(s.Bytes(), &line); err != nil {
+				t.Errorf("%q: can't decode %q: %v", test.query, s.Text(), err)
+			}
+			actual = append(actual, line.Path)
+		}
+
+		if reflect.DeepEqual(actual, test.out) != true {
+			t.Errorf("%q: got %q, want %q", test.query, actual, test.out)
+		}
+	}
+}
+
+func TestResultMetadata(t *testing.T) {
+	modTime := time.Date(2024, 3, 1, 12, 30, 0, 0, time.FixedZone("CET", 3600))
+	dirs := index{index: []details{
+		{fullPath: "/gopath/src/example.com/x", importPath: "example.com/x", modTime: modTime},
+		{fullPath: "/gopath/src/example.com/x/y", importPath: "example.com/x/y", valid: true, modTime: modTime},
+	}}
+
+	for query, valid := range map[string]bool{
+		"imports/x/y":                        true,
+		"imports/x":                          false,
+		"imports/example.com?mode=prefix":    true,
+		"dirs/x/y?mode=substring":            true,
+		"imports/xy?mode=fuzzy":              true,
+		"imports/x/y?mode=segments":          true,
+		"imports/x/y?mode=complete":          true,
+		"recent/":                            true,
+		"resolve/gopath/src/example.com/x/y": true,
+		"importdir/example.com/x/y":          true,
+		"all/imports":                        true,
+		"all/dirs":                           true,
+	} {
+		req, err := http.NewRequest("GET", hostPrefix+query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", query)
+		}
+		req.Header.Set("Accept", "application/json")
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		var results []map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+			t.Fatalf("%q: %v", query, err)
+		}
+		if len(results) == 0 {
+			t.Errorf("%q: no results", query)
+		}
+		for _, res := range results {
+			if res["valid"] != valid {
+				t.Errorf("%q: %v: got valid %v, want %v", query, res["path"], res["valid"], valid)
+			}
+			if res["mtime"] != "2024-03-01T11:30:00Z" {
+				t.Errorf("%q: %v: got mtime %v, want %v", query, res["path"], res["mtime"], "2024-03-01T11:30:00Z")
+			}
+		}
+	}
+}
+
+// cancelAfter is a context that reports cancellation
+// after its Err method has been called n times.
+type cancelAfter struct {
+	context.Context
+	n int
+}
+
+func (ctx *cancelAfter) Err() error {
+	if ctx.n--; ctx.n < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestQueryCancel(t *testing.T) {
+	dirs := index{}
+	for i := 0; i < 10*cancelCheckInterval; i++ {
+		dirs.index = append(dirs.index, details{
+			fullPath:   fmt.Sprintf("/root/%d/a", i),
+			importPath: fmt.Sprintf("%d/a", i),
+			valid:      true,
+		})
+	}
+
+	ctx := &cancelAfter{Context: context.Background(), n: 3}
+	out, err := dirs.QueryIndex(ctx, "a", kindImports, modeSuffix)
+	if err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+	if want := 3 * cancelCheckInterval; len(out) != want {
+		t.Errorf("got %d partial results, want %d", len(out), want)
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	req, err := http.NewRequest("GET", hostPrefix+"imports/a", nil)
+	if err != nil {
+		t.Errorf("GET %q failed", "imports/a")
+	}
+
+	rec := httptest.NewRecorder()
+	dirs.ServeMux().ServeHTTP(rec, req.WithContext(canceled))
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("canceled query: got status %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
+
+var IndexerImportsTests = []struct {
+	query string
+	out   []string
+}{
+	{"imports/a", []string{"a"}},
+	{"imports/c", []string{"a/b/c"}},
+	{"imports/d", []string{"d", "d/d", "a/b/c/d"}},
+	{"imports/bb", []string{"aa/bb"}},
+	{"imports/c-c", []string{"c-c"}},
+	{"imports/c.c", []string{"c-c/c.c"}},
+}
+
+func TestIndexerImports(t *testing.T) {
+	dirs := index{}
+	dirs.Roots([]string{"testdata"})
+	dirs.Index()
+
+	for _, test := range IndexerImportsTests {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		out := prefixImp(test.out, testdataPrefix)
+
+		if actual := slice(rec.Body.String()); reflect.DeepEqual(actual, out) != true {
+			t.Errorf("%q: got %q, want %q", test.query, actual, out)
+		}
+	}
+}
+
+func TestDuplicateRoots(t *testing.T) {
+	dirs := index{}
+	dirs.Roots([]string{
+		"testdata",
+		"./././testdata",
+	})
+	dirs.Index()
+
+	for _, test := range IndexerImportsTests {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		out := prefixImp(test.out, testdataPrefix)
+
+		if actual := slice(rec.Body.String()); reflect.DeepEqual(actual, out) != true {
+			t.Errorf("%q: got %q, want %q", test.query, actual, out)
+		}
+	}
+}
+
+func TestNonExistentRoot(t *testing.T) {
+	dirs := index{}
+	err := dirs.Roots([]string{
+		"non/existent/path",
+	})
+	if err == nil {
+		t.Errorf("non existent root: Roots should have returned an error")
+	}
+}
+
+func TestNonDirRoot(t *testing.T) {
+	dirs := index{}
+	err := dirs.Roots([]string{
+		"main.go",
+	})
+	if err != os.ErrInvalid {
+		t.Errorf("non dir root: Roots should have returned an error")
+	}
+}
+
+var IndexerDirTests = []struct {
+	query string
+	out   []string
+}{
+	{"a", []string{"/a"}},
+	{"c", []string{"/a/b/c"}},
+	{"d", []string{"/d", "/d/d", "/a/b/c/d"}},
+	{"bb", []string{"/aa/bb"}},
+	{"c-c", []string{"/c-c"}},
+	{"c.c", []string{"/c-c/c.c"}},
+}
+
+func TestIndexerDirs(t *testing.T) {
+	dirs := index{}
+	dirs.Roots([]string{"testdata"})
+	dirs.Index()
+
+	for _, test := range IndexerDirTests {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		out := prefixDir(test.out, dirPrefix)
+
+		if actual := slice(rec.Body.String()); reflect.DeepEqual(actual, out) != true {
+			t.Errorf("%q: got %q, want %q", test.query, actual, out)
+		}
+	}
+}
+
+var HiddenTests = []struct {
+	includeHidden bool
+	out           []string
+}{
+	{false, []string{""}},
+	{true, []string{"/.hidden"}},
+}
+
+func TestHidden(t *testing.T) {
+	query := ".hidden"
+
+	for _, test := range HiddenTests {
+		dirs := index{includeHidden: test.includeHidden}
+		dirs.Roots([]string{"testdata"})
+		dirs.Index()
+
+		req, err := http.NewRequest("GET", hostPrefix+query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", query)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		out := []string{""}
+		if test.out[0] != "" {
+			out = prefixDir(test.out, dirPrefix)
+		}
+
+		if actual := slice(rec.Body.String()); reflect.DeepEqual(actual, out) != true {
+			t.Errorf("%q (include hidden: %v): got %q, want %q", query, test.includeHidden, actual, out)
+		}
+	}
+}
+
+var ExclusionsTests = []struct {
+	query string
+	out   []string
+}{
+	{"imports/a", []string{"a"}},
+	{"imports/c", []string{""}},
+	{"imports/d", []string{"d", "d/d"}},
+	{"imports/bb", []string{"aa/bb"}},
+	{"imports/c-c", []string{"c-c"}},
+	{"imports/c.c", []string{"c-c/c.c"}},
+}
+
+func TestExclusions(t *testing.T) {
+	dirs := index{}
+	dirs.Roots([]string{"testdata"})
+	dirs.Exclusions(strings.NewReader(`b c`))
+	dirs.Index()
+
+	for _, test := range ExclusionsTests {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		out := prefixImp(test.out, testdataPrefix)
+
+		if actual := slice(rec.Body.String()); reflect.DeepEqual(actual, out) != true {
+			t.Errorf("%q: got %q, want %q", test.query, actual, out)
+		}
+	}
+}
+
+func TestExclusionHits(t *testing.T) {
+	gopath := tempGOPATH(t, map[string]string{
+		"example.com/a/vendor/x/x.go":   "package x\n",
+		"example.com/b/vendor/y/y.go":   "package y\n",
+		"example.com/c/testdata/t/t.go": "package t\n",
+		"example.com/old/old.go":        "package old\n",
+		"example.com/old/kept/kept.go":  "package kept\n",
+		"example.com/keep/keep.go":      "package keep\n",
+	})
+
+	dirs := index{}
+	dirs.Roots([]string{filepath.Join(gopath, "src")})
+	dirs.Exclusions(strings.NewReader("vendor testdata vendr !example.com/a/vendor " +
+		"import:example.com/old !import:example.com/old/kept !import:example.com/keep"))
+	dirs.Index()
+
+	req, err := http.NewRequest("GET", hostPrefix+"stats", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	dirs.ServeMux().ServeHTTP(rec, req)
+
+	var s stats
+	if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{
+		"vendor":                       1,
+		"testdata":                     1,
+		"vendr":                        0,
+		"!example.com/a/vendor":        1,
+		"import:example.com/old":       1,
+		"!import:example.com/old/kept": 1,
+		"!import:example.com/keep":     0,
+	}
+	if !reflect.DeepEqual(s.Exclusions, want) {
+		t.Errorf("got exclusion hits %v, want %v", s.Exclusions, want)
+	}
+}
+
+var ImportExclusionsTests = []struct {
+	query string
+	out   []string
+}{
+	{"imports/lib", []string{"example.com/lib", "example.com/new/lib"}},
+	{"imports/internal", []string{"example.com/old/lib/kept/internal"}},
+	{"imports/kept/internal", []string{"example.com/old/lib/kept/internal"}},
+	{"imports/util", []string{"example.com/util"}},
+}
+
+func TestImportExclusions(t *testing.T) {
+	gopath := tempGOPATH(t, map[string]string{
+		"example.com/lib/lib.go":                          "package lib",
+		"example.com/new/lib/lib.go":                      "package lib",
+		"example.com/old/lib/lib.go":                      "package lib",
+		"example.com/old/lib/internal/internal.go":        "package internal",
+		"example.com/old/lib/kept/internal/internal.go":   "package internal",
+		"example.com/old/util/util.go":                    "package util",
+		"example.com/util/util.go":                        "package util",
+		"example.com/oldest/lib/lib.go":                   "package lib",
+		"example.com/vendored/example.com/old/lib/lib.go": "package lib",
+	})
+
+	dirs := index{}
+	dirs.Roots([]string{filepath.Join(gopath, "src")})
+	dirs.Exclusions(strings.NewReader(`
+		import:example.com/old
+		!import:example.com/old/lib/kept/internal
+		import:example.com/oldes?
+		import:*/vendored
+	`))
+	dirs.Index()
+
+	for _, test := range ImportExclusionsTests {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		if actual := slice(rec.Body.String()); !reflect.DeepEqual(actual, test.out) {
+			t.Errorf("%q: got %q, want %q", test.query, actual, test.out)
+		}
+	}
+
+	// Import path rules don't match directory names.
+	if dirs.excluded("example.com/old", "old") {
+		t.Errorf("import path rule should not have excluded the directory")
+	}
+
+	if err := dirs.Exclusions(strings.NewReader("import:")); err == nil {
+		t.Errorf("empty import path should have been an error")
+	}
+}
+
+var ListDirsTests = []struct {
+	query string
+	out   []string
+}{
+	{"imports/lib", []string{"example.com/lib"}},
+	{"imports/util", []string{"example.com/lib/util"}},
+	{"imports/sub", []string{""}},
+	{"imports/other", []string{""}},
+	{"imports/skipped", []string{""}},
+}
+
+func TestListDirs(t *testing.T) {
+	gopath := tempGOPATH(t, map[string]string{
+		"example.com/lib/lib.go":            "package lib",
+		"example.com/lib/sub/sub.go":        "package sub",
+		"example.com/lib/util/util.go":      "package util",
+		"example.com/other/other.go":        "package other",
+		"example.com/skipped/skipped.go":    "package skipped",
+		"example.com/lib/util/more/more.go": "package more",
+	})
+	src := filepath.Join(gopath, "src")
+
+	dirs := index{}
+	dirs.Roots([]string{src})
+	dirs.Exclusions(strings.NewReader("skipped"))
+	list := strings.Join([]string{
+		"# The packages to index.",
+		filepath.Join(src, "example.com", "lib"),
+		"",
+		filepath.Join(src, "example.com", "lib", "util"),
+		filepath.Join(src, "example.com", "skipped"),
+		filepath.Join(src, "example.com", "missing"),
+	}, "\n")
+	if err := dirs.ListDirs(strings.NewReader(list)); err != nil {
+		t.Fatal(err)
+	}
+	dirs.Index()
+
+	if n := dirs.Len(); n != 2 {
+		t.Errorf("got %d indexed directories, want 2", n)
+	}
+	for _, test := range ListDirsTests {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		if actual := slice(rec.Body.String()); !reflect.DeepEqual(actual, test.out) {
+			t.Errorf("%q: got %q, want %q", test.query, actual, test.out)
+		}
+	}
+}
+
+// tempTree creates a temporary directory with a Go package
+// in each of the slash separated subdirectories.
+func tempTree(t *testing.T, dirs ...string) string {
+	root := t.TempDir()
+	for _, dir := range dirs {
+		dir = filepath.Join(root, filepath.FromSlash(dir))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		src := "package " + filepath.Base(dir) + "\n"
+		if err := ioutil.WriteFile(filepath.Join(dir, "x.go"), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+var NegatedExclusionsTests = []struct {
+	exclusions string
+	out        []string
+}{
+	{"testdata", []string{""}},
+	{"testdata !pkg/foo/testdata", []string{"/pkg/foo/testdata"}},
+	{"testdata !/pkg/foo/testdata/", []string{"/pkg/foo/testdata"}},
+	{"testdata !testdata", []string{"/a/testdata", "/pkg/bar/testdata", "/pkg/foo/testdata"}},
+	{"testdata !pkg/*/testdata", []string{"/pkg/bar/testdata", "/pkg/foo/testdata"}},
+	{"test* !pkg/[f]oo/testdata", []string{"/pkg/foo/testdata"}},
+
+	// Later rules take precedence.
+	{"!pkg/foo/testdata testdata", []string{""}},
+	{"testdata !pkg/foo/testdata pkg", []string{""}},
+}
+
+func TestNegatedExclusions(t *testing.T) {
+	root := tempTree(t,
+		"a/testdata",
+		"pkg/bar/testdata",
+		"pkg/foo/testdata",
+	)
+	query := "dirs/testdata"
+
+	for _, test := range NegatedExclusionsTests {
+		dirs := index{}
+		dirs.Roots([]string{root})
+		dirs.Exclusions(strings.NewReader(test.exclusions))
+		dirs.Index()
+
+		req, err := http.NewRequest("GET", hostPrefix+query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", query)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		out := []string{""}
+		if test.out[0] != "" {
+			out = prefixDir(test.out, root)
+		}
+
+		if actual := slice(rec.Body.String()); reflect.DeepEqual(actual, out) != true {
+			t.Errorf("%q: got %q, want %q", test.exclusions, actual, out)
+		}
+	}
+}
+
+var PathExclusionsTests = []struct {
+	exclusions string
+	out        []string
+}{
+	{"", []string{"/a/b/generated", "/a/generated", "/c", "/generated", "/third_party/x/y"}},
+	{"third_party/**", []string{"/a/b/generated", "/a/generated", "/c", "/generated"}},
+	{"*/generated", []string{"/a/b/generated", "/c", "/generated", "/third_party/x/y"}},
+	{"**/generated", []string{"/c", "/third_party/x/y"}},
+	{"a/b", []string{"/a/generated", "/c", "/generated", "/third_party/x/y"}},
+
+	// Base names.
+	{"generated", []string{"/c", "/third_party/x/y"}},
+	{"b y", []string{"/a/generated", "/c", "/generated"}},
+
+	// Depths below the root.
+	{"depth:1:generated", []string{"/a/b/generated", "/a/generated", "/c", "/third_party/x/y"}},
+	{"depth:2:generated", []string{"/a/b/generated", "/c", "/generated", "/third_party/x/y"}},
+	{"depth:2:*", []string{"/c", "/generated"}},
+	{"generated !depth:3:generated", []string{"/a/b/generated", "/c", "/third_party/x/y"}},
+	{"depth:2:a/generated", []string{"/a/b/generated", "/c", "/generated", "/third_party/x/y"}},
+	{"depth:3:a/generated", []string{"/a/b/generated", "/a/generated", "/c", "/generated", "/third_party/x/y"}},
+}
+
+func TestPathExclusions(t *testing.T) {
+	root := tempTree(t,
+		"a/b/generated",
+		"a/generated",
+		"c",
+		"generated",
+		"third_party/x/y",
+	)
+	query := "dirs/?mode=substring"
+
+	for _, test := range PathExclusionsTests {
+		dirs := index{}
+		dirs.Roots([]string{root})
+		dirs.Exclusions(strings.NewReader(test.exclusions))
+		dirs.Index()
+
+		req, err := http.NewRequest("GET", hostPrefix+query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", query)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		out := prefixDir(test.out, root)
+
+		// Equal scores are ordered by length; the order doesn't matter here.
+		actual := slice(rec.Body.String())
+		sort.Strings(actual)
+		if reflect.DeepEqual(actual, out) != true {
+			t.Errorf("%q: got %q, want %q", test.exclusions, actual, out)
+		}
+	}
+}
+
+func TestExclusionDepthErrors(t *testing.T) {
+	for _, rule := range []string{"depth:", "depth:1", "depth:x:a", "depth:0:a", "!depth:-1:a"} {
+		dirs := index{}
+		if err := dirs.Exclusions(strings.NewReader(rule)); err == nil {
+			t.Errorf("%q: got no error", rule)
+		}
+	}
+}
+
+func TestExclusionRegexps(t *testing.T) {
+	root := tempTree(t,
+		"m/internal",
+		"m/v2/internal/x",
+		"m/v2/pkg",
+		"m/v10/internal",
+		"m/vendor/v2/internal",
+	)
+	query := "dirs/?mode=substring"
+
+	dirs := index{}
+	dirs.Roots([]string{root})
+	if err := dirs.ExclusionRegexps(strings.NewReader("/v[0-9]+/internal/\n\n/vendor/\n")); err != nil {
+		t.Fatal(err)
+	}
+	dirs.Index()
+
+	req, err := http.NewRequest("GET", hostPrefix+query, nil)
+	if err != nil {
+		t.Errorf("GET %q failed", query)
+	}
+
+	rec := httptest.NewRecorder()
+	dirs.ServeMux().ServeHTTP(rec, req)
+
+	out := prefixDir([]string{"/m/v2/pkg", "/m/internal"}, root)
+
+	if actual := slice(rec.Body.String()); reflect.DeepEqual(actual, out) != true {
+		t.Errorf("got %q, want %q", actual, out)
+	}
+
+	err = dirs.ExclusionRegexps(strings.NewReader("/vendor/\n/v[0-9+/internal/\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "line 2:") {
+		t.Errorf("invalid regexp: got error %v, want an error on line 2", err)
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	dirs := index{index: QueryTestDetails, cache: newCache(2)}
+
+	for _, query := range []string{
+		"imports/a", // Miss.
+		"imports/a", // Hit.
+		"imports/b", // Miss.
+		"dirs/a",    // Miss, evicts "imports/a".
+		"imports/a", // Miss, evicts "imports/b".
+		"dirs/a",    // Hit.
+	} {
+		req, err := http.NewRequest("GET", hostPrefix+query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", query)
+		}
+
+		dirs.ServeMux().ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	req, err := http.NewRequest("GET", hostPrefix+"stats", nil)
+	if err != nil {
+		t.Errorf("GET %q failed", "stats")
+	}
+
+	rec := httptest.NewRecorder()
+	dirs.ServeMux().ServeHTTP(rec, req)
+
+	var actual stats
+	if err := json.Unmarshal(rec.Body.Bytes(), &actual); err != nil {
+		t.Fatalf("can't decode %q: %v", rec.Body.String(), err)
+	}
+
+	out := cacheStats{Size: 2, Entries: 2, Hits: 2, Misses: 4, Evictions: 2}
+	if actual.Cache != out {
+		t.Errorf("got %+v, want %+v", actual.Cache, out)
+	}
+	if actual.Directories != len(QueryTestDetails) {
+		t.Errorf("got %d directories, want %d", actual.Directories, len(QueryTestDetails))
+	}
+	if actual.Goroutines <= 0 {
+		t.Errorf("got %d goroutines, want the running ones", actual.Goroutines)
+	}
+}
+
+func TestCacheUpdate(t *testing.T) {
+	dirs := index{cache: newCache(10)}
+	dirs.Roots([]string{"testdata"})
+	dirs.Index()
+
+	query := "dirs/a"
+	for _, path := range []string{query, "update", query} {
+		method := "GET"
+		if path == "update" {
+			method = "POST"
+		}
+		req, err := http.NewRequest(method, hostPrefix+path, nil)
+		if err != nil {
+			t.Errorf("%s %q failed", method, path)
+		}
+
+		dirs.ServeMux().ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// Reindexing clears the cache.
+	out := cacheStats{Size: 10, Entries: 1, Hits: 0, Misses: 2}
+	if actual := dirs.cache.stats(); actual != out {
+		t.Errorf("got %+v, want %+v", actual, out)
+	}
+}
+
+func TestCacheDisabled(t *testing.T) {
+	dirs := index{index: QueryTestDetails, cache: newCache(0)}
+
+	req, err := http.NewRequest("GET", hostPrefix+"imports/a", nil)
+	if err != nil {
+		t.Errorf("GET %q failed", "imports/a")
+	}
+	dirs.ServeMux().ServeHTTP(httptest.NewRecorder(), req)
+
+	if actual := dirs.cache.stats(); actual != (cacheStats{}) {
+		t.Errorf("got %+v, want no cache activity", actual)
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	dirs := index{index: QueryTestDetails, cache: newCache(10)}
+
+	keys, err := parsePrefetch(strings.NewReader(`
+		# Common queries.
+		imports/a
+		/dirs/a?mode=prefix
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := dirs.Prefetch(keys); n != 2 {
+		t.Errorf("prefetched %d queries, want 2", n)
+	}
+
+	for _, query := range []string{"imports/a", "dirs/a?mode=prefix&stdlib=false"} {
+		req, err := http.NewRequest("GET", hostPrefix+query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", query)
+		}
+
+		dirs.ServeMux().ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// Both requests are answered from the cache.
+	out := cacheStats{Size: 10, Entries: 2, Hits: 2, Misses: 2}
+	if actual := dirs.cache.stats(); actual != out {
+		t.Errorf("got %+v, want %+v", actual, out)
+	}
+
+	for _, list := range []string{"a", "imports", "/imports", "lists/a", "dirs/a?mode=unknown"} {
+		if _, err := parsePrefetch(strings.NewReader(list)); err == nil {
+			t.Errorf("%q: parsePrefetch should have returned an error", list)
+		}
+	}
+}
+
+func TestQueryNotReady(t *testing.T) {
+	dirs := index{}
+	dirs.Roots([]string{"testdata"})
+
+	for _, test := range []struct {
+		index bool
+		code  int
+	}{
+		{false, http.StatusServiceUnavailable},
+		{true, http.StatusOK},
+	} {
+		if test.index {
+			dirs.Index()
+		}
+
+		for _, query := range []string{"a", "dirs/a", "imports/a"} {
+			req, err := http.NewRequest("GET", hostPrefix+query, nil)
+			if err != nil {
+				t.Errorf("GET %q failed", query)
+			}
+
+			rec := httptest.NewRecorder()
+			dirs.ServeMux().ServeHTTP(rec, req)
+
+			if rec.Code != test.code {
+				t.Errorf("%q (indexed: %v): got status %d, want %d", query, test.index, rec.Code, test.code)
+			}
+		}
+	}
+}
+
+func TestQueryWaitReady(t *testing.T) {
+	query := "dirs/a"
+
+	dirs := index{waitReady: 5 * time.Second}
+	dirs.Roots([]string{"testdata"})
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		req, err := http.NewRequest("GET", hostPrefix+query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", query)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+		done <- rec
+	}()
+
+	// A slow first index.
+	time.Sleep(50 * time.Millisecond)
+	dirs.Index()
+
+	rec := <-done
+	if rec.Code != http.StatusOK {
+		t.Errorf("%q: got status %d, want %d", query, rec.Code, http.StatusOK)
+	}
+
+	out := prefixDir([]string{"/a"}, dirPrefix)
+	if actual := slice(rec.Body.String()); reflect.DeepEqual(actual, out) != true {
+		t.Errorf("%q: got %q, want %q", query, actual, out)
+	}
+
+	// The wait times out.
+	dirs = index{waitReady: 10 * time.Millisecond}
+
+	req, err := http.NewRequest("GET", hostPrefix+query, nil)
+	if err != nil {
+		t.Errorf("GET %q failed", query)
+	}
+
+	rec = httptest.NewRecorder()
+	dirs.ServeMux().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("%q: got status %d, want %d", query, rec.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestWarmLog(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(ioutil.Discard)
+		log.SetFlags(log.LstdFlags)
+	}()
+
+	dirs := index{}
+	dirs.Roots([]string{"testdata"})
+	warm(&dirs, []string{"127.0.0.1:6118", "unix:/tmp/gopaths.sock"}, 0, nil)
+
+	lines := slice(buf.String())
+	if len(lines) != 3 {
+		t.Fatalf("got log lines %q, want 3 lines", lines)
+	}
+	if !strings.HasPrefix(lines[0], "Indexed ") {
+		t.Errorf("got first line %q, want the indexing summary", lines[0])
+	}
+
+	for i, addr := range []string{"127.0.0.1:6118", "unix:/tmp/gopaths.sock"} {
+		ready := fmt.Sprintf("ready addr=%s directories=%d duration=", addr, dirs.Len())
+		if !strings.HasPrefix(lines[1+i], ready) {
+			t.Errorf("got line %q, want it to begin with %q", lines[1+i], ready)
+		}
+	}
+}
+
+func TestWarmListen(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix sockets may be unsupported")
+	}
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(ioutil.Discard)
+		log.SetFlags(log.LstdFlags)
+	}()
+
+	// Try connecting while the index is being built.
+	sock := filepath.Join(t.TempDir(), "gopaths.sock")
+	connected := false
+	defer func(f func(string) (*build.Package, error)) { importDir = f }(importDir)
+	imported := importDir
+	importDir = func(dir string) (*build.Package, error) {
+		if c, err := net.Dial("unix", sock); err == nil {
+			c.Close()
+			connected = true
+		}
+		return imported(dir)
+	}
+
+	dirs := index{}
+	dirs.Roots([]string{"testdata"})
+	listeners, err := warmListen(&dirs, "unix:"+sock, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listeners[0].Close()
+
+	if connected {
+		t.Errorf("connected before the index was built")
+	}
+	c, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatalf("connecting after the index was built: %v", err)
+	}
+	c.Close()
+
+	lines := slice(buf.String())
+	ready := fmt.Sprintf("ready addr=unix:%s directories=%d duration=", sock, dirs.Len())
+	if last := lines[len(lines)-1]; !strings.HasPrefix(last, ready) {
+		t.Errorf("got last line %q, want it to begin with %q", last, ready)
+	}
+}
+
+func TestIndexDeadline(t *testing.T) {
+	root := tempTree(t, "a/b/c/d", "x")
+	deadline := 10 * time.Millisecond
+
+	// Walking a/b takes past the deadline, and a/b/c until released.
+	release := make(chan struct{})
+	defer func(readDir func(string) ([]os.FileInfo, error)) { build.Default.ReadDir = readDir }(build.Default.ReadDir)
+	build.Default.ReadDir = func(dir string) ([]os.FileInfo, error) {
+		switch dir {
+		case filepath.Join(root, "a", "b"):
+			time.Sleep(2 * deadline)
+		case filepath.Join(root, "a", "b", "c"):
+			<-release
+		}
+		return ioutil.ReadDir(dir)
+	}
+
+	dirs := index{}
+	dirs.Roots([]string{root})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		dirs.IndexWithin(deadline)
+	}()
+
+	query := func(query string) []string {
+		t.Helper()
+		req, err := http.NewRequest("GET", hostPrefix+query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", query)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		// The number of goroutines varies.
+		return slice(regexp.MustCompile(`,"goroutines":[0-9]+`).ReplaceAllString(rec.Body.String(), ""))
+	}
+
+	if err := dirs.WaitReady(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		query string
+		out   []string
+	}{
+		{"dirs/x", prefixDir([]string{"/x"}, root)},
+		{"dirs/b", prefixDir([]string{"/a/b"}, root)},
+		{"dirs/c", []string{""}},
+		{"stats", []string{`{"directories":4,"files":0,"fileBytes":0,"cache":{"size":0,"entries":0,"hits":0,"misses":0,"evictions":0},"partial":true}`}},
+	} {
+		if actual := query(test.query); !reflect.DeepEqual(actual, test.out) {
+			t.Errorf("partial %q: got %q, want %q", test.query, actual, test.out)
+		}
+	}
+
+	close(release)
+	<-done
+	for _, test := range []struct {
+		query string
+		out   []string
+	}{
+		{"dirs/c", prefixDir([]string{"/a/b/c"}, root)},
+		{"dirs/d", prefixDir([]string{"/a/b/c/d"}, root)},
+		{"stats", []string{`{"directories":6,"files":2,"fileBytes":20,"cache":{"size":0,"entries":0,"hits":0,"misses":0,"evictions":0}}`}},
+	} {
+		if actual := query(test.query); !reflect.DeepEqual(actual, test.out) {
+			t.Errorf("complete %q: got %q, want %q", test.query, actual, test.out)
+		}
+	}
+}
+
+var CollisionsTestDetails = []details{
+	{fullPath: "/root1/src/x/y", importPath: "x/y", valid: true},
+	{fullPath: "/root1/src/x/z", importPath: "x/z", valid: true},
+	{fullPath: "/root2/src/x/y", importPath: "x/y", valid: true},
+	{fullPath: "/root2/src/x/z", importPath: "x/z", valid: false},
+	{fullPath: "/root3/src/x/y", importPath: "x/y", valid: true},
+	{fullPath: "/elsewhere/a", importPath: ".", valid: true},
+	{fullPath: "/elsewhere/b", importPath: ".", valid: true},
+}
+
+func TestCollisions(t *testing.T) {
+	dirs := index{index: CollisionsTestDetails}
+
+	req, err := http.NewRequest("GET", hostPrefix+"collisions", nil)
+	if err != nil {
+		t.Errorf("GET %q failed", "collisions")
+	}
+
+	rec := httptest.NewRecorder()
+	dirs.ServeMux().ServeHTTP(rec, req)
+
+	var actual map[string][]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &actual); err != nil {
+		t.Fatalf("can't decode %q: %v", rec.Body.String(), err)
+	}
+
+	out := map[string][]string{
+		"x/y": {"/root1/src/x/y", "/root2/src/x/y", "/root3/src/x/y"},
+	}
+	if reflect.DeepEqual(actual, out) != true {
+		t.Errorf("got %q, want %q", actual, out)
+	}
+}
+
+var ConflictsTestDetails = []details{
+	{fullPath: "/src/vanity/x", importPath: "vanity.org/x", valid: true},
+	{fullPath: "/src/vanity/x", importPath: ".", valid: true},
+	{fullPath: "/src/vanity/x", importPath: "example.com/vanity/x", valid: true},
+	{fullPath: "/src/vanity/x", importPath: "vanity.org/x", valid: true},
+	{fullPath: "/src/example.com/y", importPath: "example.com/y", valid: true},
+}
+
+func TestConflicts(t *testing.T) {
+	reversed := []details{}
+	for i := len(ConflictsTestDetails) - 1; i >= 0; i-- {
+		reversed = append(reversed, ConflictsTestDetails[i])
+	}
+
+	// The chosen import path doesn't depend on the order of the entries.
+	for _, entries := range [][]details{ConflictsTestDetails, reversed} {
+		dirs := index{}
+		dirs.Load(entries)
+
+		get := func(query string) *httptest.ResponseRecorder {
+			req, err := http.NewRequest("GET", hostPrefix+query, nil)
+			if err != nil {
+				t.Fatalf("GET %q failed", query)
+			}
+			rec := httptest.NewRecorder()
+			dirs.ServeMux().ServeHTTP(rec, req)
+			return rec
+		}
+
+		var actual map[string][]string
+		rec := get("conflicts")
+		if err := json.Unmarshal(rec.Body.Bytes(), &actual); err != nil {
+			t.Fatalf("can't decode %q: %v", rec.Body.String(), err)
+		}
+		out := map[string][]string{
+			"/src/vanity/x": {"example.com/vanity/x", "vanity.org/x", "."},
+		}
+		if !reflect.DeepEqual(actual, out) {
+			t.Errorf("got conflicts %q, want %q", actual, out)
+		}
+
+		for _, test := range []struct {
+			query string
+			out   []string
+		}{
+			{"imports/x", []string{"example.com/vanity/x"}},
+			{"imports/vanity.org/x", []string{""}},
+			{"imports/y", []string{"example.com/y"}},
+			{"dirs/x", []string{"/src/vanity/x"}},
+		} {
+			if actual := slice(get(test.query).Body.String()); !reflect.DeepEqual(actual, test.out) {
+				t.Errorf("%q: got %q, want %q", test.query, actual, test.out)
+			}
+		}
+	}
+}
+
+func TestConflictsSymlink(t *testing.T) {
+	gopath := tempGOPATH(t, map[string]string{
+		"example.com/lib/lib.go": "package lib\n",
+	})
+
+	// The second GOPATH entry links to the first one's example.com,
+	// so that its root reaches example.com/lib as vendored.com/lib.
+	linked := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(linked, "src"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(gopath, "src", "example.com"), filepath.Join(linked, "src", "vendored.com")); err != nil {
+		t.Skipf("can't create symlinks: %v", err)
+	}
+	build.Default.GOPATH = linked + string(os.PathListSeparator) + gopath
+
+	dirs := index{}
+	dirs.Roots([]string{filepath.Join(gopath, "src"), filepath.Join(linked, "src", "vendored.com", "lib")})
+	dirs.Index()
+
+	real, err := filepath.EvalSymlinks(filepath.Join(gopath, "src", "example.com", "lib"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual, out := dirs.Conflicts(), map[string][]string{real: {"example.com/lib", "vendored.com/lib"}}; !reflect.DeepEqual(actual, out) {
+		t.Errorf("got conflicts %q, want %q", actual, out)
+	}
+
+	for query, out := range map[string][]string{
+		"imports/lib":              {"example.com/lib"},
+		"imports/vendored.com/lib": {""},
+	} {
+		req, err := http.NewRequest("GET", hostPrefix+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+		if actual := slice(rec.Body.String()); !reflect.DeepEqual(actual, out) {
+			t.Errorf("%q: got %q, want %q", query, actual, out)
+		}
+	}
+}
+
+func TestConflictsPartial(t *testing.T) {
+	gopath := tempGOPATH(t, map[string]string{
+		"example.com/lib/lib.go":              "package lib\n",
+		"example.com/slow/later/later.go":     "package later\n",
+		"example.com/slow/later/last/last.go": "package last\n",
+	})
+	linked := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(linked, "src"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(gopath, "src", "example.com"), filepath.Join(linked, "src", "vendored.com")); err != nil {
+		t.Skipf("can't create symlinks: %v", err)
+	}
+	build.Default.GOPATH = linked + string(os.PathListSeparator) + gopath
+
+	// Importing later takes past the deadline, and last until released,
+	// after both import paths of lib are indexed.
+	deadline := 10 * time.Millisecond
+	later := filepath.Join(gopath, "src", "example.com", "slow", "later")
+	release := make(chan struct{})
+	defer func(f func(string) (*build.Package, error)) { importDir = f }(importDir)
+	imported := importDir
+	importDir = func(dir string) (*build.Package, error) {
+		switch dir {
+		case later:
+			time.Sleep(2 * deadline)
+		case filepath.Join(later, "last"):
+			<-release
+		}
+		return imported(dir)
+	}
+
+	dirs := index{}
+	dirs.Roots([]string{filepath.Join(gopath, "src"), filepath.Join(linked, "src", "vendored.com", "lib")})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		dirs.IndexWithin(deadline)
+	}()
+	defer func() {
+		close(release)
+		<-done
+	}()
+	if err := dirs.WaitReady(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for query, out := range map[string][]string{
+		"imports/lib":              {"example.com/lib"},
+		"imports/vendored.com/lib": {""},
+	} {
+		req, err := http.NewRequest("GET", hostPrefix+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+		if actual := slice(rec.Body.String()); !reflect.DeepEqual(actual, out) {
+			t.Errorf("partial %q: got %q, want %q", query, actual, out)
+		}
+	}
+}
+
+var MismatchesTestDetails = []details{
+	{fullPath: "/root/src/x/foo", importPath: "x/foo", valid: true},
+	{fullPath: "/root/src/x/bar", importPath: "x/baz", valid: true},
+	{fullPath: "/root/src/x/bar/v2", importPath: "x/bar/v2", valid: true},
+	{fullPath: "/root/src/renamed", importPath: "vanity.org/pkg", valid: true},
+	{fullPath: "/root/src/x/qux", importPath: "x/quux", valid: false},
+	{fullPath: "/elsewhere/a", importPath: ".", valid: true},
+}
+
+func TestMismatches(t *testing.T) {
+	dirs := index{index: MismatchesTestDetails}
+
+	req, err := http.NewRequest("GET", hostPrefix+"mismatches", nil)
+	if err != nil {
+		t.Errorf("GET %q failed", "mismatches")
+	}
+
+	rec := httptest.NewRecorder()
+	dirs.ServeMux().ServeHTTP(rec, req)
+
+	var actual []mismatch
+	if err := json.Unmarshal(rec.Body.Bytes(), &actual); err != nil {
+		t.Fatalf("can't decode %q: %v", rec.Body.String(), err)
+	}
+
+	out := []mismatch{
+		{"x/baz", "/root/src/x/bar"},
+		{"vanity.org/pkg", "/root/src/renamed"},
+	}
+	if reflect.DeepEqual(actual, out) != true {
+		t.Errorf("got %q, want %q", actual, out)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	root := tempTree(t,
+		".hidden",
+		"a/b",
+		"testdata/c",
+		"x",
+	)
+
+	dirs := index{}
+	dirs.Roots([]string{root})
+	dirs.Exclusions(strings.NewReader("testdata"))
+
+	var buf bytes.Buffer
+	dirs.DryRun(&buf)
+
+	out := []string{
+		"skipped-no-go\t" + root,
+		"skipped-excluded\t" + filepath.Join(root, ".hidden"),
+		"skipped-no-go\t" + filepath.Join(root, "a"),
+		"indexed\t" + filepath.Join(root, "a", "b"),
+		"skipped-excluded\t" + filepath.Join(root, "testdata"),
+		"indexed\t" + filepath.Join(root, "x"),
+	}
+	if actual := slice(buf.String()); reflect.DeepEqual(actual, out) != true {
+		t.Errorf("got %q, want %q", actual, out)
+	}
+
+	if dirs.Ready() {
+		t.Errorf("dry run should not have built the index")
+	}
+}
+
+func TestDryRunListed(t *testing.T) {
+	root := tempTree(t,
+		"a/b",
+		"testdata/c",
+		"x",
+	)
+
+	dirs := index{}
+	dirs.Roots([]string{root})
+	dirs.Exclusions(strings.NewReader("testdata"))
+	listed := strings.Join([]string{
+		filepath.Join(root, "a", "b"),
+		filepath.Join(root, "testdata"),
+		filepath.Join(root, "missing"),
+	}, "\n")
+	if err := dirs.ListDirs(strings.NewReader(listed)); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	dirs.DryRun(&buf)
+
+	lines := slice(buf.String())
+	out := []string{
+		"indexed\t" + filepath.Join(root, "a", "b"),
+		"skipped-excluded\t" + filepath.Join(root, "testdata"),
+		"unreadable\t" + filepath.Join(root, "missing") + "\t",
+	}
+	if len(lines) != len(out) {
+		t.Fatalf("got %q, want the lines starting with %q", lines, out)
+	}
+	for i, line := range out {
+		if !strings.HasPrefix(lines[i], line) {
+			t.Errorf("got %q, want it to start with %q", lines[i], line)
+		}
+	}
+}
+
+// TestUnreadableDir walks a directory whose permissions deny listing it.
+// (The Windows tests deny it with an ACL.)
+func TestUnreadableDir(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		t.Skip("permissions aren't enforced")
+	}
+
+	root := tempTree(t, "a", "b/c", "d")
+	denied := filepath.Join(root, "b")
+	if err := os.Chmod(denied, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(denied, 0755)
+
+	testUnreadableDir(t, root, denied)
+}
+
+// testUnreadableDir checks that indexing and dry runs skip the contents
+// of the denied directory under root, and go on with the rest.
+func testUnreadableDir(t *testing.T, root, denied string) {
+	dirs := index{}
+	dirs.Roots([]string{root})
+	dirs.Index()
+
+	indexed := []string{}
+	for _, c := range dirs.index {
+		indexed = append(indexed, c.fullPath)
+	}
+	want := []string{root, filepath.Join(root, "a"), denied, filepath.Join(root, "d")}
+	if !reflect.DeepEqual(indexed, want) {
+		t.Errorf("got %q indexed, want %q", indexed, want)
+	}
+
+	var buf bytes.Buffer
+	dirs.DryRun(&buf)
+
+	lines := slice(buf.String())
+	for _, line := range []string{
+		"indexed\t" + filepath.Join(root, "a"),
+		"unreadable\t" + denied + "\t",
+		"indexed\t" + filepath.Join(root, "d"),
+	} {
+		found := false
+		for _, l := range lines {
+			found = found || strings.HasPrefix(l, line)
+		}
+		if !found {
+			t.Errorf("dry run: got %q, want a line beginning with %q", lines, line)
+		}
+	}
+}
+
+func TestQueryUpdate(t *testing.T) {
+	dirs := index{}
+	dirs.Roots([]string{"testdata"})
+	dirs.Index()
+
+	query := "update"
+
+	req, err := http.NewRequest("POST", hostPrefix+query, nil)
+	if err != nil {
+		t.Errorf("POST %q failed", query)
+	}
+
+	rec := httptest.NewRecorder()
+	dirs.ServeMux().ServeHTTP(rec, req)
+
+	out := []string{""}
+
+	if actual := slice(rec.Body.String()); reflect.DeepEqual(actual, out) != true {
+		t.Errorf("%q: got %q, want %q", query, actual, out)
+	}
+}
+
+var UpdateAccessTests = []struct {
+	disableUpdate bool
+	updateToken   string
+	auth          string
+	code          int
+}{
+	{false, "", "", http.StatusOK},
+	{true, "", "", http.StatusForbidden},
+	{true, "secret", "Bearer secret", http.StatusForbidden},
+	{false, "secret", "", http.StatusUnauthorized},
+	{false, "secret", "Bearer wrong", http.StatusUnauthorized},
+	{false, "secret", "Basic secret", http.StatusUnauthorized},
+	{false, "secret", "Bearer secret", http.StatusOK},
+}
+
+func TestUpdateAccess(t *testing.T) {
+	query := "update"
+
+	for _, test := range UpdateAccessTests {
+		dirs := index{
+			disableUpdate: test.disableUpdate,
+			updateToken:   test.updateToken,
+		}
+
+		req, err := http.NewRequest("POST", hostPrefix+query, nil)
+		if err != nil {
+			t.Errorf("POST %q failed", query)
+		}
+		if test.auth != "" {
+			req.Header.Set("Authorization", test.auth)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		if rec.Code != test.code {
+			t.Errorf("%+v: got status %d, want %d", test, rec.Code, test.code)
+		}
+		if indexed := rec.Code == http.StatusOK; dirs.Ready() != indexed {
+			t.Errorf("%+v: got indexed %v, want %v", test, dirs.Ready(), indexed)
+		}
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	one := tempTree(t, "one/keep", "one/skip")
+	two := tempTree(t, "two/keep", "two/skip")
+
+	dirs := index{}
+	dirs.Roots([]string{one})
+	dirs.Exclusions(strings.NewReader("keep"))
+	dirs.Index()
+
+	post := func(body string) int {
+		req, err := http.NewRequest("POST", hostPrefix+"config", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+		return rec.Code
+	}
+	query := func(query string) []string {
+		req, err := http.NewRequest("GET", hostPrefix+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+		return slice(rec.Body.String())
+	}
+
+	// Both the roots and the exclusions change, with a single reindex.
+	body, err := json.Marshal(configBody{Roots: []string{two}, Exclusions: []string{"skip"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := post(string(body)); code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", code, http.StatusOK)
+	}
+	if dirs.indexRuns != 2 {
+		t.Errorf("got %d indexing runs, want 2", dirs.indexRuns)
+	}
+	for q, out := range map[string][]string{
+		"dirs/keep": {filepath.Join(two, "two", "keep")},
+		"dirs/skip": {""},
+		"dirs/one":  {""},
+	} {
+		if actual := query(q); !reflect.DeepEqual(actual, out) {
+			t.Errorf("%q: got %q, want %q", q, actual, out)
+		}
+	}
+
+	// Neither is replaced, nor the index updated, if either is invalid.
+	for _, body := range []string{
+		`{"roots": ["` + filepath.ToSlash(filepath.Join(two, "missing")) + `"], "exclusions": ["keep"]}`,
+		`{"roots": ["` + filepath.ToSlash(one) + `"], "exclusions": ["depth:x:keep"]}`,
+		`{"roots": [], "exclusions": ["keep"]}`,
+		`{"roots": ["` + filepath.ToSlash(one) + `"], "excluded": ["keep"]}`,
+	} {
+		if code := post(body); code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", body, code, http.StatusBadRequest)
+		}
+	}
+	if dirs.indexRuns != 2 {
+		t.Errorf("got %d indexing runs, want 2", dirs.indexRuns)
+	}
+	if !reflect.DeepEqual(dirs.rootDirs, []string{two}) || len(dirs.exclusions) != 1 || dirs.exclusions[0].rule != "skip" {
+		t.Errorf("got roots %q and exclusions %+v, want the posted ones kept", dirs.rootDirs, dirs.exclusions)
+	}
+
+	dirs.frozen = true
+	if code := post(string(body)); code != http.StatusForbidden {
+		t.Errorf("frozen: got status %d, want %d", code, http.StatusForbidden)
+	}
+}
+
+var QueryTokensTests = []struct {
+	query string
+	auth  string
+	code  int
+	out   []string
+}{
+	{"imports/x", "", http.StatusUnauthorized, nil},
+	{"imports/x", "Bearer wrong", http.StatusUnauthorized, nil},
+	{"imports/x", "Bearer nobody", http.StatusForbidden, nil},
+	{"imports/x", "Bearer alice", http.StatusOK, []string{"a.com/x"}},
+	{"imports/x", "Bearer bob", http.StatusOK, []string{"b.com/x", "c.com/x"}},
+	{"dirs/x", "Bearer alice", http.StatusOK, []string{"/tenant1/src/a.com/x"}},
+	{"imports/x?count=true", "Bearer bob", http.StatusOK, []string{"2"}},
+	{"basename/x", "Bearer alice", http.StatusOK, []string{"/tenant1/src/a.com/x"}},
+	{"importdir/a.com/x", "Bearer alice", http.StatusOK, []string{"/tenant1/src/a.com/x"}},
+	{"importdir/b.com/x", "Bearer alice", http.StatusNotFound, nil},
+	{"resolve/tenant2/src/b.com/x", "Bearer alice", http.StatusNotFound, nil},
+	{"resolve/tenant2/src/b.com/x", "Bearer bob", http.StatusOK, []string{"b.com/x"}},
+	{"recent/?limit=1", "Bearer bob", http.StatusOK, []string{"/tenant2/src/b.com/x"}},
+	{"all/imports", "Bearer alice", http.StatusOK, []string{"a.com/x"}},
+	{"stats", "", http.StatusUnauthorized, nil},
+	{"roots", "", http.StatusUnauthorized, nil},
+	{"stats", "Bearer alice", http.StatusOK, nil},
+}
+
+func TestQueryTokens(t *testing.T) {
+	now := time.Now()
+	dirs := index{index: []details{
+		{fullPath: "/tenant1/src/a.com/x", importPath: "a.com/x", valid: true, modTime: now.Add(-3 * time.Hour)},
+		{fullPath: "/tenant2/src/b.com/x", importPath: "b.com/x", valid: true, modTime: now.Add(-2 * time.Hour)},
+		{fullPath: "/tenant3/src/c.com/x", importPath: "c.com/x", valid: true, modTime: now.Add(-4 * time.Hour)},
+		{fullPath: "/tenant4/src/d.com/x", importPath: "d.com/x", valid: true, modTime: now},
+	}}
+	err := dirs.QueryTokens(strings.NewReader(`
+		# Tenants.
+		alice /tenant1
+		bob   /tenant2 /tenant3/src
+		nobody
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range QueryTokensTests {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+		if test.auth != "" {
+			req.Header.Set("Authorization", test.auth)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		if rec.Code != test.code {
+			t.Errorf("%q %q: got status %d, want %d", test.query, test.auth, rec.Code, test.code)
+			continue
+		}
+		if test.out == nil {
+			continue
+		}
+		if actual := slice(rec.Body.String()); !reflect.DeepEqual(actual, test.out) {
+			t.Errorf("%q %q: got %q, want %q", test.query, test.auth, actual, test.out)
+		}
+	}
+
+	if err := dirs.QueryTokens(strings.NewReader("alice /a\nalice /b")); err == nil {
+		t.Errorf("duplicate token should have been an error")
+	}
+}
+
+func TestQueryTokensScope(t *testing.T) {
+	dirs := index{index: []details{
+		{fullPath: "/tenant1/src/a.com/y", importPath: "a.com/y"},
+		{fullPath: "/tenant1/src/a.com/y/z", importPath: "a.com/y/z", valid: true},
+		{fullPath: "/tenant1/src/a.com/dup", importPath: "dup.com/dup", valid: true},
+		{fullPath: "/tenant2/src/b.com/y", importPath: "b.com/y", valid: true},
+		{fullPath: "/tenant2/src/secret.com/xy", importPath: "secret.com/xy", valid: true},
+		{fullPath: "/tenant2/src/secret.com/dup", importPath: "dup.com/dup", valid: true},
+		{fullPath: "/tenant2/src/secret.com/named", importPath: "secret.com/renamed", valid: true},
+	}, conflicts: map[string][]string{
+		"/tenant2/src/secret.com/xy": {"secret.com/xy", "other.com/xy"},
+	}}
+	if err := dirs.QueryTokens(strings.NewReader("alice /tenant1\n")); err != nil {
+		t.Fatal(err)
+	}
+	get := func(query string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", hostPrefix+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer alice")
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+		return rec
+	}
+
+	// The other tenants' valid matches don't hide the invalid ones.
+	if actual, out := slice(get("imports/y").Body.String()), []string{"a.com/y"}; !reflect.DeepEqual(actual, out) {
+		t.Errorf("imports/y: got %q, want %q", actual, out)
+	}
+
+	for _, query := range []string{"imports/xz?suggest=1", "collisions", "mismatches", "conflicts"} {
+		rec := get(query)
+		if body := rec.Body.String(); strings.Contains(body, "tenant2") || strings.Contains(body, "secret.com") {
+			t.Errorf("%q: got %q, with another tenant's paths", query, body)
+		}
+	}
+	if body := get("collisions").Body.String(); strings.TrimSpace(body) != "{}" {
+		t.Errorf("collisions: got %q, want none", body)
+	}
+
+	// The statistics only count the token's directories.
+	dirs.importPanics = map[string]string{"/tenant2/src/secret.com/bad": "malformed file"}
+	var s stats
+	if err := json.Unmarshal(get("stats").Body.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Directories != 3 || len(s.Panics) != 0 {
+		t.Errorf("stats: got %d directories and panics %v, want 3 and none", s.Directories, s.Panics)
+	}
+}
+
+func TestQueryTokensRoots(t *testing.T) {
+	tenant1, tenant2 := t.TempDir(), t.TempDir()
+	dirs := index{}
+	if err := dirs.Roots([]string{tenant1, tenant2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dirs.QueryTokens(strings.NewReader("alice " + tenant1 + "\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", hostPrefix+"roots", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer alice")
+	rec := httptest.NewRecorder()
+	dirs.ServeMux().ServeHTTP(rec, req)
+
+	var roots []rootStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &roots); err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 1 || roots[0].Root != tenant1 {
+		t.Errorf("got roots %+v, want only %q", roots, tenant1)
+	}
+}
+
+func TestPrefetchQueryTokens(t *testing.T) {
+	dirs := index{index: []details{
+		{fullPath: "/tenant1/src/a.com/x", importPath: "a.com/x", valid: true},
+		{fullPath: "/tenant2/src/b.com/x", importPath: "b.com/x", valid: true},
+	}, cache: newCache(10)}
+	if err := dirs.QueryTokens(strings.NewReader("alice /tenant1\nbob /tenant2\ncarol /tenant2\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := parsePrefetch(strings.NewReader("imports/x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := dirs.Prefetch(keys); n != 1 {
+		t.Errorf("prefetched %d queries, want 1", n)
+	}
+
+	for _, token := range []string{"alice", "bob", "carol"} {
+		req, err := http.NewRequest("GET", hostPrefix+"imports/x", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		dirs.ServeMux().ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// Each token's request is answered from the cache, the ones
+	// permitting the same directories sharing the entry.
+	out := cacheStats{Size: 10, Entries: 2, Hits: 3, Misses: 2}
+	if actual := dirs.cache.stats(); actual != out {
+		t.Errorf("got %+v, want %+v", actual, out)
+	}
+}
+
+func TestReindex(t *testing.T) {
+	gopath := tempGOPATH(t, map[string]string{
+		"example.com/a/a.go": "package a\n",
+	})
+	root := filepath.Join(gopath, "src")
+
+	dirs := index{updateToken: "secret"}
+	dirs.Roots([]string{root})
+	dirs.Index()
+
+	srv := httptest.NewServer(dirs.Handler())
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	// A package added after the start is found by the reindexing.
+	if err := os.MkdirAll(filepath.Join(root, "example.com", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "example.com", "b", "b.go"), []byte("package b\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := reindex(&out, addr, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), "Indexed 2 packages\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if results, _ := dirs.QueryIndex(context.Background(), "b", kindImports, modeSuffix); len(results) != 1 {
+		t.Errorf("got %v, want the new package", results)
+	}
+
+	err := reindex(ioutil.Discard, addr, "wrong")
+	if err == nil || !strings.Contains(err.Error(), "401 Unauthorized") {
+		t.Errorf("wrong token: got error %v, want 401 Unauthorized", err)
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	sock := "unix:" + filepath.Join(t.TempDir(), "gopaths.sock")
+	listeners, err := listen(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(listeners[0], dirs.Handler())
+	defer listeners[0].Close()
+
+	out.Reset()
+	if err := reindex(&out, sock+","+addr, "secret"); err != nil || out.String() != "Indexed 2 packages\n" {
+		t.Errorf("unix socket: got %q (%v), want %q", out.String(), err, "Indexed 2 packages\n")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	gopath := tempGOPATH(t, map[string]string{
+		"example.com/ok/ok.go":       "package ok\n",
+		"example.com/broken/a.go":    "package broken\nimport (\n",
+		"example.com/mixed/a.go":     "package a\n",
+		"example.com/mixed/b.go":     "package b\n",
+		"example.com/mixed/sub/c.go": "package c\n",
+	})
+
+	dirs := index{}
+	dirs.Roots([]string{filepath.Join(gopath, "src")})
+
+	metrics := func() map[string]string {
+		req, err := http.NewRequest("GET", hostPrefix+"metrics", nil)
+		if err != nil {
+			t.Errorf("GET %q failed", "metrics")
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		values := map[string]string{}
+		for _, line := range slice(rec.Body.String()) {
+			if fields := strings.Fields(line); len(fields) == 2 && !strings.HasPrefix(line, "#") {
+				values[fields[0]] = fields[1]
+			}
+		}
+		return values
+	}
+
+	before := metrics()
+	if before["gopaths_index_runs_total"] != "0" || before["gopaths_index_last_success_timestamp_seconds"] != "0.000" {
+		t.Errorf("got %v before indexing, want no runs", before)
+	}
+
+	start := time.Now()
+	dirs.Index()
+	dirs.Index()
+
+	actual := metrics()
+	for name, value := range map[string]string{
+		"gopaths_index_runs_total":                              "2",
+		`gopaths_index_errors_total{class="parse"}`:             "2",
+		`gopaths_index_errors_total{class="multiple_packages"}`: "2",
+		`gopaths_index_errors_total{class="walk"}`:              "0",
+		`gopaths_index_errors_total{class="panic"}`:             "0",
+		`gopaths_index_errors_total{class="other"}`:             "0",
+		"gopaths_index_directories":                             "6",
+	} {
+		if actual[name] != value {
+			t.Errorf("%s: got %q, want %q", name, actual[name], value)
+		}
+	}
+
+	last, err := strconv.ParseFloat(actual["gopaths_index_last_success_timestamp_seconds"], 64)
+	if err != nil || last < float64(start.Unix()) {
+		t.Errorf("got last success %q, want after %d", actual["gopaths_index_last_success_timestamp_seconds"], start.Unix())
+	}
+}
+
+func TestImportPanic(t *testing.T) {
+	gopath := tempGOPATH(t, map[string]string{
+		"example.com/ok/ok.go":       "package ok\n",
+		"example.com/bad/bad.go":     "package bad\n",
+		"example.com/bad/sub/sub.go": "package sub\n",
+	})
+	bad := filepath.Join(gopath, "src", "example.com", "bad")
+
+	defer func(f func(string) (*build.Package, error)) { importDir = f }(importDir)
+	imported := importDir
+	importDir = func(dir string) (*build.Package, error) {
+		if dir == bad {
+			panic("malformed file")
+		}
+		return imported(dir)
+	}
+
+	dirs := index{}
+	dirs.Roots([]string{filepath.Join(gopath, "src")})
+	dirs.Index()
+
+	for query, out := range map[string][]string{
+		"imports/ok":           {"example.com/ok"},
+		"imports/sub":          {"example.com/bad/sub"},
+		"imports/bad":          {"example.com/bad"},
+		"dirs/bad?strict=true": {""},
+	} {
+		req, err := http.NewRequest("GET", hostPrefix+query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", query)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		if actual := slice(rec.Body.String()); !reflect.DeepEqual(actual, out) {
+			t.Errorf("%q: got %q, want %q", query, actual, out)
+		}
+	}
+
+	req, err := http.NewRequest("GET", hostPrefix+"stats", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	dirs.ServeMux().ServeHTTP(rec, req)
+
+	var s stats
+	if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{bad: "malformed file"}; !reflect.DeepEqual(s.Panics, want) {
+		t.Errorf("got panics %v, want %v", s.Panics, want)
+	}
+	if n := dirs.indexErrors[errorPanic]; n != 1 {
+		t.Errorf("got %d panic errors, want 1", n)
+	}
+}
+
+func TestSymbolsPanic(t *testing.T) {
+	gopath := tempGOPATH(t, map[string]string{
+		"example.com/ok/ok.go":       "package ok\n\nfunc Frobnicate() {}\n",
+		"example.com/bad/bad.go":     "package bad\n\nfunc Frobnicate() {}\n",
+		"example.com/bad/sub/sub.go": "package sub\n",
+	})
+	bad := filepath.Join(gopath, "src", "example.com", "bad")
+
+	defer func(f func(*token.FileSet, string) (*ast.File, error)) { parseFile = f }(parseFile)
+	parsed := parseFile
+	parseFile = func(fset *token.FileSet, path string) (*ast.File, error) {
+		if filepath.Dir(path) == bad {
+			panic("malformed file")
+		}
+		return parsed(fset, path)
+	}
+
+	dirs := index{indexSymbols: true, indexWorkers: 2}
+	dirs.Roots([]string{filepath.Join(gopath, "src")})
+	dirs.Index()
+
+	for query, out := range map[string][]string{
+		"symbols/Frobnicate":   {"example.com/ok"},
+		"imports/sub":          {"example.com/bad/sub"},
+		"dirs/bad?strict=true": {""},
+	} {
+		req, err := http.NewRequest("GET", hostPrefix+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+		if actual := slice(rec.Body.String()); !reflect.DeepEqual(actual, out) {
+			t.Errorf("%q: got %q, want %q", query, actual, out)
+		}
+	}
+	if want := map[string]string{bad: "malformed file"}; !reflect.DeepEqual(dirs.importPanics, want) {
+		t.Errorf("got panics %v, want %v", dirs.importPanics, want)
+	}
+}
+
+func TestIndexWorkers(t *testing.T) {
+	root := tempTree(t, "a", "b", "c", "d", "e", "f", "g", "h")
+
+	// Count the goroutines importing packages at once, holding the ones
+	// importing the root's children until as many as the workers are.
+	var mu sync.Mutex
+	running, most := 0, 0
+	var barrier chan struct{}
+	workers, reached := 0, false
+	defer func(f func(string) (*build.Package, error)) { importDir = f }(importDir)
+	imported := importDir
+	importDir = func(dir string) (*build.Package, error) {
+		if dir == root {
+			return imported(dir)
+		}
+
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		if running == workers && !reached {
+			reached = true
+			close(barrier)
+		}
+		mu.Unlock()
+
+		select {
+		case <-barrier:
+		case <-time.After(5 * time.Second):
+		}
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return imported(dir)
+	}
+
+	var serial []details
+	for _, workers = range []int{1, 3} {
+		most, barrier, reached = 0, make(chan struct{}), false
+		dirs := index{indexWorkers: workers}
+		dirs.Roots([]string{root})
+		dirs.Index()
+
+		if !reached {
+			t.Errorf("%d workers: never had %d importing at once", workers, workers)
+		}
+		if most > workers {
+			t.Errorf("%d workers: got %d importing at once, want at most %d", workers, most, workers)
+		}
+		if serial == nil {
+			serial = dirs.index
+		} else if !reflect.DeepEqual(dirs.index, serial) {
+			t.Errorf("%d workers: got index %v, want %v", workers, dirs.index, serial)
+		}
+	}
+
+	if n := (&index{}).workers(); n != runtime.NumCPU() {
+		t.Errorf("no workers set: got %d, want %d", n, runtime.NumCPU())
+	}
+}
+
+func TestSortBuilt(t *testing.T) {
+	gopath := tempGOPATH(t, map[string]string{
+		"example.com/a/a.go":       "package a\n",
+		"example.com/b/b.go":       "package b\n",
+		"example.com/c/c.go":       "package c\n",
+		"example.com/tool/main.go": "package main\n",
+	})
+	t.Setenv("GOBIN", "")
+
+	now := time.Now()
+	pkg := filepath.Join(gopath, "pkg", build.Default.GOOS+"_"+build.Default.GOARCH, "example.com")
+	tool := "tool"
+	if runtime.GOOS == "windows" {
+		tool += ".exe"
+	}
+	for name, age := range map[string]time.Duration{
+		filepath.Join(pkg, "a.a"):          3 * time.Hour,
+		filepath.Join(pkg, "b.a"):          2 * time.Hour,
+		filepath.Join(gopath, "bin", tool): time.Hour,
+	} {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, now.Add(-age), now.Add(-age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dirs := index{builtTimes: true}
+	dirs.Roots([]string{filepath.Join(gopath, "src")})
+	dirs.Index()
+
+	for query, out := range map[string][]string{
+		"imports/example.com?mode=prefix&sort=built": {"example.com/tool", "example.com/b", "example.com/a", "example.com/c"},
+		"imports/c?sort=built":                       {"example.com/c"},
+	} {
+		req, err := http.NewRequest("GET", hostPrefix+query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", query)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		if actual := slice(rec.Body.String()); !reflect.DeepEqual(actual, out) {
+			t.Errorf("%q: got %q, want %q", query, actual, out)
+		}
+	}
+
+	req, err := http.NewRequest("GET", hostPrefix+"imports/a?sort=newest", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	dirs.ServeMux().ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown sort: got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	// Reinstalling a package is a change of the trees.
+	if dirs.IndexIfChanged() {
+		t.Errorf("reindexed without changes")
+	}
+	if err := os.Remove(filepath.Join(pkg, "a.a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(pkg, "a.a"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !dirs.IndexIfChanged() {
+		t.Errorf("didn't reindex after reinstalling example.com/a")
+	}
+	query := "imports/example.com?mode=prefix&sort=built"
+	req, err = http.NewRequest("GET", hostPrefix+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	dirs.ServeMux().ServeHTTP(rec, req)
+	out := []string{"example.com/a", "example.com/tool", "example.com/b", "example.com/c"}
+	if actual := slice(rec.Body.String()); !reflect.DeepEqual(actual, out) {
+		t.Errorf("%q after reinstalling: got %q, want %q", query, actual, out)
+	}
+
+	// Without the built times, there's no order by them.
+	unrecorded := index{}
+	unrecorded.Roots([]string{filepath.Join(gopath, "src")})
+	unrecorded.Index()
+	req, err = http.NewRequest("GET", hostPrefix+"imports/a?sort=built", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	unrecorded.ServeMux().ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("without -built-times: got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+var MinFilesTests = []struct {
+	query string
+	out   []string
+}{
+	{"imports/example.com/one", []string{"example.com/one"}},
+	{"imports/example.com/one?minfiles=0", []string{"example.com/one"}},
+	{"imports/example.com/one?minfiles=1", []string{"example.com/one"}},
+	{"imports/example.com/one?minfiles=2", []string{""}},
+	{"imports/example.com/two?minfiles=2", []string{"example.com/two"}},
+	{"imports/example.com/two?minfiles=3", []string{""}},
+	{"imports/example.com/three?minfiles=3", []string{""}},
+	{"imports/example.com/three?minfiles=2", []string{"example.com/three"}},
+	{"imports/example.com/tests?minfiles=1", []string{""}},
+	{"dirs/empty", []string{"{{gopath}}/src/example.com/empty"}},
+	{"dirs/empty?minfiles=1", []string{""}},
+}
+
+func TestMinFiles(t *testing.T) {
+	gopath := tempGOPATH(t, map[string]string{
+		"example.com/one/one.go":       "package one\n",
+		"example.com/two/a.go":         "package two\n",
+		"example.com/two/b.go":         "package two\n",
+		"example.com/two/a_test.go":    "package two\n",
+		"example.com/three/a.go":       "package three\n",
+		"example.com/three/b.go":       "package three\n",
+		"example.com/three/ignored.go": "//go:build ignore\n\npackage three\n",
+		"example.com/tests/a_test.go":  "package tests\n",
+		"example.com/empty/README":     "",
+	})
+
+	dirs := index{}
+	dirs.Roots([]string{filepath.Join(gopath, "src")})
+	dirs.Index()
+
+	for _, test := range MinFilesTests {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		out := make([]string, len(test.out))
+		for i, path := range test.out {
+			out[i] = strings.Replace(path, "{{gopath}}", filepath.ToSlash(gopath), 1)
+		}
+		if actual := slice(filepath.ToSlash(rec.Body.String())); !reflect.DeepEqual(actual, out) {
+			t.Errorf("%q: got %q, want %q", test.query, actual, out)
+		}
+	}
+
+	for body, out := range map[string][]string{
+		`{"q": "example.com/two", "minFiles": 2}`: {"example.com/two"},
+		`{"q": "example.com/one", "minFiles": 2}`: {},
+	} {
+		req, err := http.NewRequest("POST", hostPrefix+"query", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		var results []result
+		if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+			t.Fatalf("%s: %v", body, err)
+		}
+		actual := []string{}
+		for _, res := range results {
+			actual = append(actual, res.Path)
+		}
+		if !reflect.DeepEqual(actual, out) {
+			t.Errorf("%s: got %q, want %q", body, actual, out)
+		}
+	}
+
+	for _, query := range []string{"imports/one?minfiles=-1", "imports/one?minfiles=x"} {
+		req, err := http.NewRequest("GET", hostPrefix+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: got status %d, want %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	root := tempTree(t, "a")
+
+	dirs := index{frozen: true}
+	dirs.Roots([]string{root})
+	dirs.Index()
+	if n := dirs.Len(); n != 2 {
+		t.Fatalf("frozen: got %d directories initially, want 2", n)
+	}
+
+	// The updates return at once rather than tick.
+	done := make(chan struct{})
+	go func() {
+		dirs.UpdateIndex(time.Millisecond)
+		dirs.RefreshInvalidEvery(time.Millisecond)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("frozen: the updates kept running")
+	}
+
+	if err := os.Mkdir(filepath.Join(root, "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", hostPrefix+"update", nil)
+	if err != nil {
+		t.Errorf("POST %q failed", "update")
+	}
+
+	rec := httptest.NewRecorder()
+	dirs.ServeMux().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("frozen: got status %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	if n := dirs.Len(); n != 2 {
+		t.Errorf("frozen: got %d directories after the update, want 2", n)
+	}
+}
+
+func TestControlCharacters(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file names can't contain newlines")
+	}
+
+	root := tempTree(t, "x", "a\nb", "c\td")
+	dirs := index{}
+	dirs.Roots([]string{root})
+	dirs.Index()
+
+	query := func(accept string) string {
+		req, err := http.NewRequest("GET", hostPrefix+"dirs"+root+"?mode=prefix", nil)
+		if err != nil {
+			t.Errorf("GET %q failed", root)
+		}
+		req.Header.Set("Accept", accept)
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+		return rec.Body.String()
+	}
+
+	// Each line is a single path, quoted if need be.
+	out := []string{
+		strconv.Quote(filepath.Join(root, "a\nb")),
+		strconv.Quote(filepath.Join(root, "c\td")),
+		filepath.Join(root, "x"),
+	}
+	if actual := slice(query("text/plain")); !reflect.DeepEqual(actual, out) {
+		t.Errorf("text: got %q, want %q", actual, out)
+	}
+
+	var results []result
+	if err := json.Unmarshal([]byte(query("application/json")), &results); err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{}
+	for _, res := range results {
+		paths = append(paths, res.Path)
+	}
+	sort.Strings(paths)
+	if want := []string{filepath.Join(root, "a\nb"), filepath.Join(root, "c\td"), filepath.Join(root, "x")}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("JSON: got %q, want %q", paths, want)
+	}
+
+	if actual := textPath(`"quoted"`); actual != `"\"quoted\""` {
+		t.Errorf("got %s for a path starting with a quote, want it quoted", actual)
+	}
+}
+
+var MethodsTests = []struct {
+	method string
+	query  string
+	code   int
+	allow  string
+}{
+	{"GET", "imports/a", http.StatusOK, ""},
+	{"HEAD", "imports/a", http.StatusOK, ""},
+	{"POST", "imports/a", http.StatusMethodNotAllowed, "GET, HEAD"},
+	{"GET", "dirs/a", http.StatusOK, ""},
+	{"POST", "dirs/a", http.StatusMethodNotAllowed, "GET, HEAD"},
+	{"DELETE", "dirs/a", http.StatusMethodNotAllowed, "GET, HEAD"},
+	{"GET", "symbols/A", http.StatusOK, ""},
+	{"PUT", "symbols/A", http.StatusMethodNotAllowed, "GET, HEAD"},
+	{"GET", "files/none", http.StatusOK, ""},
+	{"POST", "files/a", http.StatusMethodNotAllowed, "GET, HEAD"},
+	{"GET", "resolve/a", http.StatusNotFound, ""},
+	{"POST", "resolve/a", http.StatusMethodNotAllowed, "GET, HEAD"},
+	{"POST", "importdir/a", http.StatusMethodNotAllowed, "GET, HEAD"},
+	{"GET", "recent/", http.StatusOK, ""},
+	{"POST", "recent/", http.StatusMethodNotAllowed, "GET, HEAD"},
+	{"GET", "all/imports", http.StatusOK, ""},
+	{"POST", "all/dirs", http.StatusMethodNotAllowed, "GET, HEAD"},
+	{"GET", "stats", http.StatusOK, ""},
+	{"POST", "stats", http.StatusMethodNotAllowed, "GET, HEAD"},
+	{"GET", "metrics", http.StatusOK, ""},
+	{"POST", "metrics", http.StatusMethodNotAllowed, "GET, HEAD"},
+	{"HEAD", "roots", http.StatusOK, ""},
+	{"POST", "roots", http.StatusMethodNotAllowed, "GET, HEAD"},
+	{"GET", "collisions", http.StatusOK, ""},
+	{"POST", "collisions", http.StatusMethodNotAllowed, "GET, HEAD"},
+	{"GET", "mismatches", http.StatusOK, ""},
+	{"POST", "mismatches", http.StatusMethodNotAllowed, "GET, HEAD"},
+	{"GET", "a", http.StatusOK, ""},
+	{"POST", "a", http.StatusMethodNotAllowed, "GET, HEAD"},
+	{"GET", "query", http.StatusMethodNotAllowed, "POST"},
+	{"GET", "update", http.StatusMethodNotAllowed, "POST"},
+	{"HEAD", "update", http.StatusMethodNotAllowed, "POST"},
+	{"PUT", "update", http.StatusMethodNotAllowed, "POST"},
+	{"POST", "update", http.StatusOK, ""},
+}
+
+func TestMethods(t *testing.T) {
+	for _, test := range MethodsTests {
+		dirs := index{}
+		dirs.Roots([]string{"testdata"})
+		dirs.Index()
+
+		// Only a POST to /update may reindex.
+		dirs.mu.Lock()
+		dirs.index = QueryTestDetails
+		dirs.mu.Unlock()
+
+		req, err := http.NewRequest(test.method, hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("%s %q failed", test.method, test.query)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		if rec.Code != test.code {
+			t.Errorf("%s %q: got status %d, want %d", test.method, test.query, rec.Code, test.code)
+		}
+		if allow := rec.Header().Get("Allow"); allow != test.allow {
+			t.Errorf("%s %q: got Allow %q, want %q", test.method, test.query, allow, test.allow)
+		}
+
+		dirs.mu.RLock()
+		reindexed := len(dirs.index) != len(QueryTestDetails) || &dirs.index[0] != &QueryTestDetails[0]
+		dirs.mu.RUnlock()
+		if want := test.query == "update" && test.code == http.StatusOK; reindexed != want {
+			t.Errorf("%s %q: got reindexed %v, want %v", test.method, test.query, reindexed, want)
+		}
+	}
+}
+
+var SearchPageTests = []struct {
+	query  string
+	accept string
+	html   bool
+}{
+	{"", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", true},
+	{"", "*/*", false},
+	{"", "", false},
+	{"a", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", false},
+	{"dirs/", "text/html", false},
+}
+
+func TestSearchPage(t *testing.T) {
+	dirs := index{index: QueryTestDetails}
+
+	for _, test := range SearchPageTests {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+		req.Header.Set("Accept", test.accept)
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		ct := rec.Header().Get("Content-Type")
+		html := strings.HasPrefix(ct, "text/html") && strings.Contains(rec.Body.String(), "<form")
+		if html != test.html {
+			t.Errorf("%q (Accept: %q): got Content-Type %q, want the search page: %v",
+				test.query, test.accept, ct, test.html)
+		}
+	}
+}
+
+// tempGOPATH makes a temporary GOPATH with the given source files,
+// named by slash separated paths relative to its src directory, and sets
+// it as the GOPATH for the duration of the test.
+func tempGOPATH(t *testing.T, files map[string]string) string {
+	gopath := t.TempDir()
+	for name, src := range files {
+		name = filepath.Join(gopath, "src", filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	old := build.Default.GOPATH
+	build.Default.GOPATH = gopath
+	t.Cleanup(func() { build.Default.GOPATH = old })
+
+	return gopath
+}
+
+var SymbolsTests = []struct {
+	query string
+	out   []string
+}{
+	{"symbols/Frobnicate", []string{"example.com/frob"}},
+	{"symbols/Widget", []string{"example.com/frob", "example.com/widget"}},
+	{"symbols/MaxSize", []string{"example.com/widget"}},
+	{"symbols/Default", []string{"example.com/widget"}},
+	{"symbols/helper", []string{""}},
+	{"symbols/Reset", []string{""}},
+	{"symbols/Frob", []string{""}},
+	{"symbols/Allocate", []string{"example.com/cgo"}},
+}
+
+func TestSymbols(t *testing.T) {
+	gopath := t.TempDir()
+	defer func(gopath string) { build.Default.GOPATH = gopath }(build.Default.GOPATH)
+	build.Default.GOPATH = gopath
+
+	files := map[string]string{
+		"src/example.com/frob/frob.go": "package frob\n\nfunc Frobnicate() {}\n\nfunc helper() {}\n\ntype Widget int\n",
+		"src/example.com/widget/widget.go": "package widget\n\ntype Widget struct{}\n\nfunc (w *Widget) Reset() {}\n\n" +
+			"const MaxSize = 10\n\nvar (\n\tDefault, other Widget\n)\n",
+		"src/example.com/cgo/cgo.go": "package cgo\n\n// #include <stdlib.h>\nimport \"C\"\n\nfunc Allocate() {}\n",
+	}
+	for name, src := range files {
+		name = filepath.Join(gopath, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The cgo files are only listed as such with cgo enabled.
+	defer func(enabled bool) { build.Default.CgoEnabled = enabled }(build.Default.CgoEnabled)
+	build.Default.CgoEnabled = true
+
+	dirs := index{indexSymbols: true}
+	dirs.Roots([]string{gopath})
+	dirs.Index()
+
+	for _, test := range SymbolsTests {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		if actual := slice(rec.Body.String()); reflect.DeepEqual(actual, test.out) != true {
+			t.Errorf("%q: got %q, want %q", test.query, actual, test.out)
+		}
+	}
+
+	// Unchanged packages aren't parsed again.
+	frob := filepath.Join(gopath, "src", "example.com", "frob")
+	before := dirs.symbols[frob].names
+	dirs.Index()
+	if after := dirs.symbols[frob].names; &after[0] != &before[0] {
+		t.Errorf("symbols of unchanged %s were collected again", frob)
+	}
+
+	// Editing a cgo file is noticed.
+	cgo := filepath.Join(gopath, "src", "example.com", "cgo", "cgo.go")
+	if err := ioutil.WriteFile(cgo, []byte("package cgo\n\nimport \"C\"\n\nfunc Free() {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	edited := time.Now().Add(time.Minute)
+	if err := os.Chtimes(cgo, edited, edited); err != nil {
+		t.Fatal(err)
+	}
+	dirs.Index()
+	req, err := http.NewRequest("GET", hostPrefix+"symbols/Free", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	dirs.ServeMux().ServeHTTP(rec, req)
+	if actual, out := slice(rec.Body.String()), []string{"example.com/cgo"}; reflect.DeepEqual(actual, out) != true {
+		t.Errorf("after editing the cgo file: got %q, want %q", actual, out)
+	}
+}
+
+var SymbolTests = []struct {
+	query string
+	out   []string
+}{
+	{"symbol/Handle", []string{"example.com/web", "example.com/cmd/tool"}},
+	{"symbol/web.Handle", []string{"example.com/web"}},
+	{"symbol/example.com/web.Handle", []string{"example.com/web"}},
+	{"symbol/main.Handle", []string{"example.com/cmd/tool"}},
+	{"symbol/Handler", []string{"example.com/api/http", "example.com/web"}},
+	{"symbol/httpapi.Handler", []string{"example.com/api/http"}},
+	{"symbol/http.Handler", []string{"example.com/api/http"}},
+	{"symbol/yaml.v3.Marshal", []string{"example.com/yaml.v3"}},
+	{"symbol/yaml.Marshal", []string{"example.com/yaml.v3"}},
+	{"symbol/other.Handle", []string{""}},
+	{"symbol/Web", []string{""}},
+}
+
+func TestSymbol(t *testing.T) {
+	gopath := tempGOPATH(t, map[string]string{
+		"example.com/api/http/http.go": "package httpapi\n\ntype Handler int\n",
+		"example.com/cmd/tool/main.go": "package main\n\nfunc Handle() {}\n\nfunc main() {}\n",
+		"example.com/web/web.go":       "package web\n\nfunc Handle() {}\n\ntype Handler int\n",
+		"example.com/yaml.v3/yaml.go":  "package yaml\n\nfunc Marshal() {}\n",
+	})
+
+	dirs := index{indexSymbols: true}
+	dirs.Roots([]string{filepath.Join(gopath, "src")})
+	dirs.Index()
+
+	for _, test := range SymbolTests {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		if actual := slice(rec.Body.String()); !reflect.DeepEqual(actual, test.out) {
+			t.Errorf("%q: got %q, want %q", test.query, actual, test.out)
+		}
+	}
+
+	for _, name := range []string{"handle", "web.", ".Handle", "web.Handle.x"} {
+		req, err := http.NewRequest("GET", hostPrefix+"symbol/"+name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: got status %d, want %d", name, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+var FilesTests = []struct {
+	query string
+	out   []string
+}{
+	{"files/example.com/foo", []string{"a.go", "b.go", "a_test.go", "x_test.go"}},
+	{"files/example.com/foo/bar", []string{"bar.go"}},
+	{"files/foo", []string{""}},
+	{"files/example.com", []string{""}},
+}
+
+func TestFiles(t *testing.T) {
+	gopath := tempGOPATH(t, map[string]string{
+		"example.com/foo/a.go":        "package foo\n",
+		"example.com/foo/b.go":        "package foo\n",
+		"example.com/foo/a_test.go":   "package foo\n",
+		"example.com/foo/x_test.go":   "package foo_test\n",
+		"example.com/foo/c.c":         "",
+		"example.com/foo/README":      "",
+		"example.com/foo/bar/bar.go":  "package bar\n",
+		"example.com/foo/bar/ignored": "",
+		"example.com/gone/gone.go":    "package gone\n",
+	})
+
+	dirs := index{}
+	dirs.Roots([]string{gopath})
+	dirs.Index()
+
+	for _, test := range FilesTests {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		if actual := slice(rec.Body.String()); reflect.DeepEqual(actual, test.out) != true {
+			t.Errorf("%q: got %q, want %q", test.query, actual, test.out)
+		}
+	}
+
+	// A package removed since indexing has no files.
+	if err := os.RemoveAll(filepath.Join(gopath, "src", "example.com", "gone")); err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("GET", hostPrefix+"files/example.com/gone", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	dirs.ServeMux().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("removed: got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	if actual, out := slice(rec.Body.String()), []string{""}; reflect.DeepEqual(actual, out) != true {
+		t.Errorf("removed: got %q, want %q", actual, out)
+	}
+}
+
+func TestMissingRoot(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(ioutil.Discard)
+		log.SetFlags(log.LstdFlags)
+	}()
+
+	kept, gone := tempTree(t, "a", "a/b"), tempTree(t, "c")
+	dirs := index{}
+	if err := dirs.Roots([]string{kept, gone}); err != nil {
+		t.Fatal(err)
+	}
+	dirs.Index()
+
+	before := dirs.Len()
+	if err := os.RemoveAll(gone); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	dirs.Index()
+
+	if dirs.Len() != before {
+		t.Errorf("got %d directories after the root went away, want %d", dirs.Len(), before)
+	}
+	if !strings.Contains(buf.String(), "Root "+gone+" is missing") {
+		t.Errorf("got log %q, want a warning about the missing root %s", buf.String(), gone)
+	}
+
+	req, err := http.NewRequest("GET", hostPrefix+"dirs/c", nil)
+	if err != nil {
+		t.Errorf("GET %q failed", "dirs/c")
+	}
+
+	rec := httptest.NewRecorder()
+	dirs.ServeMux().ServeHTTP(rec, req)
+
+	out := []string{filepath.Join(gone, "c")}
+	if actual := slice(rec.Body.String()); reflect.DeepEqual(actual, out) != true {
+		t.Errorf("%q: got %q, want %q", "dirs/c", actual, out)
+	}
+}
+
+var CanonicalTests = []struct {
+	roots []string
+	query string
+	out   []string
+}{
+	{[]string{"/gopath1/src", "/gopath2/src"}, "imports/net/http", []string{"/goroot/src/net/http"}},
+	{[]string{"/gopath2/src", "/gopath1/src"}, "imports/net/http", []string{"/goroot/src/net/http"}},
+	{[]string{"/gopath1/src", "/gopath2/src"}, "imports/x/y", []string{"/gopath1/src/x/y"}},
+	{[]string{"/gopath2/src", "/gopath1/src"}, "imports/x/y", []string{"/gopath2/src/x/y"}},
+	{[]string{"/gopath2/src"}, "imports/x/y", []string{"/gopath2/src/x/y"}},
+	{[]string{"/gopath1/src", "/gopath2/src"}, "imports/z", []string{"/gopath1/src/z", "/gopath2/src/x/z"}},
+	{[]string{"/gopath1/src", "/gopath2/src"}, "imports/v", []string{"/gopath1/src/v"}},
+	{[]string{"/gopath1/src", "/gopath2/src"}, "imports/u", []string{"/gopath2/src/u"}},
+	{[]string{"/gopath1/src", "/gopath2/src"}, "dirs/net/http", []string{"/goroot/src/net/http", "/gopath1/src/net/http", "/gopath2/src/net/http", "/gopath1/src/x/vendor/net/http"}},
+}
+
+func TestCanonicalImports(t *testing.T) {
+	defer func(goroot string) { build.Default.GOROOT = goroot }(build.Default.GOROOT)
+	build.Default.GOROOT = filepath.FromSlash("/goroot")
+
+	entries := []details{
+		{fullPath: "/gopath1/src/net/http", importPath: "net/http", valid: true},
+		{fullPath: "/gopath1/src/x/y", importPath: "x/y", valid: true},
+		{fullPath: "/gopath1/src/z", importPath: "z", valid: true},
+		{fullPath: "/gopath2/src/net/http", importPath: "net/http", valid: true},
+		{fullPath: "/gopath2/src/x/y", importPath: "x/y", valid: true},
+		{fullPath: "/gopath2/src/x/z", importPath: "x/z", valid: true},
+		{fullPath: "/gopath1/src/v", importPath: "v", valid: true},
+		{fullPath: "/gopath2/src/w/vendor/v", importPath: "w/vendor/v", valid: true},
+		{fullPath: "/gopath1/src/x/vendor/net/http", importPath: "x/vendor/net/http", valid: true},
+		{fullPath: "/gopath2/src/u", importPath: "u", valid: true},
+		{fullPath: "/gopath2/src/t/vendor/u", importPath: "t/vendor/u", valid: true},
+		{fullPath: "/goroot/src/net/http", importPath: "net/http", valid: true},
+		{fullPath: "/elsewhere/z", importPath: ".", valid: true},
+	}
+	for i := range entries {
+		entries[i].fullPath = filepath.FromSlash(entries[i].fullPath)
+	}
+
+	for _, test := range CanonicalTests {
+		dirs := index{index: entries, canonicalImports: true}
+		for _, root := range test.roots {
+			dirs.rootDirs = append(dirs.rootDirs, filepath.FromSlash(root))
+		}
+
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+		// Tell the directories of the import paths by the CSV entries.
+		req.Header.Set("Accept", "text/csv")
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		records, err := csv.NewReader(rec.Body).ReadAll()
+		if err != nil {
+			t.Fatalf("%v %q: %v", test.roots, test.query, err)
+		}
+		actual := []string{}
+		for _, record := range records[1:] {
+			actual = append(actual, filepath.ToSlash(record[0]))
+		}
+
+		if !reflect.DeepEqual(actual, test.out) {
+			t.Errorf("%v %q: got %q, want %q", test.roots, test.query, actual, test.out)
+		}
+	}
+}
+
+var StdlibTests = []struct {
+	query  string
+	out    []string
+	stdlib []bool
+}{
+	{"imports/fmt", []string{"fmt", "example.com/fmt"}, []bool{true, false}},
+	{"imports/fmt?stdlib=false", []string{"example.com/fmt"}, []bool{false}},
+	{"imports/fmt?stdlib=true", []string{"fmt"}, []bool{true}},
+	{"imports/rand?stdlib=0", []string{}, []bool{}},
+	{"imports/rand?stdlib=1", []string{"math/rand"}, []bool{true}},
+}
+
+func TestStdlib(t *testing.T) {
+	goroot := tempTree(t, "src/fmt", "src/math/rand")
+	defer func(goroot string) { build.Default.GOROOT = goroot }(build.Default.GOROOT)
+	build.Default.GOROOT = goroot
+
+	gopath := tempGOPATH(t, map[string]string{
+		"example.com/fmt/fmt.go": "package fmt\n",
+	})
+
+	dirs := index{}
+	if err := dirs.Roots([]string{filepath.Join(goroot, "src"), gopath}); err != nil {
+		t.Fatal(err)
+	}
+	dirs.Index()
+
+	for _, test := range StdlibTests {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+		req.Header.Set("Accept", "application/json")
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		var results []struct {
+			Path   string `json:"path"`
+			Stdlib bool   `json:"stdlib"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+			t.Fatalf("%q: %v", test.query, err)
+		}
+
+		paths, stdlib := []string{}, []bool{}
+		for _, res := range results {
+			paths = append(paths, res.Path)
+			stdlib = append(stdlib, res.Stdlib)
+		}
+		if !reflect.DeepEqual(paths, test.out) || !reflect.DeepEqual(stdlib, test.stdlib) {
+			t.Errorf("%q: got %q (stdlib: %v), want %q (stdlib: %v)",
+				test.query, paths, stdlib, test.out, test.stdlib)
+		}
+	}
+
+	req, err := http.NewRequest("GET", hostPrefix+"imports/fmt?stdlib=maybe", nil)
+	if err != nil {
+		t.Errorf("GET %q failed", "imports/fmt?stdlib=maybe")
+	}
+
+	rec := httptest.NewRecorder()
+	dirs.ServeMux().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid stdlib parameter: got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+var TestOnlyTests = []struct {
+	query string
+	out   []string
+}{
+	{"imports/example.com/?mode=prefix", []string{"example.com/intest", "example.com/lib", "example.com/xtest"}},
+	{"imports/example.com/?mode=prefix&testonly=true", []string{"example.com/intest", "example.com/xtest"}},
+	{"imports/example.com/?mode=prefix&testonly=false", []string{"example.com/lib"}},
+}
+
+func TestTestOnly(t *testing.T) {
+	gopath := tempGOPATH(t, map[string]string{
+		"example.com/lib/lib.go":          "package lib\n",
+		"example.com/lib/lib_test.go":     "package lib_test\n",
+		"example.com/xtest/xtest_test.go": "package xtest_test\n",
+		"example.com/intest/in_test.go":   "package intest\n",
+	})
+
+	dirs := index{}
+	dirs.Roots([]string{filepath.Join(gopath, "src")})
+	dirs.Index()
+
+	for _, test := range TestOnlyTests {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+		req.Header.Set("Accept", "application/json")
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		var results []result
+		if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+			t.Fatalf("%q: %v", test.query, err)
+		}
+		paths := []string{}
+		for _, res := range results {
+			paths = append(paths, res.Path)
+			if want := res.Path != "example.com/lib"; res.TestOnly != want {
+				t.Errorf("%q: %s: got testOnly %v, want %v", test.query, res.Path, res.TestOnly, want)
+			}
+		}
+		if !reflect.DeepEqual(paths, test.out) {
+			t.Errorf("%q: got %q, want %q", test.query, paths, test.out)
+		}
+	}
+
+	req, err := http.NewRequest("GET", hostPrefix+"imports/lib?testonly=maybe", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	dirs.ServeMux().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid testonly parameter: got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestGoVersion(t *testing.T) {
+	gopath := tempGOPATH(t, map[string]string{
+		"example.com/any/any.go":       "package any\n",
+		"example.com/new/new.go":       "package new\n",
+		"example.com/new/new_go118.go": "//go:build go1.18\n\npackage new\n",
+		"example.com/new/new_go121.go": "// Copyright notice.\n\n//go:build go1.21 && !purego\n\npackage new\n",
+		"example.com/new/old.go":       "//go:build !go1.21\n\npackage new\n",
+		"example.com/neg/neg.go":       "//go:build !go1.18\n\npackage neg\n",
+		"example.com/next/a.go":        "package next\n",
+		"example.com/next/b.go":        "//go:build go1.99\n\npackage next\n",
+		"example.com/next/b_test.go":   "//go:build go1.999\n\npackage next\n",
+	})
+
+	dirs := index{}
+	dirs.Roots([]string{filepath.Join(gopath, "src")})
+	dirs.Index()
+
+	req, err := http.NewRequest("GET", hostPrefix+"imports/example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	rec := httptest.NewRecorder()
+	dirs.ServeMux().ServeHTTP(rec, req)
+
+	var results []result
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	versions := map[string]string{}
+	for _, res := range results {
+		versions[res.Path] = res.GoVersion
+	}
+	want := map[string]string{"example.com/any": "", "example.com/new": "go1.21", "example.com/next": "go1.99"}
+	if !reflect.DeepEqual(versions, want) {
+		t.Errorf("got Go versions %q, want %q", versions, want)
+	}
+}
+
+var GoFileTests = []struct {
+	query string
+	out   []string
+}{
+	{"imports/example.com/http/server.go?file=true", []string{"example.com/http"}},
+	{"imports/http/server.go?file=1", []string{"example.com/http"}},
+	{"imports/example.com/http/server.go", []string{""}},
+	{"imports/example.com/http/server.go?file=false", []string{""}},
+	{"imports/example.com/http?file=true", []string{"example.com/http"}},
+	{"imports/server.go?file=true", []string{""}},
+	{"imports/example.com/http/.go?file=true", []string{""}},
+	{"dirs/example.com/http/server.go?file=true", []string{"/example.com/http"}},
+	{`dirs/example.com\http\server.go?file=true`, []string{"/example.com/http"}},
+}
+
+func TestGoFile(t *testing.T) {
+	gopath := tempGOPATH(t, map[string]string{
+		"example.com/http/server.go": "package http\n",
+	})
+	root := filepath.Join(gopath, "src")
+
+	dirs := index{}
+	dirs.Roots([]string{root})
+	dirs.Index()
+
+	for _, test := range GoFileTests {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		out := test.out
+		if strings.HasPrefix(test.query, "dirs/") {
+			out = prefixDir(out, root)
+		}
+		if actual := slice(rec.Body.String()); !reflect.DeepEqual(actual, out) {
+			t.Errorf("%q: got %q, want %q", test.query, actual, out)
+		}
+	}
+
+	req, err := http.NewRequest("GET", hostPrefix+"imports/fmt/print.go?file=maybe", nil)
+	if err != nil {
+		t.Errorf("GET %q failed", "imports/fmt/print.go?file=maybe")
+	}
+
+	rec := httptest.NewRecorder()
+	dirs.ServeMux().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid file parameter: got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+var RelToTests = []struct {
+	query   string
+	code    int
+	out     []string
+	offsets [][][2]int
+}{
+	{"dirs/util?relto=/work/project", http.StatusOK,
+		[]string{"/work/other/util", "/work/project-x/util", "pkg/util"},
+		[][][2]int{{{12, 16}}, {{16, 20}}, {{4, 8}}}},
+	{"dirs/util?relto=/work/project/", http.StatusOK,
+		[]string{"/work/other/util", "/work/project-x/util", "pkg/util"},
+		[][][2]int{{{12, 16}}, {{16, 20}}, {{4, 8}}}},
+	{"dirs/project?mode=substring&relto=/work/project", http.StatusOK,
+		[]string{".", "/work/project-x/util", "pkg/util"},
+		[][][2]int(nil)},
+	{"dirs/util?relto=work/project", http.StatusBadRequest, nil, nil},
+	{"imports/util?relto=/work/project", http.StatusBadRequest, nil, nil},
+}
+
+func TestRelTo(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("absolute paths have volume names")
+	}
+
+	dirs := index{index: []details{
+		{fullPath: "/work/project", importPath: ".", valid: true},
+		{fullPath: "/work/project/pkg/util", importPath: ".", valid: true},
+		{fullPath: "/work/other/util", importPath: ".", valid: true},
+		{fullPath: "/work/project-x/util", importPath: ".", valid: true},
+	}}
+
+	for _, test := range RelToTests {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+		req.Header.Set("Accept", "application/json")
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		if rec.Code != test.code {
+			t.Errorf("%q: got status %d, want %d", test.query, rec.Code, test.code)
+			continue
+		}
+		if test.code != http.StatusOK {
+			continue
+		}
+
+		var results []result
+		if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+			t.Fatalf("%q: %v", test.query, err)
+		}
+		paths, offsets := []string{}, [][][2]int{}
+		for _, res := range results {
+			paths = append(paths, res.Path)
+			offsets = append(offsets, res.Offsets)
+		}
+		if !reflect.DeepEqual(paths, test.out) {
+			t.Errorf("%q: got %q, want %q", test.query, paths, test.out)
+		}
+		if test.offsets != nil && !reflect.DeepEqual(offsets, test.offsets) {
+			t.Errorf("%q: got offsets %v, want %v", test.query, offsets, test.offsets)
+		}
+	}
+
+	// The cached results stay absolute.
+	results, err := dirs.QueryIndex(context.Background(), "util", kindDirs, modeSuffix)
+	if err != nil || len(results) != 3 || results[2].Path != "/work/project/pkg/util" {
+		t.Errorf("got %v (%v), want the absolute paths", results, err)
+	}
+}
+
+var UnversionedTests = []struct {
+	query   string
+	out     []string
+	offsets [][][2]int
+}{
+	{"imports/x/y", []string{"github.com/x/y"}, [][][2]int{{{11, 14}}}},
+	{"imports/x/y?unversioned=true", []string{"github.com/x/y", "github.com/x/y/v3"}, [][][2]int{{{11, 14}}, {{11, 14}}}},
+	{"imports/y/v3?unversioned=true", []string{"github.com/x/y/v3"}, [][][2]int{{{13, 17}}}},
+	{"imports/github.com/w?mode=prefix&unversioned=true", []string{"github.com/w/v2"}, [][][2]int{{{0, 12}}}},
+	{"imports/z?unversioned=true", []string{}, [][][2]int{}},
+	{"imports/x/y/v3/?unversioned=true", []string{"github.com/x/y/v3/sub"}, [][][2]int{{{11, 17}}}},
+}
+
+func TestUnversioned(t *testing.T) {
+	dirs := index{index: []details{
+		{fullPath: "/gopath/src/github.com/x/y", importPath: "github.com/x/y", valid: true},
+		{fullPath: "/gopath/src/github.com/x/y/v3", importPath: "github.com/x/y/v3", valid: true},
+		{fullPath: "/gopath/src/github.com/x/y/v3/sub", importPath: "github.com/x/y/v3/sub", valid: true},
+		{fullPath: "/gopath/src/github.com/w/v2", importPath: "github.com/w/v2", valid: true},
+		{fullPath: "/gopath/src/github.com/z/v1", importPath: "github.com/z/v1", valid: true},
+		{fullPath: "/gopath/src/github.com/z/v01", importPath: "github.com/z/v01", valid: true},
+		{fullPath: "/gopath/src/github.com/z/vv2", importPath: "github.com/z/vv2", valid: true},
+	}}
+
+	for _, test := range UnversionedTests {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+		req.Header.Set("Accept", "application/json")
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		var results []result
+		if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+			t.Fatalf("%q: %v", test.query, err)
+		}
+
+		paths, offsets := []string{}, [][][2]int{}
+		for _, res := range results {
+			paths = append(paths, res.Path)
+			offsets = append(offsets, res.Offsets)
+		}
+		if !reflect.DeepEqual(paths, test.out) {
+			t.Errorf("%q: got %q, want %q", test.query, paths, test.out)
+		}
+		if !reflect.DeepEqual(offsets, test.offsets) {
+			t.Errorf("%q: got offsets %v, want %v", test.query, offsets, test.offsets)
+		}
+	}
+
+	req, err := http.NewRequest("GET", hostPrefix+"imports/x/y?unversioned=maybe", nil)
+	if err != nil {
+		t.Errorf("GET %q failed", "imports/x/y?unversioned=maybe")
+	}
+
+	rec := httptest.NewRecorder()
+	dirs.ServeMux().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid unversioned parameter: got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+var StrictValidTests = []struct {
+	strict bool // The -strict-valid default.
+	query  string
+	out    []string
+}{
+	{false, "imports/x/y", []string{"example.com/x/y"}},
+	{false, "imports/x", []string{"example.com/x"}},
+	{false, "imports/x?strict=true", []string{}},
+	{false, "imports/x/y?strict=true", []string{"example.com/x/y"}},
+	{false, "dirs/x?strict=1", []string{}},
+	{true, "imports/x", []string{}},
+	{true, "imports/x/y", []string{"example.com/x/y"}},
+	{true, "imports/x?strict=false", []string{"example.com/x"}},
+	{true, "imports/x?count=1", nil},
+}
+
+func TestStrictValid(t *testing.T) {
+	for _, test := range StrictValidTests {
+		dirs := index{strictValid: test.strict, index: []details{
+			{fullPath: "/gopath/src/example.com/x", importPath: "example.com/x"},
+			{fullPath: "/gopath/src/example.com/x/y", importPath: "example.com/x/y", valid: true},
+		}}
+
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+		req.Header.Set("Accept", "application/json")
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		if test.out == nil {
+			if got := strings.TrimSpace(rec.Body.String()); got != `{"count":0}` {
+				t.Errorf("strict %v, %q: got %s, want a count of 0", test.strict, test.query, got)
+			}
+			continue
+		}
+
+		var results []result
+		if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+			t.Fatalf("strict %v, %q: %v", test.strict, test.query, err)
+		}
+		paths := []string{}
+		for _, res := range results {
+			paths = append(paths, res.Path)
+		}
+		if !reflect.DeepEqual(paths, test.out) {
+			t.Errorf("strict %v, %q: got %q, want %q", test.strict, test.query, paths, test.out)
+		}
+	}
+
+	dirs := index{strictValid: true, index: []details{
+		{fullPath: "/gopath/src/example.com/x", importPath: "example.com/x"},
+	}}
+	for body, want := range map[string]string{
+		`{"q": "x"}`:                  `[]`,
+		`{"q": "x", "strict": false}`: `example.com/x`,
+	} {
+		req, err := http.NewRequest("POST", hostPrefix+"query", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("POST %s: got %s, want %s", body, rec.Body, want)
+		}
+	}
+
+	req, err := http.NewRequest("GET", hostPrefix+"imports/x?strict=maybe", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	dirs.ServeMux().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid strict parameter: got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+var FoldStdlibTests = []struct {
+	foldStdlib bool
+	query      string
+	out        []string
+	offsets    [][][2]int
+}{
+	{false, "imports/OS", []string{}, [][][2]int{}},
+	{true, "imports/OS", []string{"os"}, [][][2]int{{{0, 2}}}},
+	{true, "imports/Os", []string{"os", "example.com/Os"}, [][][2]int{{{0, 2}}, {{12, 14}}}},
+	{true, "imports/os", []string{"os", "example.com/os"}, [][][2]int{{{0, 2}}, {{12, 14}}}},
+	{true, "imports/OS/Exec", []string{"os/exec"}, [][][2]int{{{0, 7}}}},
+	{true, "imports/Exec?mode=substring", []string{"os/exec"}, [][][2]int{{{3, 7}}}},
+}
+
+func TestFoldStdlib(t *testing.T) {
+	goroot := filepath.Join(build.Default.GOROOT, "src")
+	details := []details{
+		{fullPath: filepath.Join(goroot, "os"), importPath: "os", valid: true},
+		{fullPath: filepath.Join(goroot, "os", "exec"), importPath: "os/exec", valid: true},
+		{fullPath: "/gopath/src/example.com/Os", importPath: "example.com/Os", valid: true},
+		{fullPath: "/gopath/src/example.com/os", importPath: "example.com/os", valid: true},
+		{fullPath: "/gopath/src/example.com/EXEC", importPath: "example.com/EXEC", valid: true},
+	}
+
+	for _, test := range FoldStdlibTests {
+		dirs := index{index: details, foldStdlib: test.foldStdlib}
+
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+		req.Header.Set("Accept", "application/json")
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		var results []result
+		if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+			t.Fatalf("%q: %v", test.query, err)
+		}
+
+		paths, offsets := []string{}, [][][2]int{}
+		for _, res := range results {
+			paths = append(paths, res.Path)
+			offsets = append(offsets, res.Offsets)
+		}
+		if !reflect.DeepEqual(paths, test.out) {
+			t.Errorf("%v %q: got %q, want %q", test.foldStdlib, test.query, paths, test.out)
+		}
+		if !reflect.DeepEqual(offsets, test.offsets) {
+			t.Errorf("%v %q: got offsets %v, want %v", test.foldStdlib, test.query, offsets, test.offsets)
+		}
+	}
+}
+
+var CommandsTests = []struct {
+	query   string
+	out     []string
+	command []bool
+}{
+	{"imports/foo", []string{"example.com/foo", "example.com/cmd/foo"}, []bool{false, true}},
+	{"imports/foo?kind=command", []string{"example.com/cmd/foo"}, []bool{true}},
+	{"imports/foo?kind=library", []string{"example.com/foo"}, []bool{false}},
+	{"imports/cmd", []string{"example.com/cmd"}, []bool{false}},
+	{"imports/cmd?kind=command", []string{}, []bool{}},
+	{"imports/cmd?kind=library", []string{}, []bool{}},
+}
+
+func TestCommands(t *testing.T) {
+	gopath := tempGOPATH(t, map[string]string{
+		"example.com/cmd/foo/main.go": "package main\n",
+		"example.com/foo/foo.go":      "package foo\n",
+	})
+
+	dirs := index{}
+	if err := dirs.Roots([]string{filepath.Join(gopath, "src")}); err != nil {
+		t.Fatal(err)
+	}
+	dirs.Index()
+
+	for _, test := range CommandsTests {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+		req.Header.Set("Accept", "application/json")
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		var results []struct {
+			Path    string `json:"path"`
+			Command bool   `json:"command"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+			t.Fatalf("%q: %v", test.query, err)
+		}
+
+		paths, command := []string{}, []bool{}
+		for _, res := range results {
+			paths = append(paths, res.Path)
+			command = append(command, res.Command)
+		}
+		if !reflect.DeepEqual(paths, test.out) || !reflect.DeepEqual(command, test.command) {
+			t.Errorf("%q: got %q (command: %v), want %q (command: %v)",
+				test.query, paths, command, test.out, test.command)
+		}
+	}
+
+	req, err := http.NewRequest("GET", hostPrefix+"imports/foo?kind=plugin", nil)
+	if err != nil {
+		t.Errorf("GET %q failed", "imports/foo?kind=plugin")
+	}
+
+	rec := httptest.NewRecorder()
+	dirs.ServeMux().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid kind parameter: got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+var MaxResponseTests = []struct {
+	accept string
+	max    int
+	out    int
+}{
+	{"", 0, 6},
+	{"", 1000, 6},
+	{"", 28, 6},
+	{"", 27, 5},
+	{"", 4, 1},
+	{"", 3, 0},
+	{"application/json", 1000, 6},
+	{"application/json", 137, 3},
+	{"application/json", 136, 2},
+	{"application/json", 48, 1},
+	{"application/json", 47, 0},
+	{"application/x-ndjson", 1000, 6},
+	{"application/x-ndjson", 135, 3},
+	{"application/x-ndjson", 134, 2},
+	{binaryMediaType, 1000, 6},
+	{binaryMediaType, 35, 6},
+	{binaryMediaType, 34, 5},
+	{binaryMediaType, 6, 1},
+	{binaryMediaType, 5, 0},
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	for _, test := range MaxResponseTests {
+		dirs := index{index: QueryTestDetails, maxResponseBytes: test.max}
+
+		req, err := http.NewRequest("GET", hostPrefix+"imports/a?mode=prefix", nil)
+		if err != nil {
+			t.Errorf("GET %q failed", "imports/a?mode=prefix")
+		}
+		req.Header.Set("Accept", test.accept)
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		truncated := test.out < 6
+		if got := rec.Header().Get("X-Truncated") == "true"; got != truncated {
+			t.Errorf("%q, %d bytes: got truncated %v, want %v", test.accept, test.max, got, truncated)
+		}
+		if test.max > 0 && rec.Body.Len() > test.max && test.out > 0 {
+			t.Errorf("%q, %d bytes: got %d bytes", test.accept, test.max, rec.Body.Len())
+		}
+
+		var n int
+		switch test.accept {
+		case "application/json":
+			var results []result
+			if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+				t.Fatalf("%q, %d bytes: %v", test.accept, test.max, err)
+			}
+			n = len(results)
+		case binaryMediaType:
+			results, err := readBinary(rec.Body)
+			if err != nil {
+				t.Fatalf("%q, %d bytes: %v", test.accept, test.max, err)
+			}
+			n = len(results)
+		default:
+			for _, line := range slice(rec.Body.String()) {
+				if line != "" {
+					n++
+				}
+			}
+		}
+		if n != test.out {
+			t.Errorf("%q, %d bytes: got %d results, want %d", test.accept, test.max, n, test.out)
+		}
+	}
+
+	dirs := index{index: QueryTestDetails, maxResponseBytes: 10, rejectOversized: true}
+	for query, code := range map[string]int{
+		"imports/a?mode=prefix": http.StatusRequestEntityTooLarge,
+		"imports/a":             http.StatusOK,
+	} {
+		req, err := http.NewRequest("GET", hostPrefix+query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", query)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		if rec.Code != code {
+			t.Errorf("%q (rejecting oversized responses): got status %d, want %d", query, rec.Code, code)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	gopath := tempGOPATH(t, map[string]string{
+		"example.com/foo/foo.go":     "package foo\n",
+		"example.com/foo/bar/bar.go": "package bar\n",
+	})
+
+	dirs := index{}
+	if err := dirs.Roots([]string{gopath}); err != nil {
+		t.Fatal(err)
+	}
+	dirs.Index()
+
+	// The leading slash is left out; ServeMux redirects "resolve//home/...".
+	abs := strings.TrimPrefix(filepath.ToSlash(filepath.Join(gopath, "src", "example.com", "foo")), "/")
+	tests := []struct {
+		query string
+		code  int
+		out   []string
+	}{
+		{"resolve/" + abs, http.StatusOK, []string{"example.com/foo"}},
+		{"resolve/" + abs + "/bar/", http.StatusOK, []string{"example.com/foo/bar"}},
+		{"resolve/src/example.com/foo/bar", http.StatusOK, []string{"example.com/foo/bar"}},
+		{"resolve/src/example.com", http.StatusNotFound, nil},
+		{"resolve/" + abs + "/baz", http.StatusNotFound, nil},
+		{"resolve/nonexistent/dir", http.StatusNotFound, nil},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		if rec.Code != test.code {
+			t.Errorf("%q: got status %d, want %d", test.query, rec.Code, test.code)
+			continue
+		}
+		if test.code != http.StatusOK {
+			continue
+		}
+		if actual := slice(rec.Body.String()); reflect.DeepEqual(actual, test.out) != true {
+			t.Errorf("%q: got %q, want %q", test.query, actual, test.out)
+		}
+	}
+}
+
+var BaseNameTestDetails = []details{
+	{fullPath: "/work/api/handlers", importPath: "example.com/api/handlers", valid: true},
+	{fullPath: "/work/api/handlersutil", importPath: "example.com/api/handlersutil", valid: true},
+	{fullPath: "/work/web/handlers", importPath: "example.com/web/handlers", valid: false},
+	{fullPath: "/work/renamed/h", importPath: "example.com/handlers", valid: true},
+	{fullPath: "/work/handlers/x", importPath: "example.com/handlers/x", valid: true},
+	{fullPath: "/elsewhere/handlers", importPath: ".", valid: true},
+}
+
+var BaseNameTests = []struct {
+	query string
+	out   []string
+}{
+	{"basename/handlers", []string{"/work/api/handlers", "/elsewhere/handlers", "/work/web/handlers"}},
+	{"basename/handlers?of=dirs", []string{"/work/api/handlers", "/elsewhere/handlers", "/work/web/handlers"}},
+	{"basename/handlers?prefix=true", []string{"/work/api/handlers", "/work/api/handlersutil", "/elsewhere/handlers", "/work/web/handlers"}},
+	{"basename/handlers?of=imports", []string{"example.com/api/handlers", "example.com/handlers", "example.com/web/handlers"}},
+	{"basename/handler?of=imports&prefix=true", []string{"example.com/api/handlers", "example.com/api/handlersutil", "example.com/handlers", "example.com/web/handlers"}},
+	{"basename/handler", []string{""}},
+	{"basename/h", []string{"/work/renamed/h"}},
+	{"basename/x?of=imports", []string{"example.com/handlers/x"}},
+}
+
+func TestBaseName(t *testing.T) {
+	dirs := index{index: BaseNameTestDetails}
+
+	for _, test := range BaseNameTests {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		if actual := slice(rec.Body.String()); !reflect.DeepEqual(actual, test.out) {
+			t.Errorf("%q: got %q, want %q", test.query, actual, test.out)
+		}
+	}
+
+	for _, query := range []string{"basename/a/b", "basename/x?of=files", "basename/x?prefix=maybe"} {
+		req, err := http.NewRequest("GET", hostPrefix+query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", query)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: got status %d, want %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+var ImportDirTestDetails = []details{
+	{fullPath: "/root1/src/x/y", importPath: "x/y", valid: false},
+	{fullPath: "/root1/src/x/z", importPath: "x/z", valid: true},
+	{fullPath: "/root2/src/x/y", importPath: "x/y", valid: true},
+	{fullPath: "/root3/src/x/y", importPath: "x/y", valid: true},
+}
+
+var ImportDirTests = []struct {
+	query string
+	code  int
+	out   []string
+}{
+	{"importdir/x/y", http.StatusOK, []string{"/root2/src/x/y", "/root3/src/x/y", "/root1/src/x/y"}},
+	{"importdir/x/z", http.StatusOK, []string{"/root1/src/x/z"}},
+	{"importdir/y", http.StatusNotFound, nil},
+	{"importdir/x", http.StatusNotFound, nil},
+}
+
+func TestImportDir(t *testing.T) {
+	dirs := index{index: ImportDirTestDetails}
+
+	for _, test := range ImportDirTests {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		if rec.Code != test.code {
+			t.Errorf("%q: got status %d, want %d", test.query, rec.Code, test.code)
+			continue
+		}
+		if test.code != http.StatusOK {
+			continue
+		}
+		if actual := slice(rec.Body.String()); reflect.DeepEqual(actual, test.out) != true {
+			t.Errorf("%q: got %q, want %q", test.query, actual, test.out)
+		}
+	}
+}
+
+var DefaultExclusionsTests = []struct {
+	exclusions string
+	noDefault  bool
+	out        []string
+}{
+	{"", false, []string{"/a", "/vendor/v"}},
+	{"vendor", false, []string{"/a"}},
+	{"vendor !.hg", false, []string{"/.hg/h", "/a"}},
+	{"", true, []string{"/.git/g", "/.hg/h", "/a", "/vendor/v"}},
+	{"vendor .hg", true, []string{"/.git/g", "/a"}},
+}
+
+func TestDefaultExclusions(t *testing.T) {
+	root := tempTree(t, "a", ".git/g", ".hg/h", "vendor/v")
+
+	for _, test := range DefaultExclusionsTests {
+		file := filepath.Join(t.TempDir(), "exclusions")
+		if err := ioutil.WriteFile(file, []byte(test.exclusions), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		dirs := index{includeHidden: true}
+		if err := loadExclusions(&dirs, file, nil, test.noDefault, false); err != nil {
+			t.Fatal(err)
+		}
+		dirs.Roots([]string{root})
+		dirs.Index()
+
+		req, err := http.NewRequest("GET", hostPrefix+"dirs/?mode=prefix", nil)
+		if err != nil {
+			t.Errorf("GET %q failed", "dirs/?mode=prefix")
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		if actual := slice(rec.Body.String()); reflect.DeepEqual(actual, prefixDir(test.out, root)) != true {
+			t.Errorf("%q (no defaults: %v): got %q, want %q",
+				test.exclusions, test.noDefault, actual, prefixDir(test.out, root))
+		}
+	}
+}
+
+func TestEmptyExclusionFile(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(ioutil.Discard)
+
+	file := filepath.Join(t.TempDir(), "exclusions")
+	if err := ioutil.WriteFile(file, []byte(" \n\t\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		noDefault, strict bool
+		warning           string
+	}{
+		{false, false, "only the default exclusions apply"},
+		{true, false, "no directories are excluded"},
+		{false, true, ""},
+	} {
+		buf.Reset()
+		dirs := index{}
+		err := loadExclusions(&dirs, file, nil, test.noDefault, test.strict)
+
+		if test.strict {
+			if err == nil || !strings.Contains(err.Error(), "no exclusions") {
+				t.Errorf("strict: got %v, want an error about no exclusions", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out := buf.String(); !strings.Contains(out, "WARNING: "+file) || !strings.Contains(out, test.warning) {
+			t.Errorf("no defaults: %v: got log %q, want a warning that %s", test.noDefault, out, test.warning)
+		}
+		if want := !test.noDefault; dirs.excluded(".git", ".git") != want {
+			t.Errorf("no defaults: %v: got .git excluded %v, want %v", test.noDefault, !want, want)
+		}
+	}
+
+	// Files with exclusions aren't warned about.
+	if err := ioutil.WriteFile(file, []byte("vendor\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := loadExclusions(&index{}, file, nil, false, true); err != nil {
+		t.Errorf("got %v, want no error", err)
+	}
+	if buf.Len() > 0 {
+		t.Errorf("got log %q, want no warning", buf.String())
+	}
+}
+
+var ApplyEnvTests = []struct {
+	args       []string
+	env        map[string]string
+	root       string
+	http       string
+	interval   time.Duration
+	exclusions []string
+}{
+	{nil, nil, "", ":6118", 45 * time.Minute, nil},
+	{
+		nil,
+		map[string]string{
+			"GOPATHS_ROOTS":    "/src" + string(os.PathListSeparator) + "/go/src",
+			"GOPATHS_EXCLUDE":  "testdata" + string(os.PathListSeparator) + "vendor",
+			"GOPATHS_HTTP":     "localhost:8080,unix:/tmp/gopaths.sock",
+			"GOPATHS_INTERVAL": "10m",
+		},
+		"/src" + string(os.PathListSeparator) + "/go/src",
+		"localhost:8080,unix:/tmp/gopaths.sock",
+		10 * time.Minute,
+		[]string{"testdata", "vendor"},
+	},
+	{
+		[]string{"-root=/flag", "-exclude=excl.txt", "-http=:7000", "-interval=0"},
+		map[string]string{
+			"GOPATHS_ROOTS":    "/src",
+			"GOPATHS_EXCLUDE":  "testdata",
+			"GOPATHS_HTTP":     ":8080",
+			"GOPATHS_INTERVAL": "10m",
+		},
+		"/flag", ":7000", 0, nil,
+	},
+	{
+		[]string{"-http=:7000"},
+		map[string]string{"GOPATHS_ROOTS": "/src", "GOPATHS_HTTP": ":8080"},
+		"/src", ":7000", 45 * time.Minute, nil,
+	},
+}
+
+var CheckTests = []struct {
+	exclusions, regexps, prefetch string
+	roots                         []string
+	names                         []string
+	out                           []string
+}{
+	// Valid configuration.
+	{"vendor !vendor/keep\n\n# depth:1:tmp\nimport:example.com/old", "^/tmp/\n\n[.]cache/", "imports/http\n# comment\n", []string{"$ROOT"}, []string{".git"}, nil},
+
+	{"*.go [a-c", "", "", []string{"$ROOT"}, nil, []string{`$EXCL:1: exclusion "[a-c": unterminated character class`}},
+	{"ok\n!\ndepth:x:a depth:1:", "", "", []string{"$ROOT"}, nil, []string{
+		`$EXCL:2: exclusion "!": empty pattern`,
+		`$EXCL:3: exclusion "depth:x:a": invalid depth "x"`,
+	}},
+	{"\n  \n", "", "", []string{"$ROOT"}, nil, []string{"$EXCL: no exclusions in the file"}},
+	{"import:", "", "", []string{"$ROOT"}, []string{"a", "/"}, []string{
+		`GOPATHS_EXCLUDE: exclusion "/": empty pattern`,
+		`$EXCL:1: exclusion "import:": empty pattern`,
+	}},
+	{"vendor", "ok\n(unclosed", "", []string{"$ROOT"}, nil, []string{"$REGEXP:2: error parsing regexp: missing closing ): `(unclosed`"}},
+	{"vendor", "", "imports/a\nlists/a\ndirs/a?mode=exact", []string{"$ROOT"}, nil, []string{
+		`$PREFETCH:2: invalid query "lists/a"`,
+		`$PREFETCH:3: unknown query mode "exact"`,
+	}},
+	{"vendor", "", "", []string{"$ROOT", "$ROOT/missing", "$EXCL"}, nil, []string{
+		"root stat $ROOT/missing: no such file or directory",
+		"root $EXCL: not a directory",
+	}},
+}
+
+func TestCheck(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the expected messages are of Unix")
+	}
+
+	for i, test := range CheckTests {
+		root := t.TempDir()
+		files := map[string]string{
+			"ROOT":     root,
+			"EXCL":     filepath.Join(root, "exclusions"),
+			"REGEXP":   filepath.Join(root, "regexps"),
+			"PREFETCH": filepath.Join(root, "prefetch"),
+		}
+		for name, content := range map[string]string{
+			"EXCL":     test.exclusions,
+			"REGEXP":   test.regexps,
+			"PREFETCH": test.prefetch,
+		} {
+			if err := ioutil.WriteFile(files[name], []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		expand := func(s string) string {
+			return os.Expand(s, func(name string) string { return files[name] })
+		}
+
+		roots := []string{}
+		for _, r := range test.roots {
+			roots = append(roots, expand(r))
+		}
+
+		var buf bytes.Buffer
+		problems := check(&buf, roots, test.names, checkFiles{exclusions: files["EXCL"], regexps: files["REGEXP"], prefetch: files["PREFETCH"]})
+
+		out := []string{}
+		for _, line := range test.out {
+			out = append(out, expand(line))
+		}
+		actual := []string{}
+		if buf.Len() > 0 {
+			actual = slice(buf.String())
+		}
+		if !reflect.DeepEqual(actual, out) {
+			t.Errorf("%d: got %q, want %q", i, actual, out)
+		}
+		if problems != len(out) {
+			t.Errorf("%d: got %d problems, want %d", i, problems, len(out))
+		}
+	}
+
+	// Missing files are problems too.
+	var buf bytes.Buffer
+	if problems := check(&buf, nil, nil, checkFiles{exclusions: filepath.Join(t.TempDir(), "missing")}); problems != 1 {
+		t.Errorf("missing file: got %d problems (%q), want 1", problems, buf.String())
+	}
+}
+
+func TestCheckFiles(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the expected messages are of Unix")
+	}
+
+	root := t.TempDir()
+	files := checkFiles{
+		queryTokens: filepath.Join(root, "tokens"),
+		dirs:        filepath.Join(root, "dirs"),
+		load:        filepath.Join(root, "index.csv"),
+	}
+	for file, content := range map[string]string{
+		files.queryTokens: "alice " + root + "\nbob\nalice " + root + "\n",
+		files.dirs:        "# listed\n" + root + "\n" + filepath.Join(root, "missing") + "\n" + files.load + "\n",
+		files.load:        "Path,ImportPath,Valid,Package\n",
+	} {
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	problems := check(&buf, nil, nil, files)
+	out := []string{
+		files.queryTokens + ": line 3: duplicate token",
+		"listed stat " + filepath.Join(root, "missing") + ": no such file or directory",
+		"listed " + files.load + ": not a directory",
+		fmt.Sprintf("%s: header %q, want %q", files.load, []string{"Path", "ImportPath", "Valid", "Package"}, csvHeader),
+	}
+	if actual := slice(buf.String()); !reflect.DeepEqual(actual, out) {
+		t.Errorf("got %q, want %q", actual, out)
+	}
+	if problems != len(out) {
+		t.Errorf("got %d problems, want %d", problems, len(out))
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	for _, v := range []string{"GOPATHS_ROOTS", "GOPATHS_EXCLUDE", "GOPATHS_HTTP", "GOPATHS_INTERVAL"} {
+		t.Setenv(v, "")
+	}
+
+	for _, test := range ApplyEnvTests {
+		for v, value := range test.env {
+			os.Setenv(v, value)
+		}
+
+		fs := flag.NewFlagSet("gopaths", flag.ContinueOnError)
+		root := fs.String("root", "", "")
+		fs.String("exclude", "", "")
+		addrs := fs.String("http", ":6118", "")
+		interval := fs.Duration("interval", 45*time.Minute, "")
+		if err := fs.Parse(test.args); err != nil {
+			t.Fatal(err)
+		}
+
+		exclusions, err := applyEnv(fs, os.Getenv)
+		if err != nil {
+			t.Errorf("%q: %v", test.args, err)
+		}
+		if *root != test.root || *addrs != test.http || *interval != test.interval || !reflect.DeepEqual(exclusions, test.exclusions) {
+			t.Errorf("%q, %q: got root %q, addresses %q, interval %s, exclusions %q; want %q, %q, %s, %q",
+				test.args, test.env, *root, *addrs, *interval, exclusions,
+				test.root, test.http, test.interval, test.exclusions)
+		}
+
+		for v := range test.env {
+			os.Setenv(v, "")
+		}
+	}
+
+	t.Setenv("GOPATHS_INTERVAL", "often")
+	fs := flag.NewFlagSet("gopaths", flag.ContinueOnError)
+	fs.Duration("interval", 45*time.Minute, "")
+	if _, err := applyEnv(fs, os.Getenv); err == nil || !strings.HasPrefix(err.Error(), "GOPATHS_INTERVAL: ") {
+		t.Errorf("invalid interval: got error %v, want a GOPATHS_INTERVAL error", err)
+	}
+}
+
+func TestDefaultExclusionsVCS(t *testing.T) {
+	vcs := []string{".git", ".hg", ".svn", ".bzr", "CVS"}
+	if actual := strings.Fields(defaultExclusions); reflect.DeepEqual(actual, vcs) != true {
+		t.Errorf("got default exclusions %q, want %q", actual, vcs)
+	}
+
+	// Hidden directories are included, so that only the exclusions skip them.
+	for _, dir := range vcs {
+		root := tempTree(t, "a", dir+"/x")
+
+		dirs := index{includeHidden: true}
+		if err := loadExclusions(&dirs, "", nil, false, false); err != nil {
+			t.Fatal(err)
+		}
+		dirs.Roots([]string{root})
+		dirs.Index()
+
+		for _, c := range dirs.index {
+			if strings.Contains(c.fullPath, sep+dir) {
+				t.Errorf("%s: got %s indexed, want it excluded", dir, c.fullPath)
+			}
+		}
+	}
+}
+
+func TestIncludeGoroot(t *testing.T) {
+	goroot := tempTree(t, "src/fmt")
+	defer func(goroot string) { build.Default.GOROOT = goroot }(build.Default.GOROOT)
+	build.Default.GOROOT = goroot
+
+	gopath := tempGOPATH(t, map[string]string{
+		"example.com/fmt/fmt.go": "package fmt\n",
+	})
+
+	for _, test := range []struct {
+		includeGoroot bool
+		out           []string
+	}{
+		{true, []string{"fmt", "example.com/fmt"}},
+		{false, []string{"example.com/fmt"}},
+	} {
+		roots := []string{filepath.Join(goroot, "src"), filepath.Join(gopath, "src")}
+		if !test.includeGoroot {
+			roots = roots[1:]
+		}
+		if actual := defaultRoots(test.includeGoroot); !reflect.DeepEqual(actual, roots) {
+			t.Errorf("include GOROOT %v: got roots %q, want %q", test.includeGoroot, actual, roots)
+		}
+
+		dirs := index{}
+		if err := dirs.Roots(defaultRoots(test.includeGoroot)); err != nil {
+			t.Fatal(err)
+		}
+		dirs.Index()
+
+		req, err := http.NewRequest("GET", hostPrefix+"imports/fmt", nil)
+		if err != nil {
+			t.Errorf("GET %q failed", "imports/fmt")
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		if actual := slice(rec.Body.String()); !reflect.DeepEqual(actual, test.out) {
+			t.Errorf("include GOROOT %v: got %q, want %q", test.includeGoroot, actual, test.out)
+		}
+	}
+}
+
+func TestCSV(t *testing.T) {
+	gopath := tempGOPATH(t, map[string]string{
+		"example.com/foo/foo.go": "package foo\n",
+		"example.com/bar/baz.go": "package baz\n",
+		"example.com/x, y/x.go":  "package x\n",
+	})
+
+	dirs := index{}
+	if err := dirs.Roots([]string{gopath}); err != nil {
+		t.Fatal(err)
+	}
+	dirs.Index()
+
+	src := filepath.Join(gopath, "src")
+	out := [][]string{
+		{"full_path", "import_path", "valid", "package"},
+		{filepath.Join(src, "example.com", "bar"), "example.com/bar", "true", "baz"},
+		{filepath.Join(src, "example.com", "foo"), "example.com/foo", "true", "foo"},
+		{filepath.Join(src, "example.com", "x, y"), "example.com/x, y", "true", "x"},
+	}
+
+	for _, test := range []struct {
+		query  string
+		accept string
+	}{
+		{"imports/example.com?mode=prefix&format=csv", ""},
+		{"imports/example.com?mode=prefix&format=csv", "application/json"},
+		{"imports/example.com?mode=prefix", "text/csv"},
+	} {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+		req.Header.Set("Accept", test.accept)
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") {
+			t.Errorf("%q (Accept: %q): got Content-Type %q, want text/csv", test.query, test.accept, ct)
+		}
+
+		records, err := csv.NewReader(rec.Body).ReadAll()
+		if err != nil {
+			t.Fatalf("%q (Accept: %q): %v", test.query, test.accept, err)
+		}
+		if reflect.DeepEqual(records, out) != true {
+			t.Errorf("%q (Accept: %q): got %q, want %q", test.query, test.accept, records, out)
+		}
+	}
+}
+
+func TestBinary(t *testing.T) {
+	results := []result{
+		{Path: "net/http", entry: details{valid: true}, Stdlib: true},
+		{Path: "example.com/cmd/tool", entry: details{valid: true}, Command: true},
+		{Path: "example.com/x_test", entry: details{valid: true}, TestOnly: true},
+		{Path: "/srv/go/src/example.com", entry: details{valid: false}},
+		{Path: "/srv/go/src/example.com/héllo\nworld", entry: details{valid: true}},
+		{Path: strings.Repeat("x/", 100) + "long", entry: details{valid: true}},
+	}
+
+	rec := httptest.NewRecorder()
+	writeBinary(rec, results)
+	if ct := rec.Header().Get("Content-Type"); ct != binaryMediaType {
+		t.Errorf("got Content-Type %q, want %q", ct, binaryMediaType)
+	}
+
+	decoded, err := readBinary(bytes.NewReader(rec.Body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range results {
+		results[i].Valid, results[i].entry = results[i].entry.valid, details{}
+	}
+	if !reflect.DeepEqual(decoded, results) {
+		t.Errorf("got %+v, want %+v", decoded, results)
+	}
+
+	// A truncated response fails to decode.
+	if _, err := readBinary(bytes.NewReader(rec.Body.Bytes()[:rec.Body.Len()-1])); err == nil {
+		t.Errorf("truncated response: got no error")
+	}
+
+	// The queries answer in the format if asked to.
+	dirs := index{index: QueryTestDetails}
+	for _, test := range []struct {
+		query  string
+		accept string
+	}{
+		{"imports/a", binaryMediaType},
+		{"imports/a?format=binary", ""},
+		{"imports/a?format=binary", "application/json"},
+	} {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+		req.Header.Set("Accept", test.accept)
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		results, err := readBinary(rec.Body)
+		if err != nil {
+			t.Fatalf("%q (Accept: %q): %v", test.query, test.accept, err)
+		}
+		paths := []string{}
+		for _, res := range results {
+			if !res.Valid {
+				t.Errorf("%q (Accept: %q): %q isn't valid", test.query, test.accept, res.Path)
+			}
+			paths = append(paths, res.Path)
+		}
+		if out := []string{"a", "a/a", "b/a"}; !reflect.DeepEqual(paths, out) {
+			t.Errorf("%q (Accept: %q): got %q, want %q", test.query, test.accept, paths, out)
+		}
+	}
+}
+
+func TestRefreshInvalid(t *testing.T) {
+	gopath := tempGOPATH(t, map[string]string{
+		"example.com/broken/b.go": "package\n",
+	})
+	broken := filepath.Join(gopath, "src", "example.com", "broken")
+
+	// Date the package back, so that the fix is seen as a later
+	// modification that has settled.
+	indexed := time.Now().Add(-time.Hour)
+	for _, path := range []string{filepath.Join(broken, "b.go"), broken} {
+		if err := os.Chtimes(path, indexed, indexed); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dirs := index{}
+	if err := dirs.Roots([]string{gopath}); err != nil {
+		t.Fatal(err)
+	}
+	dirs.Index()
+
+	query := func() []string {
+		req, err := http.NewRequest("GET", hostPrefix+"files/example.com/broken", nil)
+		if err != nil {
+			t.Errorf("GET %q failed", "files/example.com/broken")
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+		return slice(rec.Body.String())
+	}
+
+	if actual, out := query(), []string{""}; reflect.DeepEqual(actual, out) != true {
+		t.Fatalf("before the fix: got %q, want %q", actual, out)
+	}
+	if n := dirs.RefreshInvalid(); n != 0 {
+		t.Errorf("unmodified: got %d directories refreshed, want none", n)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(broken, "b.go"), []byte("package broken\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fixed := time.Now().Add(-time.Minute)
+	if err := os.Chtimes(filepath.Join(broken, "b.go"), fixed, fixed); err != nil {
+		t.Fatal(err)
+	}
+
+	before := dirs.Len()
+	if n := dirs.RefreshInvalid(); n != 1 {
+		t.Errorf("fixed: got %d directories refreshed, want 1", n)
+	}
+	if dirs.Len() != before {
+		t.Errorf("got %d directories after the refresh, want %d", dirs.Len(), before)
+	}
+	if actual, out := query(), []string{"b.go"}; reflect.DeepEqual(actual, out) != true {
+		t.Errorf("after the fix: got %q, want %q", actual, out)
+	}
+	for _, c := range dirs.index {
+		if c.fullPath == broken && !c.modTime.Equal(indexed) {
+			t.Errorf("got modification time %v, want the directory's %v", c.modTime, indexed)
+		}
+	}
+}
+
+func TestRefreshInvalidUnlocked(t *testing.T) {
+	gopath := tempGOPATH(t, map[string]string{
+		"example.com/ok/ok.go":    "package ok\n",
+		"example.com/broken/b.go": "package\n",
+	})
+	broken := filepath.Join(gopath, "src", "example.com", "broken")
+
+	indexed := time.Now().Add(-time.Hour)
+	for _, path := range []string{filepath.Join(broken, "b.go"), broken} {
+		if err := os.Chtimes(path, indexed, indexed); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dirs := index{}
+	if err := dirs.Roots([]string{gopath}); err != nil {
+		t.Fatal(err)
+	}
+	dirs.Index()
+
+	if err := ioutil.WriteFile(filepath.Join(broken, "b.go"), []byte("package broken\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fixed := time.Now().Add(-time.Minute)
+	if err := os.Chtimes(filepath.Join(broken, "b.go"), fixed, fixed); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold the refresh in the middle of its import.
+	started, release := make(chan struct{}), make(chan struct{})
+	defer func(f func(string) (*build.Package, error)) { importDir = f }(importDir)
+	imported := importDir
+	importDir = func(dir string) (*build.Package, error) {
+		if dir == broken {
+			close(started)
+			<-release
+		}
+		return imported(dir)
+	}
+
+	refreshed := make(chan int)
+	go func() { refreshed <- dirs.RefreshInvalid() }()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the refresh didn't import the modified package")
+	}
+
+	answered := make(chan []string)
+	go func() {
+		req, _ := http.NewRequest("GET", hostPrefix+"imports/ok", nil)
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+		answered <- slice(rec.Body.String())
+	}()
+	select {
+	case actual := <-answered:
+		if out := []string{"example.com/ok"}; reflect.DeepEqual(actual, out) != true {
+			t.Errorf("during the refresh: got %q, want %q", actual, out)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the query was held up by the refresh")
+	}
+
+	close(release)
+	if n := <-refreshed; n != 1 {
+		t.Errorf("got %d directories refreshed, want 1", n)
+	}
+}
+
+var ErrorTests = []struct {
+	query  string
+	accept string
+	status int
+	code   string
+}{
+	{"imports/a?mode=bogus", "application/json", http.StatusBadRequest, "bad_request"},
+	{"imports/a?mode=bogus&format=ndjson", "", http.StatusBadRequest, "bad_request"},
+	{"imports/a?stdlib=maybe", "application/json", http.StatusBadRequest, "bad_request"},
+	{"resolve/nonexistent", "application/json", http.StatusNotFound, "not_found"},
+	{"importdir/nonexistent", "application/x-ndjson", http.StatusNotFound, "not_found"},
+	{"imports/a?mode=bogus", "", http.StatusBadRequest, ""},
+	{"resolve/nonexistent", "text/csv", http.StatusNotFound, ""},
+}
+
+func TestErrors(t *testing.T) {
+	dirs := index{index: QueryTestDetails}
+
+	for _, test := range ErrorTests {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+		req.Header.Set("Accept", test.accept)
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		if rec.Code != test.status {
+			t.Errorf("%q (Accept: %q): got status %d, want %d", test.query, test.accept, rec.Code, test.status)
+		}
+
+		ct := rec.Header().Get("Content-Type")
+		if test.code == "" {
+			if !strings.HasPrefix(ct, "text/plain") || strings.HasPrefix(rec.Body.String(), "{") {
+				t.Errorf("%q (Accept: %q): got %q (%s), want a plain text error", test.query, test.accept, rec.Body.String(), ct)
+			}
+			continue
+		}
+
+		var body struct{ Error, Code string }
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || ct != "application/json" {
+			t.Errorf("%q (Accept: %q): got %q (%s), want a JSON error", test.query, test.accept, rec.Body.String(), ct)
+			continue
+		}
+		if body.Code != test.code || body.Error == "" {
+			t.Errorf("%q (Accept: %q): got error %q, code %q, want a message and code %q",
+				test.query, test.accept, body.Error, body.Code, test.code)
+		}
+	}
+}
+
+func TestFileStats(t *testing.T) {
+	root := tempTree(t, "a", "a/b", "c", "vendor/d")
+	if err := ioutil.WriteFile(filepath.Join(root, "a", "README"), []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dirs := index{}
+	if err := dirs.Exclusions(strings.NewReader("vendor")); err != nil {
+		t.Fatal(err)
+	}
+	dirs.Roots([]string{root})
+	dirs.Index()
+
+	req, err := http.NewRequest("GET", hostPrefix+"stats", nil)
+	if err != nil {
+		t.Errorf("GET %q failed", "stats")
+	}
+
+	rec := httptest.NewRecorder()
+	dirs.ServeMux().ServeHTTP(rec, req)
+
+	var actual stats
+	if err := json.Unmarshal(rec.Body.Bytes(), &actual); err != nil {
+		t.Fatalf("can't decode %q: %v", rec.Body.String(), err)
+	}
+
+	// Three x.go files, "package a\n" and so on, and the README;
+	// the vendor directory is excluded.
+	if files, size := 4, int64(3*len("package a\n")+10); actual.Files != files || actual.FileBytes != size {
+		t.Errorf("got %d files of %d bytes, want %d files of %d bytes", actual.Files, actual.FileBytes, files, size)
+	}
+
+	// The counts are of the last run only.
+	dirs.Index()
+	if dirs.files != 4 {
+		t.Errorf("after reindexing: got %d files, want 4", dirs.files)
+	}
+}
+
+func TestServeListeners(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix sockets may be unsupported")
+	}
+
+	sock := filepath.Join(t.TempDir(), "gopaths.sock")
+	listeners, err := listen("127.0.0.1:0, unix:" + sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs := listenAddrs(listeners)
+	if out := []string{listeners[0].Addr().String(), "unix:" + sock}; !reflect.DeepEqual(addrs, out) || strings.HasSuffix(addrs[0], ":0") {
+		t.Errorf("got addresses %q, want %q with the picked port", addrs, out)
+	}
+
+	dirs := index{index: QueryTestDetails}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- serve(ctx, listeners, dirs.ServeMux(), timeouts{}) }()
+
+	unix := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		},
+	}}
+
+	for _, test := range []struct {
+		client *http.Client
+		url    string
+	}{
+		{http.DefaultClient, "http://" + listeners[0].Addr().String() + "/imports/a/b"},
+		{unix, "http://unix/imports/a/b"},
+	} {
+		resp, err := test.client.Get(test.url)
+		if err != nil {
+			t.Fatalf("GET %s: %v", test.url, err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if actual, out := slice(string(body)), []string{"a/b"}; reflect.DeepEqual(actual, out) != true {
+			t.Errorf("GET %s: got %q, want %q", test.url, actual, out)
+		}
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("got %v on shutdown, want no error", err)
+	}
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Errorf("got socket %s left after shutdown", sock)
+	}
+}
+
+func TestServeReadTimeout(t *testing.T) {
+	listeners, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dirs := index{index: QueryTestDetails}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- serve(ctx, listeners, dirs.ServeMux(), timeouts{read: 100 * time.Millisecond}) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	conn, err := net.Dial("tcp", listeners[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// A client that never finishes its request is cut off.
+	if _, err := conn.Write([]byte("GET /imports/a HTTP/1.1\r\nHost: localhost\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Errorf("got %v, want the connection closed by the server", err)
+	}
+}
+
+func TestServeH2C(t *testing.T) {
+	listeners, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dirs := index{index: QueryTestDetails}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	tm := timeouts{read: time.Minute, write: time.Minute, idle: time.Minute}
+	go func() { done <- serve(ctx, listeners, allowH2C(dirs.ServeMux(), tm), tm) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// A client with prior knowledge speaks HTTP/2 without TLS right away.
+	h2 := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+
+	url := "http://" + listeners[0].Addr().String() + "/imports/a/b"
+	for _, test := range []struct {
+		client *http.Client
+		proto  int
+	}{
+		{h2, 2},
+		{http.DefaultClient, 1},
+	} {
+		resp, err := test.client.Get(url)
+		if err != nil {
+			t.Fatalf("GET %s over HTTP/%d: %v", url, test.proto, err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.ProtoMajor != test.proto {
+			t.Errorf("GET %s: got HTTP/%d, want HTTP/%d", url, resp.ProtoMajor, test.proto)
+		}
+		if actual, out := slice(string(body)), []string{"a/b"}; !reflect.DeepEqual(actual, out) {
+			t.Errorf("GET %s over HTTP/%d: got %q, want %q", url, test.proto, actual, out)
+		}
+	}
+}
+
+func TestListenError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if _, err := listen("127.0.0.1:0," + l.Addr().String()); err == nil {
+		t.Errorf("listening on the busy %s: got no error", l.Addr())
+	}
+}
+
+func TestIndexIfChanged(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(ioutil.Discard)
+		log.SetFlags(log.LstdFlags)
+	}()
+
+	root := tempTree(t, "a/b", "c")
+	dirs := index{}
+	dirs.Roots([]string{root})
+
+	if !dirs.IndexIfChanged() {
+		t.Errorf("not indexed yet: got reindexing skipped")
+	}
+
+	buf.Reset()
+	if dirs.IndexIfChanged() {
+		t.Errorf("unchanged: got reindexed")
+	}
+	if !strings.Contains(buf.String(), "skipped: no changes") {
+		t.Errorf("unchanged: got log %q, want it to report the skip", buf.String())
+	}
+
+	// A new package deep in the tree changes its parent directory.
+	if err := os.Mkdir(filepath.Join(root, "a", "b", "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if !dirs.IndexIfChanged() {
+		t.Errorf("new directory: got reindexing skipped")
+	}
+	if dirs.IndexIfChanged() {
+		t.Errorf("unchanged after reindexing: got reindexed")
+	}
+
+	// Removing a directory is noticed even if the parent's
+	// modification time is preserved.
+	info, err := os.Stat(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(root, "c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(root, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if !dirs.IndexIfChanged() {
+		t.Errorf("removed directory: got reindexing skipped")
+	}
+}
+
+// TestIndexReconfigure is meant to be run with the race detector.
+func TestIndexReconfigure(t *testing.T) {
+	one := tempTree(t, "a", "a/b", "c")
+	two := tempTree(t, "d", "e/f")
+
+	dirs := index{indexSymbols: true}
+	dirs.Roots([]string{one})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			dirs.Roots([]string{one, two}[i%2:][:1])
+			dirs.Exclusions(strings.NewReader([]string{"b", "f"}[i%2]))
+			dirs.QueryIndex(context.Background(), "a", kindDirs, modeSuffix)
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		dirs.Index()
+		dirs.RefreshInvalid()
+	}
+	<-done
+
+	dirs.Roots([]string{two})
+	dirs.Exclusions(strings.NewReader("f"))
+	dirs.Index()
+
+	results, err := dirs.QueryIndex(context.Background(), "", kindDirs, modeSubstring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual := []string{}
+	for _, r := range results {
+		actual = append(actual, r.Path)
+	}
+	if want := prefixDir([]string{"/d"}, two); !reflect.DeepEqual(actual, want) {
+		t.Errorf("got %q, want %q", actual, want)
+	}
+}
+
+func TestRecent(t *testing.T) {
+	root := tempTree(t, "a", "b", "c", "c/d")
+
+	// All are dated back, and then a couple touched.
+	now := time.Now()
+	for i, dir := range []string{"a", "b", "c", "c/d", ""} {
+		mtime := now.Add(-time.Duration(i+1) * time.Hour)
+		if err := os.Chtimes(filepath.Join(root, filepath.FromSlash(dir)), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, dir := range []string{"c/d", "b"} {
+		mtime := now.Add(-time.Duration(i+1) * time.Minute)
+		if err := os.Chtimes(filepath.Join(root, filepath.FromSlash(dir)), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dirs := index{}
+	dirs.Roots([]string{root})
+	dirs.Index()
+
+	for _, test := range []struct {
+		query string
+		out   []string
+	}{
+		{"recent/", []string{"/c/d", "/b", "/a", "/c"}},
+		{"recent", []string{"/c/d", "/b", "/a", "/c"}},
+		{"recent/?limit=2", []string{"/c/d", "/b"}},
+		{"recent/?limit=10", []string{"/c/d", "/b", "/a", "/c"}},
+	} {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+		if rec.Code == http.StatusMovedPermanently {
+			req.URL.Path = rec.Header().Get("Location")
+			rec = httptest.NewRecorder()
+			dirs.ServeMux().ServeHTTP(rec, req)
+		}
+
+		if actual := slice(rec.Body.String()); reflect.DeepEqual(actual, prefixDir(test.out, root)) != true {
+			t.Errorf("%q: got %q, want %q", test.query, actual, prefixDir(test.out, root))
+		}
+	}
+
+	for _, query := range []string{"recent/?limit=0", "recent/?limit=x"} {
+		req, err := http.NewRequest("GET", hostPrefix+query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", query)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: got status %d, want %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(ioutil.Discard)
+		log.SetFlags(log.LstdFlags)
+	}()
+
+	dirs := index{index: QueryTestDetails, logRequests: true}
+
+	for _, test := range []struct {
+		query string
+		id    string // Sent, and expected back, unless empty.
+		code  int
+	}{
+		{"imports/a", "editor-42.7", http.StatusOK},
+		{"imports/a?mode=bogus", "editor-43", http.StatusBadRequest},
+		{"imports/a", "", http.StatusOK},
+		{"imports/a", "bad id\nstatus=200", http.StatusOK},
+	} {
+		buf.Reset()
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("X-Request-ID", test.id)
+
+		rec := httptest.NewRecorder()
+		dirs.Handler().ServeHTTP(rec, req)
+
+		id := rec.Header().Get("X-Request-ID")
+		if validRequestID(test.id) && id != test.id {
+			t.Errorf("%q: got request ID %q, want %q", test.query, id, test.id)
+		}
+		if !validRequestID(test.id) && (id == test.id || !validRequestID(id)) {
+			t.Errorf("%q: got request ID %q, want a generated one", test.query, id)
+		}
+
+		line := fmt.Sprintf("request id=%s method=GET uri=%q status=%d ", id, "/"+test.query, test.code)
+		if !strings.HasPrefix(buf.String(), line) {
+			t.Errorf("%q: got log %q, want it to begin with %q", test.query, buf.String(), line)
+		}
+
+		if test.code != http.StatusOK {
+			var body errorBody
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.RequestID != id {
+				t.Errorf("%q: got error %q, want request ID %q", test.query, rec.Body.String(), id)
+			}
+		}
+	}
+}
+
+// panicMatcher is a failing matcher.
+type panicMatcher struct{}
+
+func (panicMatcher) match(path string) (float64, bool) { panic("matcher failed") }
+func (panicMatcher) spans(path string) [][2]int        { return nil }
+
+func TestPanicRecovery(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(ioutil.Discard)
+		log.SetFlags(log.LstdFlags)
+	}()
+
+	defer func(f func(queryMode, string, string) matcher) { newMatcher = f }(newMatcher)
+	newMatcher = func(queryMode, string, string) matcher { return panicMatcher{} }
+
+	dirs := index{index: QueryTestDetails}
+
+	req, err := http.NewRequest("GET", hostPrefix+"imports/a", nil)
+	if err != nil {
+		t.Errorf("GET %q failed", "imports/a")
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Request-ID", "editor-44")
+
+	rec := httptest.NewRecorder()
+	dirs.Handler().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+	var body errorBody
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Code != "internal_server_error" || body.RequestID != "editor-44" {
+		t.Errorf("got error %q, want an internal_server_error with the request ID", rec.Body.String())
+	}
+
+	// The panic is logged with the stack.
+	if log := buf.String(); !strings.HasPrefix(log, `panic id=editor-44 uri="/imports/a": matcher failed`) ||
+		!strings.Contains(log, "panicMatcher.match") {
+		t.Errorf("got log %q, want the panic with the request ID and the stack", log)
+	}
+
+	// The index isn't left locked.
+	dirs.mu.Lock()
+	dirs.mu.Unlock()
+}
+
+var AllTests = []struct {
+	query string
+	code  int
+	out   []string
+}{
+	{"all/imports", http.StatusOK, []string{"a", "a/a", "ab/ab", "b/a"}},
+	{"all/imports?limit=2", http.StatusOK, []string{"a", "a/a"}},
+	{"all/imports?limit=10", http.StatusOK, []string{"a", "a/a", "ab/ab", "b/a"}},
+	{"all/dirs", http.StatusOK, []string{"/elsewhere/c", "/gopath/src/a/a", "/goroot/src/a", "/goroot/src/a/a", "/goroot/src/b/a", "/long path/ab/ab"}},
+	{"all/dirs?limit=1", http.StatusOK, []string{"/elsewhere/c"}},
+	{"all/imports?limit=0", http.StatusBadRequest, nil},
+	{"all/imports?limit=x", http.StatusBadRequest, nil},
+}
+
+func TestAll(t *testing.T) {
+	dirs := index{index: []details{
+		{fullPath: "/goroot/src/a/a", importPath: "a/a", valid: true},
+		{fullPath: "/goroot/src/b/a", importPath: "b/a", valid: true},
+		{fullPath: "/goroot/src/a", importPath: "a", valid: true},
+		{fullPath: "/goroot/src/a/b", importPath: "a/b", valid: false},
+		{fullPath: "/long path/ab/ab", importPath: "ab/ab", valid: true},
+		{fullPath: "/gopath/src/a/a", importPath: "a/a", valid: true},
+		{fullPath: "/elsewhere/c", importPath: ".", valid: true},
+	}}
+	for _, test := range AllTests {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		if rec.Code != test.code {
+			t.Errorf("%q: got status %d, want %d", test.query, rec.Code, test.code)
+			continue
+		}
+		if test.code != http.StatusOK {
+			continue
+		}
+
+		if actual := slice(rec.Body.String()); !reflect.DeepEqual(actual, test.out) {
+			t.Errorf("%q: got %q, want %q", test.query, actual, test.out)
+		}
+	}
+
+	// A configured token guards the dump.
+	dirs.updateToken = "secret"
+	for _, token := range []string{"", "wrong", "secret"} {
+		req, err := http.NewRequest("GET", hostPrefix+"all/imports", nil)
+		if err != nil {
+			t.Errorf("GET %q failed", "all/imports")
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		code := http.StatusUnauthorized
+		if token == "secret" {
+			code = http.StatusOK
+		}
+		if rec.Code != code {
+			t.Errorf("token %q: got status %d, want %d", token, rec.Code, code)
+		}
+	}
+
+	// The dump is subject to the response size limit.
+	dirs.updateToken, dirs.maxResponseBytes = "", len("a\na/a\n")
+	req, err := http.NewRequest("GET", hostPrefix+"all/imports", nil)
+	if err != nil {
+		t.Errorf("GET %q failed", "all/imports")
+	}
+
+	rec := httptest.NewRecorder()
+	dirs.ServeMux().ServeHTTP(rec, req)
+
+	if actual, want := slice(rec.Body.String()), []string{"a", "a/a"}; !reflect.DeepEqual(actual, want) || rec.Header().Get("X-Truncated") != "true" {
+		t.Errorf("limited: got %q (X-Truncated: %q), want %q, truncated", actual, rec.Header().Get("X-Truncated"), want)
+	}
+}
+
+var SuggestTests = []struct {
+	query       string
+	code        int
+	suggestions []string
+}{
+	{"imports/nte/http?suggest=1", http.StatusNotFound, []string{"net/http"}},
+	{"imports/htp?suggest=true", http.StatusNotFound, []string{"example.com/http", "net/http"}},
+	{"imports/zzzzzz?suggest=1", http.StatusNotFound, nil},
+	{"dirs/nte/http?suggest=1", http.StatusNotFound, []string{"/goroot/src/net/http"}},
+	{"symbols/Hnadler?suggest=1", http.StatusNotFound, nil},
+	{"imports/net/http?suggest=1", http.StatusOK, nil},
+	{"imports/nte/http", http.StatusOK, nil},
+	{"imports/nte/http?suggest=0", http.StatusOK, nil},
+	{"imports/nte/http?suggest=maybe", http.StatusBadRequest, nil},
+}
+
+func TestSuggest(t *testing.T) {
+	dirs := index{index: []details{
+		{fullPath: "/goroot/src/net/http", importPath: "net/http", valid: true},
+		{fullPath: "/goroot/src/net/url", importPath: "net/url", valid: true},
+		{fullPath: "/goroot/src/os", importPath: "os", valid: true},
+		{fullPath: "/goroot/src/net/htpp", importPath: "net/htpp", valid: false},
+		{fullPath: "/gopath/src/example.com/http", importPath: "example.com/http", valid: true},
+	}}
+	if runtime.GOOS == "windows" {
+		for i := range dirs.index {
+			dirs.index[i].fullPath = filepath.FromSlash(dirs.index[i].fullPath)
+		}
+	}
+
+	for _, test := range SuggestTests {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+		req.Header.Set("Accept", "application/json")
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		if rec.Code != test.code {
+			t.Errorf("%q: got status %d, want %d", test.query, rec.Code, test.code)
+			continue
+		}
+		if test.code != http.StatusNotFound {
+			continue
+		}
+
+		var body errorBody
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%q: %v", test.query, err)
+		}
+		suggestions := test.suggestions
+		if strings.HasPrefix(test.query, "dirs/") {
+			suggestions = prefixDir(suggestions, "")
+		}
+		if !reflect.DeepEqual(body.Suggestions, suggestions) {
+			t.Errorf("%q: got suggestions %q, want %q", test.query, body.Suggestions, suggestions)
+		}
+	}
+
+	// Plain text clients get the suggestions after the message.
+	req, err := http.NewRequest("GET", hostPrefix+"imports/htp?suggest=1", nil)
+	if err != nil {
+		t.Errorf("GET %q failed", "imports/htp?suggest=1")
+	}
+
+	rec := httptest.NewRecorder()
+	dirs.ServeMux().ServeHTTP(rec, req)
+
+	want := "no paths match \"htp\"\ndid you mean:\nexample.com/http\nnet/http\n"
+	if rec.Code != http.StatusNotFound || rec.Body.String() != want {
+		t.Errorf("plain text: got %d %q, want %d %q", rec.Code, rec.Body.String(), http.StatusNotFound, want)
+	}
+}
+
+var PostQueryTests = []struct {
+	body string
+	code int
+	out  []string
+}{
+	{`{"q": "a"}`, http.StatusOK, []string{"a", "a/a", "b/a"}},
+	{`{"q": "a/", "kind": "imports", "mode": "prefix"}`, http.StatusOK, []string{"a/a", "a/b/c"}},
+	{`{"q": "a", "limit": 2}`, http.StatusOK, []string{"a", "a/a"}},
+	{`{"q": "a", "limit": 10}`, http.StatusOK, []string{"a", "a/a", "b/a"}},
+	{`{"q": "a", "root": "/root/a"}`, http.StatusOK, []string{"a", "a/a"}},
+	{`{"q": "a", "root": "/root/a/", "limit": 1}`, http.StatusOK, []string{"a"}},
+	{`{"q": "a", "root": "/elsewhere"}`, http.StatusOK, []string{}},
+	{`{"q": "root/a", "kind": "dirs"}`, http.StatusOK, []string{"/root/a"}},
+	{`{"q": "a#b?c", "kind": "dirs"}`, http.StatusOK, []string{"/odd/a#b?c"}},
+	{`{"q": "a", "kind": "packages"}`, http.StatusBadRequest, nil},
+	{`{"q": "a", "mode": "bogus"}`, http.StatusBadRequest, nil},
+	{`{"q": "a", "limit": -1}`, http.StatusBadRequest, nil},
+	{`{"q": "a", "query": "a"}`, http.StatusBadRequest, nil},
+	{`{"q": `, http.StatusBadRequest, nil},
+}
+
+func TestPostQuery(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test paths are Unix paths")
+	}
+	dirs := index{index: append(QueryTestDetails[:len(QueryTestDetails):len(QueryTestDetails)],
+		details{fullPath: "/odd/a#b?c", importPath: "a#b?c", valid: true})}
+
+	for _, test := range PostQueryTests {
+		req, err := http.NewRequest("POST", hostPrefix+"query", strings.NewReader(test.body))
+		if err != nil {
+			t.Errorf("POST %q failed", test.body)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		if rec.Code != test.code {
+			t.Errorf("%s: got status %d, want %d", test.body, rec.Code, test.code)
+			continue
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: got Content-Type %q, want JSON", test.body, ct)
+		}
+		if test.code != http.StatusOK {
+			continue
+		}
+
+		var results []struct {
+			Path string `json:"path"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+			t.Fatalf("%s: %v", test.body, err)
+		}
+		paths := []string{}
+		for _, res := range results {
+			paths = append(paths, res.Path)
+		}
+		if !reflect.DeepEqual(paths, test.out) {
+			t.Errorf("%s: got %q, want %q", test.body, paths, test.out)
+		}
+	}
+
+	req, err := http.NewRequest("GET", hostPrefix+"query", nil)
+	if err != nil {
+		t.Errorf("GET %q failed", "query")
+	}
+
+	rec := httptest.NewRecorder()
+	dirs.ServeMux().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "POST" {
+		t.Errorf("GET: got status %d (Allow: %q), want %d", rec.Code, rec.Header().Get("Allow"), http.StatusMethodNotAllowed)
+	}
+}
+
+func TestRoots(t *testing.T) {
+	one := tempTree(t, "a", "a/b", "c/d")
+	two := tempTree(t, "x")
+	gone := tempTree(t, "y", "z")
+
+	dirs := index{}
+	if err := dirs.Roots([]string{one, two, gone}); err != nil {
+		t.Fatal(err)
+	}
+	dirs.Index()
+	if err := os.RemoveAll(gone); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", hostPrefix+"roots", nil)
+	if err != nil {
+		t.Errorf("GET %q failed", "roots")
+	}
+
+	rec := httptest.NewRecorder()
+	dirs.ServeMux().ServeHTTP(rec, req)
+
+	var actual []rootStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &actual); err != nil {
+		t.Fatal(err)
+	}
+	want := []rootStatus{
+		{Root: one, Exists: true, Readable: true, Packages: 3},
+		{Root: two, Exists: true, Readable: true, Packages: 1},
+		{Root: gone, Exists: false, Readable: false, Packages: 2},
+	}
+	if !reflect.DeepEqual(actual, want) {
+		t.Errorf("got %+v, want %+v", actual, want)
+	}
+
+	// The missing root keeps its packages through reindexing.
+	dirs.Index()
+	if actual := dirs.RootsStatus(); !reflect.DeepEqual(actual, want) {
+		t.Errorf("reindexed: got %+v, want %+v", actual, want)
+	}
+}
+
+func TestMaxDirEntries(t *testing.T) {
+	root := tempTree(t, "a", "media/sub/pkg", "src/x")
+	for i := 0; i < 30; i++ {
+		for _, dir := range []string{"media", "src"} {
+			name := filepath.Join(root, dir, fmt.Sprintf("%02d.jpg", i))
+			if err := ioutil.WriteFile(name, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "src", "src.go"), []byte("package src\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		max int
+		out []string
+	}{
+		{0, []string{"", "/a", "/media", "/src", "/media/sub", "/src/x", "/media/sub/pkg"}},
+		{31, []string{"", "/a", "/media", "/src", "/media/sub", "/src/x", "/media/sub/pkg"}},
+		{30, []string{"", "/a", "/media", "/src", "/src/x"}},
+		{3, []string{"", "/a", "/media", "/src", "/src/x"}},
+	} {
+		dirs := index{maxDirEntries: test.max}
+		dirs.Roots([]string{root})
+		dirs.Index()
+
+		indexed := []string{}
+		for _, c := range dirs.index {
+			indexed = append(indexed, c.fullPath)
+		}
+		out := prefixDir(test.out, root)
+		sort.Strings(indexed)
+		sort.Strings(out)
+		if !reflect.DeepEqual(indexed, out) {
+			t.Errorf("max %d: got %q indexed, want %q", test.max, indexed, out)
+		}
+
+		// The skipped directories aren't taken for changes.
+		if dirs.IndexIfChanged() {
+			t.Errorf("max %d: unchanged: got reindexed", test.max)
+		}
+
+		var buf bytes.Buffer
+		dirs.DryRun(&buf)
+		crowded := "skipped-crowded\t" + filepath.Join(root, "media") + "\t31 entries"
+		if found := strings.Contains(buf.String(), crowded+"\n"); found != (test.max > 0 && test.max < 31) {
+			t.Errorf("max %d: got dry run %q, reporting %q: %v", test.max, buf.String(), crowded, found)
+		}
+	}
+}
+
+var CountTests = []struct {
+	query  string
+	accept string
+	out    string
+}{
+	{"imports/a?count=1", "application/json", `{"count":3}` + "\n"},
+	{"imports/a?count=1", "", "3\n"},
+	{"imports/a?count=true&format=ndjson", "", `{"count":3}` + "\n"},
+	{"imports/a?count=1&stdlib=true", "", "0\n"},
+	{"imports/zzz?count=1&suggest=1", "application/json", `{"count":0}` + "\n"},
+	{"dirs/root?count=1&mode=prefix", "", "4\n"},
+	{"dirs/root?count=0&mode=prefix&format=csv", "", "full_path,import_path,valid,package\n/root/a/a,a/a,true,\n/root/b/a,b/a,true,\n/root/a,a,true,\n/root/ab,ab,true,\n"},
+}
+
+func TestCount(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test paths are Unix paths")
+	}
+	dirs := index{index: QueryTestDetails}
+
+	for _, test := range CountTests {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+		req.Header.Set("Accept", test.accept)
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK || rec.Body.String() != test.out {
+			t.Errorf("%q (Accept: %q): got %d %q, want %d %q",
+				test.query, test.accept, rec.Code, rec.Body.String(), http.StatusOK, test.out)
+		}
+	}
+
+	req, err := http.NewRequest("POST", hostPrefix+"query", strings.NewReader(`{"q": "a", "count": true}`))
+	if err != nil {
+		t.Errorf("POST %q failed", "query")
+	}
+
+	rec := httptest.NewRecorder()
+	dirs.ServeMux().ServeHTTP(rec, req)
+
+	if want := `{"count":3}` + "\n"; rec.Body.String() != want {
+		t.Errorf("POST: got %q, want %q", rec.Body.String(), want)
 	}
 }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// deepPath is a directory path exceeding the legacy MAX_PATH (260 characters).
+var deepPath = `C:\` + strings.Repeat(`long directory name\`, 15) + `deep`
+
+var WindowsPathTestDetails = []details{
+	{fullPath: `\\?\UNC\server\share\proj\a`, importPath: "proj/a", valid: true},
+	{fullPath: `\\server\share\proj\b`, importPath: "proj/b", valid: true},
+	{fullPath: `\\?\` + deepPath, importPath: "deep", valid: true},
+}
+
+var WindowsPathTests = []struct {
+	query string
+	out   []string
+}{
+	{"dirs/proj/a", []string{`\\?\UNC\server\share\proj\a`}},
+	{"dirs/share/proj/a", []string{`\\?\UNC\server\share\proj\a`}},
+	{"dirs/proj/b", []string{`\\server\share\proj\b`}},
+	{"dirs/long directory name/deep", []string{`\\?\` + deepPath}},
+	{"dirs/" + strings.Replace(deepPath, `\`, "/", -1), []string{`\\?\` + deepPath}},
+	{`dirs/proj\a`, []string{`\\?\UNC\server\share\proj\a`}},
+	{`dirs/share\proj/b`, []string{`\\server\share\proj\b`}},
+}
+
+func TestQueryWindowsPaths(t *testing.T) {
+	if len(deepPath) <= 260 {
+		t.Fatalf("deep path is %d characters long, want more than 260", len(deepPath))
+	}
+
+	dirs := index{index: WindowsPathTestDetails}
+
+	for _, test := range WindowsPathTests {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		if actual := slice(rec.Body.String()); reflect.DeepEqual(actual, test.out) != true {
+			t.Errorf("%q: got %q, want %q", test.query, actual, test.out)
+		}
+	}
+}
+
+var CaseTestDetails = []details{
+	{fullPath: `C:\Users\peter\AppData`, importPath: "", valid: false},
+	{fullPath: `C:\Users\peter\go\src\github.com\x\AppData`, importPath: "github.com/x/AppData", valid: true},
+}
+
+var CaseTests = []struct {
+	query string
+	out   []string
+}{
+	{"dirs/appdata", []string{`C:\Users\peter\go\src\github.com\x\AppData`}},
+	{"dirs/peter/APPDATA", []string{`C:\Users\peter\AppData`}},
+	{"imports/x/AppData", []string{"github.com/x/AppData"}},
+	{"imports/x/appdata", []string{""}},
+}
+
+func TestQueryDirsCase(t *testing.T) {
+	dirs := index{index: CaseTestDetails}
+
+	for _, test := range CaseTests {
+		req, err := http.NewRequest("GET", hostPrefix+test.query, nil)
+		if err != nil {
+			t.Errorf("GET %q failed", test.query)
+		}
+
+		rec := httptest.NewRecorder()
+		dirs.ServeMux().ServeHTTP(rec, req)
+
+		if actual := slice(rec.Body.String()); reflect.DeepEqual(actual, test.out) != true {
+			t.Errorf("%q: got %q, want %q", test.query, actual, test.out)
+		}
+	}
+}
+
+// TestUnreadableDirACL walks a directory whose ACL denies listing it
+// to everyone.
+func TestUnreadableDirACL(t *testing.T) {
+	root := tempTree(t, "a", "b/c", "d")
+	denied := filepath.Join(root, "b")
+
+	// Everyone's well-known SID, and the right to list a directory.
+	if out, err := exec.Command("icacls", denied, "/deny", "*S-1-1-0:(RD)").CombinedOutput(); err != nil {
+		t.Skipf("icacls: %v: %s", err, out)
+	}
+	defer exec.Command("icacls", denied, "/remove:d", "*S-1-1-0").Run()
+
+	testUnreadableDir(t, root, denied)
+}
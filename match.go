@@ -0,0 +1,340 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// queryMode selects how a query is matched against the indexed paths.
+type queryMode uint
+
+const (
+	modeSuffix     queryMode = iota // Path ends with the query.
+	modePrefix                      // Path starts with the query.
+	modeSubstring                   // Path contains the query.
+	modeFuzzy                       // Path contains the query's characters in order.
+	modeSegments                    // Path contains the query's segments consecutively.
+	modeComplete                    // Path ends with the query, except for the rest of the last segment.
+	modeUnanchored                  // Path ends with the query, within a segment or not.
+	modeGlob                        // Path ends with segments matching the query's wildcards.
+)
+
+var modeNames = map[string]queryMode{
+	"":           modeSuffix,
+	"suffix":     modeSuffix,
+	"prefix":     modePrefix,
+	"substring":  modeSubstring,
+	"fuzzy":      modeFuzzy,
+	"segments":   modeSegments,
+	"complete":   modeComplete,
+	"unanchored": modeUnanchored,
+	"glob":       modeGlob,
+}
+
+// parseMode returns the query mode by its name. An empty name selects
+// the default suffix mode.
+func parseMode(name string) (queryMode, error) {
+	mode, ok := modeNames[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown query mode %q", name)
+	}
+	return mode, nil
+}
+
+// caseFolding selects the parts of the query and the paths that are
+// matched case-insensitively.
+type caseFolding uint
+
+const (
+	foldNone caseFolding = iota // Match case-sensitively.
+	foldAll                     // Match case-insensitively.
+	foldLast                    // Match the last segment case-insensitively.
+)
+
+var foldingNames = map[string]caseFolding{
+	"":            foldNone,
+	"sensitive":   foldNone,
+	"insensitive": foldAll,
+	"last":        foldLast,
+}
+
+// parseFolding returns the case folding by its name. An empty name
+// selects the default case-sensitive matching.
+func parseFolding(name string) (caseFolding, error) {
+	f, ok := foldingNames[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown case %q", name)
+	}
+	return f, nil
+}
+
+// fold returns the path with the parts matched case-insensitively
+// lowercased. The last segment of a path ending with the separator sep,
+// as a query for the paths under the matching ones may, is the one
+// before the separator.
+func (f caseFolding) fold(path, sep string) string {
+	switch f {
+	case foldAll:
+		return strings.ToLower(path)
+	case foldLast:
+		i := strings.LastIndex(strings.TrimRight(path, sep), sep) + 1
+		return path[:i] + strings.ToLower(path[i:])
+	}
+	return path
+}
+
+// anchor returns the path with a single leading separator sep, so that
+// its first segment is bounded by a separator as the others are, whatever
+// the kind of the path: e.g., the import path “os”, or the directory
+// “/http” in the file system root. The query and the candidate paths
+// are anchored the same way.
+func anchor(path, sep string) string {
+	return sep + strings.TrimLeft(path, sep)
+}
+
+// matcher reports whether a candidate path matches a query and, for the
+// ranked modes, how well. The candidate paths are anchored (see anchor).
+type matcher interface {
+	match(path string) (score float64, ok bool)
+
+	// spans returns the byte offsets of the matched query characters
+	// in a matching path, as [start, end) pairs.
+	spans(path string) [][2]int
+}
+
+// ranked reports whether the results of the mode are ordered by score.
+func (mode queryMode) ranked() bool {
+	return mode == modeSubstring || mode == modeFuzzy
+}
+
+// newMatcher returns a matcher for the query in the given mode.
+// Suffix and prefix queries are anchored on the path separator sep,
+// so that, e.g., "os" matches "os" but not "paxos", unless the mode
+// is unanchored. A suffix query ending with the separator matches
+// the paths under the matching paths. It's a variable, so that
+// the tests can inject failing matchers.
+var newMatcher = func(mode queryMode, query, sep string) matcher {
+	anchored := anchor(query, sep)
+
+	switch mode {
+	case modePrefix:
+		return prefixMatcher(anchored)
+	case modeSubstring:
+		return substringMatcher(query)
+	case modeFuzzy:
+		return fuzzyMatcher(query)
+	case modeUnanchored:
+		return unanchoredMatcher(query)
+	case modeGlob:
+		return newGlobMatcher(query, sep)
+	case modeSegments:
+		return segmentsMatcher{strings.TrimRight(anchored, sep), sep}
+	case modeComplete:
+		i := strings.LastIndex(anchored, sep)
+		return completeMatcher{anchored[:i], anchored[i+len(sep):], sep}
+	}
+
+	// A trailing separator asks for the paths under the matching ones.
+	if strings.HasSuffix(query, sep) && strings.Trim(query, sep) != "" {
+		return childrenMatcher(sep + strings.Trim(query, sep) + sep)
+	}
+	return suffixMatcher(anchored)
+}
+
+type suffixMatcher string
+
+func (m suffixMatcher) match(path string) (float64, bool) {
+	return 0, strings.HasSuffix(path, string(m))
+}
+
+func (m suffixMatcher) spans(path string) [][2]int {
+	// Leave out the anchoring separator.
+	return span(len(path)-len(m)+1, len(path))
+}
+
+// unanchoredMatcher matches the paths ending with the query, even
+// in the middle of a segment, e.g., "os" matches "paxos". A query
+// starting with the separator is anchored, as in the suffix mode.
+type unanchoredMatcher string
+
+func (m unanchoredMatcher) match(path string) (float64, bool) {
+	return 0, strings.HasSuffix(path, string(m))
+}
+
+func (m unanchoredMatcher) spans(path string) [][2]int {
+	// Leave out the anchoring separator of an anchored query.
+	start := len(path) - len(m)
+	if start < len(path) && os.IsPathSeparator(path[start]) {
+		start++
+	}
+	return span(start, len(path))
+}
+
+// childrenMatcher matches the paths under the paths ending with the query,
+// e.g., "net/http/" matches "net/http/httptest" and "x/net/http/httpguts".
+type childrenMatcher string
+
+func (m childrenMatcher) match(path string) (float64, bool) {
+	i := strings.Index(path, string(m))
+	return 0, i >= 0 && i+len(m) < len(path)
+}
+
+func (m childrenMatcher) spans(path string) [][2]int {
+	// Leave out the anchoring and the trailing separators.
+	i := strings.Index(path, string(m))
+	return span(i+1, i+len(m)-1)
+}
+
+type prefixMatcher string
+
+func (m prefixMatcher) match(path string) (float64, bool) {
+	return 0, strings.HasPrefix(path, string(m))
+}
+
+func (m prefixMatcher) spans(path string) [][2]int {
+	return span(1, len(m))
+}
+
+// segmentsMatcher matches paths containing the query segments
+// consecutively, i.e. the query bounded by separators or the path end.
+type segmentsMatcher struct {
+	segments, sep string
+}
+
+func (m segmentsMatcher) match(path string) (float64, bool) {
+	return 0, m.index(path) >= 0
+}
+
+func (m segmentsMatcher) spans(path string) [][2]int {
+	i := m.index(path)
+	return span(i+1, i+len(m.segments))
+}
+
+// index returns the index of the first occurrence of the query segments
+// in path, or -1 if there is none.
+func (m segmentsMatcher) index(path string) int {
+	for pos := 0; ; {
+		i := strings.Index(path[pos:], m.segments)
+		if i < 0 {
+			return -1
+		}
+		end := pos + i + len(m.segments)
+		if end == len(path) || strings.HasPrefix(path[end:], m.sep) {
+			return pos + i
+		}
+		pos += i + len(m.sep)
+	}
+}
+
+// completeMatcher matches the paths whose last segment starts with
+// the last query segment, and whose other segments end with the other
+// query segments, e.g., "net/ht" matches "net/http" and "x/net/httpguts",
+// for completing partially typed paths.
+type completeMatcher struct {
+	head, last, sep string // The head is anchored, or empty.
+}
+
+func (m completeMatcher) match(path string) (float64, bool) {
+	i := strings.LastIndex(path, m.sep)
+	return 0, strings.HasSuffix(path[:i], m.head) && strings.HasPrefix(path[i+len(m.sep):], m.last)
+}
+
+func (m completeMatcher) spans(path string) [][2]int {
+	// Leave out the anchoring separator.
+	i := strings.LastIndex(path, m.sep)
+	start := i + len(m.sep)
+	if m.head != "" {
+		start = i - len(m.head) + len(m.sep)
+	}
+	return span(start, i+len(m.sep)+len(m.last))
+}
+
+type substringMatcher string
+
+func (m substringMatcher) match(path string) (float64, bool) {
+	i := strings.Index(path, string(m))
+	if i < 0 {
+		return 0, false
+	}
+	return score(path, i, i+len(m), len(m)), true
+}
+
+func (m substringMatcher) spans(path string) [][2]int {
+	i := strings.Index(path, string(m))
+	return span(i, i+len(m))
+}
+
+type fuzzyMatcher string
+
+func (m fuzzyMatcher) match(path string) (float64, bool) {
+	start, end, ok := m.window(path)
+	if !ok {
+		return 0, false
+	}
+	return score(path, start, end, len(m)), true
+}
+
+func (m fuzzyMatcher) spans(path string) (spans [][2]int) {
+	pos, _, _ := m.window(path)
+	for _, r := range string(m) {
+		i := pos + strings.IndexRune(path[pos:], r)
+		_, size := utf8.DecodeRuneInString(path[i:])
+		pos = i + size
+
+		// Merge adjacent characters.
+		if n := len(spans); n > 0 && spans[n-1][1] == i {
+			spans[n-1][1] = pos
+		} else {
+			spans = append(spans, [2]int{i, pos})
+		}
+	}
+	return
+}
+
+// window returns the shortest span of path containing
+// the query's characters in order.
+func (m fuzzyMatcher) window(path string) (start, end int, ok bool) {
+	// Find the leftmost end of a match...
+	for _, r := range string(m) {
+		i := strings.IndexRune(path[end:], r)
+		if i < 0 {
+			return 0, 0, false
+		}
+		_, size := utf8.DecodeRuneInString(path[end+i:])
+		end += i + size
+	}
+
+	// ...and then the shortest match ending there.
+	start = end
+	for q := string(m); q != ""; {
+		r, size := utf8.DecodeLastRuneInString(q)
+		start = strings.LastIndex(path[:start], string(r))
+		q = q[:len(q)-size]
+	}
+	return start, end, true
+}
+
+// span returns a single span, or none if it's empty.
+func span(start, end int) [][2]int {
+	if start >= end {
+		return nil
+	}
+	return [][2]int{{start, end}}
+}
+
+// score rates a match of n query bytes spanning path[start:end]. Compact
+// matches score higher, as do matches in shorter paths and matches starting
+// at a path segment.
+func score(path string, start, end, n int) float64 {
+	if n == 0 {
+		return 0
+	}
+
+	s := float64(n)/float64(end-start) + float64(n)/float64(len(path))
+	if start == 0 || os.IsPathSeparator(path[start-1]) || path[start-1] == '/' {
+		s++
+	}
+	return s
+}
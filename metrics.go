@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"go/build"
+	"go/scanner"
+	"net/http"
+)
+
+// The classes of the errors counted while indexing.
+const (
+	errorWalk             = "walk"              // A directory couldn't be read.
+	errorParse            = "parse"             // A Go file has a syntax error.
+	errorMultiplePackages = "multiple_packages" // Files of different packages.
+	errorPanic            = "panic"             // Importing the package panicked.
+	errorOther            = "other"
+)
+
+var errorClasses = []string{errorWalk, errorParse, errorMultiplePackages, errorPanic, errorOther}
+
+// errorClass returns the class of an error of build.ImportDir, or ""
+// if there's no error or the directory just has no Go files.
+func errorClass(err error) string {
+	switch err.(type) {
+	case nil, *build.NoGoError:
+		return ""
+	case scanner.ErrorList:
+		return errorParse
+	case *build.MultiplePackageError:
+		return errorMultiplePackages
+	case importPanic:
+		return errorPanic
+	}
+	return errorOther
+}
+
+// MetricsHandler reports the indexing counters in the Prometheus text
+// exposition format, for alerting on failing index updates.
+func (dirs *index) MetricsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dirs.mu.RLock()
+		runs, last, directories := dirs.indexRuns, dirs.lastIndexed, len(dirs.index)
+		errs := map[string]uint64{}
+		for class, n := range dirs.indexErrors {
+			errs[class] = n
+		}
+		dirs.mu.RUnlock()
+
+		lastSeconds := 0.0
+		if !last.IsZero() {
+			lastSeconds = float64(last.UnixNano()) / 1e9
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		fmt.Fprintln(w, "# HELP gopaths_index_runs_total Number of completed indexing runs.")
+		fmt.Fprintln(w, "# TYPE gopaths_index_runs_total counter")
+		fmt.Fprintf(w, "gopaths_index_runs_total %d\n", runs)
+
+		fmt.Fprintln(w, "# HELP gopaths_index_errors_total Number of directories that failed to be read or imported while indexing.")
+		fmt.Fprintln(w, "# TYPE gopaths_index_errors_total counter")
+		for _, class := range errorClasses {
+			fmt.Fprintf(w, "gopaths_index_errors_total{class=%q} %d\n", class, errs[class])
+		}
+
+		fmt.Fprintln(w, "# HELP gopaths_index_last_success_timestamp_seconds Time the last indexing run completed.")
+		fmt.Fprintln(w, "# TYPE gopaths_index_last_success_timestamp_seconds gauge")
+		fmt.Fprintf(w, "gopaths_index_last_success_timestamp_seconds %.3f\n", lastSeconds)
+
+		fmt.Fprintln(w, "# HELP gopaths_index_directories Number of indexed directories.")
+		fmt.Fprintln(w, "# TYPE gopaths_index_directories gauge")
+		fmt.Fprintf(w, "gopaths_index_directories %d\n", directories)
+	}
+}
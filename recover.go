@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"go/build"
+	"log"
+	"net/http"
+	"runtime/debug"
+)
+
+// recoverPanics returns a handler recovering from the panics of h, so that
+// a failing query gets “500 Internal Server Error” rather than a dropped
+// connection. The panics are logged with the request ID and the stack.
+func recoverPanics(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+
+			log.Printf("panic id=%s uri=%q: %v\n%s", requestID(r.Context()), r.URL.RequestURI(), err, debug.Stack())
+			writeError(w, r, "internal server error", http.StatusInternalServerError)
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// importDir imports the package in the directory. It's a variable,
+// so that the tests can inject panics.
+var importDir = func(dir string) (*build.Package, error) {
+	return build.Default.ImportDir(dir, 0)
+}
+
+// importPanic is the error of an import that panicked, e.g., in go/parser
+// on a malformed file.
+type importPanic struct {
+	value interface{}
+}
+
+func (e importPanic) Error() string {
+	return fmt.Sprintf("panic: %v", e.value)
+}
+
+// importPackage imports the package in the directory like
+// build.Default.ImportDir, recovering from a panic, so that a bad package
+// doesn't crash the indexer. A panic is logged with the stack, and returned
+// as an importPanic, with the package found without reading its files.
+func importPackage(dir string) (p *build.Package, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			p, err = panicked(dir, v)
+		}
+	}()
+	return importDir(dir)
+}
+
+// panicked logs the panic of importing the package in dir, or of reading
+// its files, with the stack, and returns the package found without
+// reading its files, and the panic as an importPanic. It's called by
+// the deferred functions recovering from the panics.
+func panicked(dir string, v interface{}) (*build.Package, error) {
+	log.Printf("panic importing %s: %v\n%s", dir, v, debug.Stack())
+	p, _ := build.Default.ImportDir(dir, build.FindOnly)
+	return p, importPanic{v}
+}
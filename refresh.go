@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// refreshQuiet is how long a directory must stay unmodified before its
+// entry is refreshed, so that packages being edited are left to settle.
+const refreshQuiet = 2 * time.Second
+
+// RefreshInvalid imports again the directories of the invalid entries
+// (e.g., of packages with syntax errors) modified since they were indexed,
+// and marks the entries valid if there are packages in them now. This is
+// much cheaper than reindexing. It returns the number of entries marked valid.
+func (dirs *index) RefreshInvalid() int {
+	type stale struct {
+		i       int
+		path    string
+		modTime time.Time
+	}
+
+	// Look for modified directories without holding up the queries.
+	dirs.mu.RLock()
+	cfg := dirs.snapshot()
+	candidates := []stale{}
+	for i, c := range dirs.index {
+		if !c.valid {
+			candidates = append(candidates, stale{i, c.fullPath, c.modTime})
+		}
+	}
+	dirs.mu.RUnlock()
+
+	refreshed := []stale{}
+	for _, c := range candidates {
+		modTime := dirModTime(c.path)
+		if modTime.After(c.modTime) && time.Since(modTime) >= refreshQuiet {
+			refreshed = append(refreshed, stale{c.i, c.path, modTime})
+		}
+	}
+	if len(refreshed) == 0 {
+		return 0
+	}
+
+	// Import the packages without holding up the queries either,
+	// interning the strings as an indexing run does.
+	pool := interner{}
+	visits := make([]visit, len(refreshed))
+	dirTimes := make([]time.Time, len(refreshed))
+	for i, c := range refreshed {
+		visits[i] = cfg.visit(c.path)
+		if info, err := os.Stat(c.path); err == nil {
+			dirTimes[i] = info.ModTime()
+		}
+	}
+
+	dirs.mu.Lock()
+	defer dirs.mu.Unlock()
+
+	// Update copies, as an indexing run may be reading the originals.
+	index := append([]details(nil), dirs.index...)
+	symbols := make(map[string]symbolSet, len(dirs.symbols))
+	for dir, s := range dirs.symbols {
+		symbols[dir] = s
+	}
+
+	promoted := 0
+	for i, c := range refreshed {
+		// The index may have been rebuilt in the meantime.
+		if c.i >= len(index) || index[c.i].fullPath != c.path {
+			continue
+		}
+
+		e := &index[c.i]
+		e.modTime = c.modTime
+		v := visits[i]
+		if v.err != nil {
+			continue
+		}
+
+		// A valid entry has the modification time of the directory only.
+		pool.fillPackage(e, v)
+		e.modTime = dirTimes[i]
+		if cfg.indexSymbols {
+			symbols[c.path] = v.symbols
+		}
+		promoted++
+	}
+	dirs.index, dirs.symbols = index, symbols
+	if promoted > 0 {
+		dirs.cache.clear()
+		log.Printf("Refreshed %d directories", promoted)
+	}
+	return promoted
+}
+
+// RefreshInvalidEvery refreshes the invalid entries at the interval d,
+// unless the index is frozen.
+func (dirs *index) RefreshInvalidEvery(d time.Duration) {
+	if dirs.frozen {
+		return
+	}
+	for range time.Tick(d) {
+		dirs.RefreshInvalid()
+	}
+}
+
+// dirModTime returns the latest modification time of the directory
+// and the Go files in it.
+func dirModTime(dir string) (t time.Time) {
+	if info, err := os.Stat(dir); err == nil {
+		t = info.ModTime()
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	for _, info := range files {
+		if strings.HasSuffix(info.Name(), ".go") && info.ModTime().After(t) {
+			t = info.ModTime()
+		}
+	}
+	return
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// reindex asks the server listening on the first of the comma separated
+// addresses, as given to -http, to update its index, waits for the update
+// to complete, and writes the number of packages found to w. The token,
+// if set, is sent as the bearer token /update may require.
+func reindex(w io.Writer, addrs, token string) error {
+	client, base := serverClient(strings.Split(addrs, ",")[0])
+
+	req, err := http.NewRequest("POST", base+"/update", nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if err := do(client, req, nil); err != nil {
+		return fmt.Errorf("update: %v", err)
+	}
+
+	req, err = http.NewRequest("GET", base+"/roots", nil)
+	if err != nil {
+		return err
+	}
+	roots := []rootStatus{}
+	if err := do(client, req, &roots); err != nil {
+		return fmt.Errorf("roots: %v", err)
+	}
+
+	packages := 0
+	for _, root := range roots {
+		packages += root.Packages
+	}
+	fmt.Fprintf(w, "Indexed %d packages\n", packages)
+	return nil
+}
+
+// serverClient returns the client and the base URL of the requests
+// to the server at the address, either a TCP address, with the host
+// defaulting to localhost, or a Unix socket path prefixed with "unix:".
+func serverClient(addr string) (*http.Client, string) {
+	addr = strings.TrimSpace(addr)
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}
+		return &http.Client{Transport: &http.Transport{DialContext: dial}}, "http://unix"
+	}
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
+	}
+	return http.DefaultClient, "http://" + addr
+}
+
+// do sends the request and decodes the JSON response into v, if not nil.
+// Responses other than “200 OK” are errors with their messages.
+func do(client *http.Client, req *http.Request, v interface{}) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"time"
+)
+
+// maxRequestIDLen is the maximum length of an incoming request ID.
+const maxRequestIDLen = 128
+
+type requestIDKey struct{}
+
+// requestID returns the ID of the request the context belongs to, if any.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Handler returns the handler of the ServeMux routes, tagging each
+// request with an ID, and logging the requests if enabled. The ID is
+// taken from the X-Request-ID header or, in its absence, generated;
+// either way, it's sent back in the X-Request-ID header. Handler panics
+// are answered with “500 Internal Server Error”.
+func (dirs *index) Handler() http.Handler {
+	mux := recoverPanics(dirs.ServeMux())
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+
+		if !dirs.logRequests {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		mux.ServeHTTP(sw, r)
+		log.Printf("request id=%s method=%s uri=%q status=%d duration=%s",
+			id, r.Method, r.URL.RequestURI(), sw.status, time.Since(start))
+	})
+}
+
+// validRequestID reports whether the incoming request ID is short and
+// limited to the characters that can't disrupt a log line.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random request ID.
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// statusWriter records the status code of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush flushes the response, for streaming NDJSON.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
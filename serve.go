@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// shutdownTimeout is how long the servers wait for the requests
+// in progress to complete on shutdown.
+const shutdownTimeout = 5 * time.Second
+
+// listen listens on the comma separated addresses: TCP addresses,
+// e.g., "localhost:6118", and Unix socket paths prefixed with "unix:".
+func listen(addrs string) ([]net.Listener, error) {
+	listeners := []net.Listener{}
+	for _, addr := range strings.Split(addrs, ",") {
+		network, address := "tcp", strings.TrimSpace(addr)
+		if strings.HasPrefix(address, "unix:") {
+			network, address = "unix", strings.TrimPrefix(address, "unix:")
+		}
+
+		l, err := net.Listen(network, address)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// listenAddrs returns the addresses the listeners listen on, written as
+// for listen, e.g., with the port the system picked for "localhost:0".
+func listenAddrs(listeners []net.Listener) []string {
+	addrs := make([]string, len(listeners))
+	for i, l := range listeners {
+		addrs[i] = l.Addr().String()
+		if l.Addr().Network() == "unix" {
+			addrs[i] = "unix:" + addrs[i]
+		}
+	}
+	return addrs
+}
+
+// timeouts are the timeouts of the servers, as in http.Server;
+// zero means no timeout.
+type timeouts struct {
+	read  time.Duration // Of reading a request, body included.
+	write time.Duration // Of writing a response, from the end of the request headers.
+	idle  time.Duration // Of waiting for the next request on a kept-alive connection.
+}
+
+// allowH2C returns the handler serving HTTP/2 over cleartext (h2c)
+// connections too, for the clients multiplexing their queries on
+// a connection without TLS, e.g., on localhost: the ones starting with
+// the HTTP/2 connection preface (prior knowledge) and the ones upgrading
+// from HTTP/1.1. The other requests are served by the handler as they are.
+func allowH2C(handler http.Handler, t timeouts) http.Handler {
+	return h2c.NewHandler(handler, &http2.Server{IdleTimeout: t.idle})
+}
+
+// serve serves the handler on each of the listeners until ctx is done
+// or one of the servers fails, and then shuts all of them down.
+// It returns the error of the failed server, if any. The servers cut off
+// the clients exceeding the timeouts, so that slow or stalled clients
+// don't hold up connections.
+func serve(ctx context.Context, listeners []net.Listener, handler http.Handler, t timeouts) error {
+	servers := []*http.Server{}
+	errc := make(chan error, len(listeners))
+	for _, l := range listeners {
+		srv := &http.Server{
+			Handler:      handler,
+			ReadTimeout:  t.read,
+			WriteTimeout: t.write,
+			IdleTimeout:  t.idle,
+		}
+		servers = append(servers, srv)
+		go func(l net.Listener) { errc <- srv.Serve(l) }(l)
+	}
+
+	var err error
+	select {
+	case err = <-errc:
+	case <-ctx.Done():
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		srv.Shutdown(ctx)
+	}
+
+	if err == http.ErrServerClosed {
+		err = nil
+	}
+	return err
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+// maxSuggestions is the maximum number of suggestions for a query
+// without matches.
+const maxSuggestions = 5
+
+// Suggest returns up to maxSuggestions import paths, or directories if kind
+// is kindDirs, of the packages closest to the query, for a query without
+// matches, e.g., with a typo. The trailing path elements of the packages,
+// as many as the query has, are compared with the query by edit distance;
+// the paths at most a third of the query length away are suggested,
+// the closest first. There are no suggestions for symbols. If permitted
+// isn't nil, only the packages under the permitted directories are.
+func (dirs *index) Suggest(query string, kind queryKind, permitted []string) []string {
+	if kind == kindSymbols {
+		return nil
+	}
+
+	dirs.mu.RLock()
+	defer dirs.mu.RUnlock()
+
+	sep := "/"
+	if kind == kindDirs {
+		sep = string(os.PathSeparator)
+	}
+	query = strings.Trim(strings.NewReplacer("/", sep, `\`, sep).Replace(query), sep)
+	query = matchKey(query, kind)
+	if query == "" {
+		return nil
+	}
+	elems := strings.Count(query, sep) + 1
+	maxDist := len([]rune(query)) / 3
+	if maxDist < 1 {
+		maxDist = 1
+	}
+
+	type suggestion struct {
+		path string
+		dist int
+	}
+	suggestions := []suggestion{}
+	seen := map[string]bool{}
+	for _, c := range dirs.index {
+		path := c.importPath
+		if kind == kindDirs {
+			path = c.fullPath
+		}
+		if !c.valid || path == "." || seen[path] || !permits(permitted, c.fullPath) {
+			continue
+		}
+		seen[path] = true
+
+		if d := editDistance(query, lastElems(matchKey(path, kind), sep, elems)); d <= maxDist {
+			suggestions = append(suggestions, suggestion{path, d})
+		}
+	}
+
+	sort.Slice(suggestions, func(i, j int) bool {
+		if suggestions[i].dist != suggestions[j].dist {
+			return suggestions[i].dist < suggestions[j].dist
+		}
+		return suggestions[i].path < suggestions[j].path
+	})
+	if len(suggestions) > maxSuggestions {
+		suggestions = suggestions[:maxSuggestions]
+	}
+
+	paths := make([]string, len(suggestions))
+	for i, s := range suggestions {
+		paths[i] = s.path
+	}
+	return paths
+}
+
+// lastElems returns the last n elements of the path separated by sep.
+func lastElems(path, sep string, n int) string {
+	i := len(path)
+	for ; n > 0 && i >= 0; n-- {
+		i = strings.LastIndex(path[:i], sep)
+	}
+	return path[i+1:]
+}
+
+// editDistance returns the Levenshtein distance between a and b:
+// the number of characters to insert, delete or substitute
+// to turn a into b.
+func editDistance(a, b string) int {
+	s, t := []rune(a), []rune(b)
+	prev, cur := make([]int, len(t)+1), make([]int, len(t)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(s); i++ {
+		cur[0] = i
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(t)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
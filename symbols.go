@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// symbolSet is the exported top-level identifiers of a package,
+// collected when the package was last modified at modTime.
+type symbolSet struct {
+	modTime time.Time
+	names   []string
+}
+
+// has reports whether the package exports the name.
+func (s symbolSet) has(name string) bool {
+	i := sort.SearchStrings(s.names, name)
+	return i < len(s.names) && s.names[i] == name
+}
+
+// packageSymbols returns the exported symbols of the package p in dir.
+// Parsing is expensive, so the symbols of the packages unchanged since
+// the previous indexing run are reused.
+func (dirs *index) packageSymbols(dir string, p *build.Package) symbolSet {
+	modTime := packageModTime(dir, p)
+	if s, ok := dirs.symbols[dir]; ok && s.modTime.Equal(modTime) {
+		return s
+	}
+	return symbolSet{modTime: modTime, names: exportedSymbols(dir, packageFiles(p))}
+}
+
+// packageFiles returns the names of the Go files of the package p,
+// the ones importing "C" included.
+func packageFiles(p *build.Package) []string {
+	return append(append([]string(nil), p.GoFiles...), p.CgoFiles...)
+}
+
+// packageModTime returns the latest modification time of the directory
+// and its Go files, so that both adding and editing files are noticed.
+func packageModTime(dir string, p *build.Package) (t time.Time) {
+	for _, name := range append([]string{"."}, packageFiles(p)...) {
+		if info, err := os.Stat(filepath.Join(dir, name)); err == nil && info.ModTime().After(t) {
+			t = info.ModTime()
+		}
+	}
+	return
+}
+
+// parseFile parses the Go file for its declarations. It's a variable,
+// so that the tests can inject panics.
+var parseFile = func(fset *token.FileSet, path string) (*ast.File, error) {
+	return parser.ParseFile(fset, path, nil, parser.SkipObjectResolution)
+}
+
+// exportedSymbols returns the sorted exported top-level function, type,
+// constant, and variable names declared in the files. Methods are left out.
+// Files that don't parse are skipped.
+func exportedSymbols(dir string, files []string) []string {
+	seen := map[string]bool{}
+	add := func(id *ast.Ident) {
+		if id.IsExported() {
+			seen[id.Name] = true
+		}
+	}
+
+	fset := token.NewFileSet()
+	for _, name := range files {
+		f, err := parseFile(fset, filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+
+		for _, decl := range f.Decls {
+			switch decl := decl.(type) {
+			case *ast.FuncDecl:
+				if decl.Recv == nil {
+					add(decl.Name)
+				}
+			case *ast.GenDecl:
+				for _, spec := range decl.Specs {
+					switch spec := spec.(type) {
+					case *ast.TypeSpec:
+						add(spec.Name)
+					case *ast.ValueSpec:
+						for _, id := range spec.Names {
+							add(id)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// querySymbols returns the import paths of the packages exporting
+// a symbol with exactly the given name. The caller holds dirs.mu.
+func (dirs *index) querySymbols(ctx context.Context, name string) (out []result, err error) {
+	out = []result{}
+	for i, c := range dirs.index {
+		if i%cancelCheckInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				break
+			}
+		}
+
+		if c.valid && dirs.symbols[c.fullPath].has(name) {
+			out = append(out, newResult(c, c.importPath))
+		}
+	}
+	return
+}
+
+// splitSymbol splits a symbol name, e.g., “Handler”, “http.Handler”
+// or “net/http.Handler”, into the qualifier of the package, if any,
+// and the exported identifier, or reports it isn't an exported
+// identifier. The qualifier ends at the last dot after the last slash,
+// as in “gopkg.in/yaml.v3.Marshal”.
+func splitSymbol(name string) (qualifier, symbol string, ok bool) {
+	symbol = name
+	if i := strings.LastIndex(name, "."); i > strings.LastIndex(name, "/") {
+		qualifier, symbol = name[:i], name[i+1:]
+		if qualifier == "" {
+			return "", "", false
+		}
+	}
+	return qualifier, symbol, token.IsIdentifier(symbol) && token.IsExported(symbol)
+}
+
+// qualifies reports whether the qualifier of a symbol, a package name
+// or an import path, or its trailing elements, refers to the package.
+// An empty qualifier refers to any package.
+func (c details) qualifies(qualifier string) bool {
+	return qualifier == "" || qualifier == c.name || qualifier == c.importPath ||
+		strings.HasSuffix(c.importPath, "/"+qualifier)
+}
+
+// SymbolOwners returns the packages exporting exactly the symbol,
+// which the qualifier, if set, refers to: the importable packages first,
+// and then the commands and test-only packages, which only the packages
+// beside them could use.
+func (dirs *index) SymbolOwners(qualifier, symbol string) []details {
+	dirs.mu.RLock()
+	defer dirs.mu.RUnlock()
+
+	importable, others := []details{}, []details{}
+	for _, c := range dirs.index {
+		if !c.valid || !c.qualifies(qualifier) || !dirs.symbols[c.fullPath].has(symbol) {
+			continue
+		}
+		if c.isCommand() || c.testOnly {
+			others = append(others, c)
+		} else {
+			importable = append(importable, c)
+		}
+	}
+	return append(importable, others...)
+}